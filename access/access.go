@@ -0,0 +1,111 @@
+// Package access decides which users may log in to a client, based on the
+// roles the client requires.
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"simple-login-endpoint/flow"
+	"slices"
+	"strings"
+)
+
+// MetadataRequiredRoles lists the roles a user needs for the client, as a
+// list or a comma separated string in the metadata of the Hydra client.
+const MetadataRequiredRoles = "required_roles"
+
+// Policy holds the required roles per client ID configured in the identity
+// provider. A user needs every required role of the client.
+type Policy struct {
+	clients map[string][]string
+}
+
+func NewPolicy(clients map[string][]string) *Policy {
+	policy := &Policy{clients: make(map[string][]string)}
+	for clientID, roles := range clients {
+		if roles = normalizeRoles(roles); len(roles) > 0 {
+			policy.clients[clientID] = roles
+		}
+	}
+	return policy
+}
+
+// NewPolicyFromEnv reads the JSON file CLIENT_ACCESS_FILE mapping client IDs
+// to their required roles, e.g. {"admin-ui": ["admin"]}.
+func NewPolicyFromEnv() (policy *Policy, err error) {
+	clients := make(map[string][]string)
+
+	if file := os.Getenv("CLIENT_ACCESS_FILE"); file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &clients); err != nil {
+			return nil, fmt.Errorf("client access %s: %w", file, err)
+		}
+	}
+
+	return NewPolicy(clients), nil
+}
+
+func Must(policy *Policy, err error) *Policy {
+	if err != nil {
+		panic("could not load client access policy: " + err.Error())
+	}
+	return policy
+}
+
+// RequiredRoles returns the roles of the configuration file and of the
+// client metadata. A nil client requires no role.
+func (p *Policy) RequiredRoles(client *flow.Client) []string {
+	if client == nil {
+		return nil
+	}
+
+	required := slices.Clone(p.clients[client.ClientID])
+	for _, role := range metadataRoles(client.Metadata[MetadataRequiredRoles]) {
+		if !slices.Contains(required, role) {
+			required = append(required, role)
+		}
+	}
+	return required
+}
+
+// Missing returns the required roles of the client the user does not have.
+func (p *Policy) Missing(client *flow.Client, roles []string) []string {
+	var missing []string
+	for _, role := range p.RequiredRoles(client) {
+		if !slices.Contains(roles, role) {
+			missing = append(missing, role)
+		}
+	}
+	return missing
+}
+
+func metadataRoles(value interface{}) []string {
+	switch roles := value.(type) {
+	case string:
+		return normalizeRoles(strings.Split(roles, ","))
+	case []interface{}:
+		var values []string
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				values = append(values, role)
+			}
+		}
+		return normalizeRoles(values)
+	default:
+		return nil
+	}
+}
+
+func normalizeRoles(roles []string) []string {
+	var normalized []string
+	for _, role := range roles {
+		if role = strings.TrimSpace(role); role != "" && !slices.Contains(normalized, role) {
+			normalized = append(normalized, role)
+		}
+	}
+	return normalized
+}
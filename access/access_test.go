@@ -0,0 +1,72 @@
+package access
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"simple-login-endpoint/flow"
+	"slices"
+	"testing"
+)
+
+func TestMissing(t *testing.T) {
+	//given
+	policy := NewPolicy(map[string][]string{"admin-ui": {"admin", " "}, "empty": {""}})
+
+	cases := []struct {
+		client  *flow.Client
+		roles   []string
+		missing []string
+	}{
+		{&flow.Client{ClientID: "admin-ui"}, []string{"user", "admin"}, nil},
+		{&flow.Client{ClientID: "admin-ui"}, []string{"user"}, []string{"admin"}},
+		{&flow.Client{ClientID: "admin-ui", Metadata: map[string]interface{}{MetadataRequiredRoles: []interface{}{"staff", "admin"}}}, []string{"admin"}, []string{"staff"}},
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataRequiredRoles: "user, staff"}}, nil, []string{"user", "staff"}},
+		{&flow.Client{ClientID: "app"}, nil, nil},
+		{&flow.Client{ClientID: "empty"}, nil, nil},
+		{nil, nil, nil},
+	}
+
+	for _, c := range cases {
+		//when
+		missing := policy.Missing(c.client, c.roles)
+
+		//then
+		if !slices.Equal(missing, c.missing) {
+			log.Println("unexpected missing roles for", c.client, missing)
+			t.Fail()
+		}
+	}
+}
+
+func TestNewPolicyFromEnv(t *testing.T) {
+	//given
+	file := filepath.Join(t.TempDir(), "access.json")
+	if err := os.WriteFile(file, []byte(`{"admin-ui": ["admin"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLIENT_ACCESS_FILE", file)
+
+	//when
+	policy, err := NewPolicyFromEnv()
+
+	//then
+	if err != nil || !slices.Equal(policy.RequiredRoles(&flow.Client{ClientID: "admin-ui"}), []string{"admin"}) {
+		log.Println("access file not loaded:", err)
+		t.FailNow()
+	}
+
+	//given
+	if err := os.WriteFile(file, []byte(`["admin"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	_, err = NewPolicyFromEnv()
+
+	//then
+	if err == nil {
+		log.Println("invalid access file accepted")
+		t.Fail()
+	}
+}
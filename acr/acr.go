@@ -0,0 +1,140 @@
+// Package acr maps the authentication context class references a client can
+// request with acr_values to the combinations of authentication methods (amr)
+// a login has to use.
+package acr
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// The default levels in ascending order.
+const (
+	// Password is reached by a login with the password.
+	Password = "pwd"
+	// MFA is reached by the password and a second factor.
+	MFA = "mfa"
+	// Passkey is reached by a login verified with a passkey.
+	Passkey = "passkey"
+)
+
+// Level is reached by a login that used all methods of one of the AMR
+// combinations, e.g. [["pwd","otp"],["pwd","hwk"]].
+type Level struct {
+	ACR string     `json:"acr"`
+	AMR [][]string `json:"amr"`
+}
+
+// Levels are ordered from the weakest to the strongest. A login reaching a
+// level satisfies all weaker levels as well.
+type Levels struct {
+	levels []Level
+}
+
+// DefaultLevels returns password, password and TOTP or passkey, and passkey.
+func DefaultLevels() []Level {
+	return []Level{
+		{ACR: Password, AMR: [][]string{{"pwd"}}},
+		{ACR: MFA, AMR: [][]string{{"pwd", "otp"}, {"pwd", "hwk"}}},
+		{ACR: Passkey, AMR: [][]string{{"hwk"}}},
+	}
+}
+
+// NewLevels fails if an ACR is empty or used twice, or if a level has no
+// AMR combination.
+func NewLevels(levels ...Level) (*Levels, error) {
+	seen := make(map[string]bool)
+	for _, level := range levels {
+		if level.ACR == "" {
+			return nil, fmt.Errorf("level without acr")
+		}
+		if seen[level.ACR] {
+			return nil, fmt.Errorf("duplicate acr %s", level.ACR)
+		}
+		seen[level.ACR] = true
+
+		if len(level.AMR) == 0 {
+			return nil, fmt.Errorf("acr %s has no amr", level.ACR)
+		}
+		for _, methods := range level.AMR {
+			if len(methods) == 0 {
+				return nil, fmt.Errorf("acr %s has an empty amr combination", level.ACR)
+			}
+		}
+	}
+	return &Levels{levels: levels}, nil
+}
+
+// NewLevelsFromEnv reads the JSON file ACR_LEVELS_FILE with a list of levels
+// from the weakest to the strongest. Without the file the default levels
+// apply.
+func NewLevelsFromEnv() (*Levels, error) {
+	file := os.Getenv("ACR_LEVELS_FILE")
+	if file == "" {
+		return NewLevels(DefaultLevels()...)
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var levels []Level
+	if err := json.Unmarshal(content, &levels); err != nil {
+		return nil, fmt.Errorf("acr levels %s: %w", file, err)
+	}
+	return NewLevels(levels...)
+}
+
+func Must(levels *Levels, err error) *Levels {
+	if err != nil {
+		panic("could not load acr levels: " + err.Error())
+	}
+	return levels
+}
+
+// Achieved returns the strongest level reached by the authentication
+// methods, or an empty string.
+func (l *Levels) Achieved(amr []string) string {
+	for i := len(l.levels) - 1; i >= 0; i-- {
+		for _, methods := range l.levels[i].AMR {
+			if containsAll(amr, methods) {
+				return l.levels[i].ACR
+			}
+		}
+	}
+	return ""
+}
+
+// Required returns the weakest of the requested levels, since the client
+// accepts any of them. Unknown values are ignored, an empty string means no
+// level is required.
+func (l *Levels) Required(acrValues []string) string {
+	for _, level := range l.levels {
+		if slices.Contains(acrValues, level.ACR) {
+			return level.ACR
+		}
+	}
+	return ""
+}
+
+// Satisfied reports whether the authentication methods reach the level acr
+// or a stronger one. An empty acr is always satisfied.
+func (l *Levels) Satisfied(acr string, amr []string) bool {
+	return l.rank(l.Achieved(amr)) >= l.rank(acr)
+}
+
+// rank returns the position of the level, -1 for no or an unknown level.
+func (l *Levels) rank(acr string) int {
+	return slices.IndexFunc(l.levels, func(level Level) bool { return level.ACR == acr })
+}
+
+func containsAll(amr []string, methods []string) bool {
+	for _, method := range methods {
+		if !slices.Contains(amr, method) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package acr
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAchievedAndSatisfied(t *testing.T) {
+	//given
+	levels := Must(NewLevels(DefaultLevels()...))
+
+	cases := []struct {
+		amr       []string
+		achieved  string
+		satisfied map[string]bool
+	}{
+		{nil, "", map[string]bool{"": true, Password: false, MFA: false}},
+		{[]string{"otp"}, "", map[string]bool{"": true, Password: false}},
+		{[]string{"pwd"}, Password, map[string]bool{Password: true, MFA: false, Passkey: false}},
+		{[]string{"pwd", "otp", "mfa"}, MFA, map[string]bool{Password: true, MFA: true, Passkey: false}},
+		{[]string{"pwd", "hwk", "mfa"}, Passkey, map[string]bool{Password: true, MFA: true, Passkey: true}},
+	}
+
+	for _, c := range cases {
+		//when
+		achieved := levels.Achieved(c.amr)
+
+		//then
+		if achieved != c.achieved {
+			log.Println("unexpected acr for", c.amr, achieved)
+			t.Fail()
+		}
+		for required, satisfied := range c.satisfied {
+			if levels.Satisfied(required, c.amr) != satisfied {
+				log.Println("unexpected satisfaction of", required, "by", c.amr)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestRequiredIsWeakestKnownLevel(t *testing.T) {
+	//given
+	levels := Must(NewLevels(DefaultLevels()...))
+
+	cases := map[string][]string{
+		"":       {"unknown"},
+		MFA:      {Passkey, "unknown", MFA},
+		Passkey:  {Passkey},
+		Password: {MFA, Password},
+	}
+
+	for required, acrValues := range cases {
+		//when
+		got := levels.Required(acrValues)
+
+		//then
+		if got != required {
+			log.Println("unexpected required level for", acrValues, got)
+			t.Fail()
+		}
+	}
+	if levels.Required(nil) != "" {
+		t.Fail()
+	}
+}
+
+func TestNewLevelsFailsOnInvalidLevels(t *testing.T) {
+	cases := [][]Level{
+		{{ACR: "", AMR: [][]string{{"pwd"}}}},
+		{{ACR: "a", AMR: [][]string{{"pwd"}}}, {ACR: "a", AMR: [][]string{{"hwk"}}}},
+		{{ACR: "a"}},
+		{{ACR: "a", AMR: [][]string{{}}}},
+	}
+
+	for _, c := range cases {
+		if _, err := NewLevels(c...); err == nil {
+			log.Println("expected error for", c)
+			t.Fail()
+		}
+	}
+}
+
+func TestNewLevelsFromEnv(t *testing.T) {
+	//given
+	file := filepath.Join(t.TempDir(), "acr.json")
+	content := `[{"acr": "urn:example:bronze", "amr": [["pwd"], ["otp"]]}, {"acr": "urn:example:gold", "amr": [["mfa"]]}]`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ACR_LEVELS_FILE", file)
+
+	//when
+	levels, err := NewLevelsFromEnv()
+
+	//then
+	if err != nil {
+		log.Println(err)
+		t.FailNow()
+	}
+	if levels.Achieved([]string{"otp"}) != "urn:example:bronze" || levels.Achieved([]string{"otp", "mfa"}) != "urn:example:gold" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"simple-login-endpoint/logging"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventLogin           EventType = "login"
+	EventLoginSkipped    EventType = "login_skipped"
+	EventConsentAccepted EventType = "consent_accepted"
+	EventConsentRejected EventType = "consent_rejected"
+	EventLogout          EventType = "logout"
+	EventAccountLogin    EventType = "account_login"
+	EventAccountLogout   EventType = "account_logout"
+	EventConsentRevoked  EventType = "consent_revoked"
+	EventPasswordChanged EventType = "password_changed"
+	EventProfileUpdated  EventType = "profile_updated"
+	EventTOTPEnabled     EventType = "totp_enabled"
+	EventTOTPDisabled    EventType = "totp_disabled"
+	EventPasskeyAdded    EventType = "passkey_added"
+	EventPasskeyRemoved  EventType = "passkey_removed"
+	// EventPasswordResetRequested is emitted for unknown subjects as well,
+	// with outcome failure.
+	EventPasswordResetRequested EventType = "password_reset_requested"
+	EventPasswordReset          EventType = "password_reset"
+	EventRegistered             EventType = "registered"
+	// EventEmailLoginRequested is emitted for unknown subjects as well, with
+	// outcome failure.
+	EventEmailLoginRequested EventType = "email_login_requested"
+	EventEmailVerified       EventType = "email_verified"
+	// EventAccessDenied is emitted when the user lacks a role the client
+	// requires.
+	EventAccessDenied EventType = "access_denied"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+type Event struct {
+	Time          time.Time `json:"time"`
+	Type          EventType `json:"type"`
+	Outcome       Outcome   `json:"outcome"`
+	Reason        string    `json:"reason,omitempty"`
+	Subject       string    `json:"subject,omitempty"`
+	ClientID      string    `json:"client_id,omitempty"`
+	Scopes        []string  `json:"scopes,omitempty"`
+	IP            string    `json:"ip,omitempty"`
+	ForwardedFor  string    `json:"forwarded_for,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+}
+
+// Sink persists or forwards audit events.
+type Sink interface {
+	Write(ctx context.Context, event Event) error
+	Close() error
+}
+
+type Auditor struct {
+	sinks []Sink
+}
+
+func New(sinks ...Sink) (auditor *Auditor) {
+	return &Auditor{sinks: sinks}
+}
+
+// NewFromEnv creates the sinks listed in AUDIT_SINKS (comma separated:
+// stdout, file, webhook).
+func NewFromEnv() (auditor *Auditor, err error) {
+	sinks := make([]Sink, 0)
+
+	for _, name := range strings.Split(os.Getenv("AUDIT_SINKS"), ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "stdout":
+			sinks = append(sinks, NewWriterSink(os.Stdout))
+		case "file":
+			path := os.Getenv("AUDIT_FILE")
+			if path == "" {
+				path = "audit.log"
+			}
+			maxSizeMB := envInt("AUDIT_FILE_MAX_SIZE_MB", 100)
+			maxBackups := envInt("AUDIT_FILE_MAX_BACKUPS", 5)
+
+			sink, err := NewFileSink(path, int64(maxSizeMB)*1024*1024, maxBackups)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		case "webhook":
+			url := os.Getenv("AUDIT_WEBHOOK_URL")
+			if url == "" {
+				return nil, errors.New("audit sink webhook requires AUDIT_WEBHOOK_URL")
+			}
+			sinks = append(sinks, NewWebhookSink(url))
+		default:
+			slog.Warn("unknown audit sink", "sink", name)
+		}
+	}
+
+	return New(sinks...), nil
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Emit completes the event with request metadata and writes it to all sinks.
+// Failing sinks are logged but never abort the flow.
+func (a *Auditor) Emit(r *http.Request, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	if r != nil {
+		event.IP = remoteIP(r)
+		event.ForwardedFor = r.Header.Get("X-Forwarded-For")
+		event.UserAgent = r.UserAgent()
+	}
+
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+
+	if event.CorrelationID == "" {
+		event.CorrelationID = logging.CorrelationIDFromContext(ctx)
+	}
+
+	for _, sink := range a.sinks {
+		if err := sink.Write(ctx, event); err != nil {
+			logging.FromContext(ctx).Error("error on writing audit event", "type", event.Type, "error", err)
+		}
+	}
+}
+
+// Add registers further sinks, e.g. sinks the handler reads from.
+func (a *Auditor) Add(sinks ...Sink) {
+	a.sinks = append(a.sinks, sinks...)
+}
+
+func (a *Auditor) Close() (err error) {
+	for _, sink := range a.sinks {
+		if closeErr := sink.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
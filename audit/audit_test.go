@@ -0,0 +1,170 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEmitAddsRequestMetadata(t *testing.T) {
+	//given
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 1024*1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor := New(sink)
+
+	req := httptest.NewRequest(http.MethodPost, "/idp/login", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "test-agent")
+
+	//when
+	auditor.Emit(req, Event{Type: EventLogin, Outcome: OutcomeSuccess, Subject: "user", ClientID: "myclient"})
+	auditor.Close()
+
+	//then
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		t.Fatal("no audit event written")
+	}
+
+	var event Event
+	if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.IP != "10.0.0.1" || event.UserAgent != "test-agent" || event.ClientID != "myclient" || event.Time.IsZero() {
+		log.Println("unexpected event:", event)
+		t.FailNow()
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	//given
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor := New(sink)
+
+	//when
+	for i := 0; i < 5; i++ {
+		auditor.Emit(nil, Event{Type: EventLogout, Outcome: OutcomeSuccess, Subject: "user"})
+	}
+	auditor.Close()
+
+	//then
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			log.Println("missing audit file", name)
+			t.FailNow()
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); err == nil {
+		log.Println("more backups than configured")
+		t.FailNow()
+	}
+}
+
+func TestWebhookSinkDoesNotBlockTheRequest(t *testing.T) {
+	//given
+	release := make(chan struct{})
+	received := make(chan Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var event Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			received <- event
+		}
+	}))
+	defer server.Close()
+	auditor := New(NewWebhookSink(server.URL))
+
+	req := httptest.NewRequest(http.MethodPost, "/idp/login", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+
+	//when
+	start := time.Now()
+	auditor.Emit(req.WithContext(ctx), Event{Type: EventLogin, Outcome: OutcomeSuccess, Subject: "user"})
+	auditor.Emit(nil, Event{Type: EventLogout, Outcome: OutcomeSuccess, Subject: "user"})
+	elapsed := time.Since(start)
+	close(release)
+	auditor.Close()
+
+	//then
+	if elapsed > time.Second {
+		log.Println("emit waited for the webhook:", elapsed)
+		t.Fail()
+	}
+	if len(received) != 2 {
+		log.Println("events of cancelled request lost:", len(received))
+		t.Fail()
+	}
+}
+
+func TestWebhookSinkRequiresURL(t *testing.T) {
+	t.Setenv("AUDIT_SINKS", "webhook")
+	t.Setenv("AUDIT_WEBHOOK_URL", "")
+
+	if _, err := NewFromEnv(); err == nil {
+		log.Println("webhook sink without url accepted")
+		t.Fail()
+	}
+}
+
+func TestRecentSinkKeepsLastEventsPerSubject(t *testing.T) {
+	//given
+	recent := NewRecentSink(2)
+	auditor := New()
+	auditor.Add(recent)
+
+	//when
+	auditor.Emit(nil, Event{Type: EventLogin, Outcome: OutcomeFailure, Subject: "user"})
+	auditor.Emit(nil, Event{Type: EventLogin, Outcome: OutcomeSuccess, Subject: "user"})
+	auditor.Emit(nil, Event{Type: EventLogout, Outcome: OutcomeSuccess, Subject: "user"})
+	auditor.Emit(nil, Event{Type: EventLogin, Outcome: OutcomeSuccess, Subject: "other"})
+
+	//then
+	events := recent.Recent("user")
+	if len(events) != 2 || events[0].Type != EventLogout || events[1].Outcome != OutcomeSuccess {
+		log.Println("unexpected recent events:", events)
+		t.Fail()
+	}
+}
+
+func TestRecentSinkDropsOldestSubject(t *testing.T) {
+	//given
+	recent := NewRecentSink(1)
+	recent.Write(context.Background(), Event{Type: EventLogin, Subject: "first"})
+	for i := 1; i < RecentSinkMaxSubjects; i++ {
+		recent.Write(context.Background(), Event{Type: EventLogin, Subject: strconv.Itoa(i)})
+	}
+	recent.Write(context.Background(), Event{Type: EventLogin, Subject: "first"})
+
+	//when
+	recent.Write(context.Background(), Event{Type: EventLogin, Subject: "new"})
+
+	//then
+	if len(recent.Recent("first")) != 1 || len(recent.Recent("1")) != 0 || len(recent.Recent("new")) != 1 {
+		log.Println("unexpected subjects kept")
+		t.Fail()
+	}
+}
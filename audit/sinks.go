@@ -0,0 +1,289 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WriterSink writes one JSON document per line, e.g. to stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) (sink *WriterSink) {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+// FileSink writes JSON lines to a file and rotates it once maxBytes is
+// exceeded, keeping maxBackups files named <path>.1 ... <path>.N.
+type FileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewFileSink(path string, maxBytes int64, maxBackups int) (sink *FileSink, err error) {
+	sink = &FileSink{
+		path:       path,
+		maxBytes:   maxBytes,
+		maxBackups: maxBackups,
+	}
+
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", s.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.maxBackups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) Write(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// WebhookQueueSize is the number of events waiting for the webhook. Further
+// events are dropped until the receiver catches up.
+const WebhookQueueSize = 1000
+
+// WebhookSink posts every event as JSON to the configured URL. The events
+// are delivered by a background worker, so a slow receiver does not delay
+// the login and events of cancelled requests are not lost.
+type WebhookSink struct {
+	url        string
+	httpClient *http.Client
+	mu         sync.RWMutex
+	closed     bool
+	queue      chan Event
+	done       chan struct{}
+}
+
+func NewWebhookSink(url string) (sink *WebhookSink) {
+	sink = &WebhookSink{
+		url:        url,
+		httpClient: &http.Client{Timeout: time.Second * 5},
+		queue:      make(chan Event, WebhookQueueSize),
+		done:       make(chan struct{}),
+	}
+	go sink.deliver()
+	return sink
+}
+
+func (s *WebhookSink) Write(_ context.Context, event Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return errors.New("audit webhook is closed")
+	}
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return errors.New("audit webhook queue is full, event dropped")
+	}
+}
+
+func (s *WebhookSink) deliver() {
+	defer close(s.done)
+	for event := range s.queue {
+		if err := s.post(event); err != nil {
+			slog.Error("error on delivering audit event", "type", event.Type, "error", err)
+		}
+	}
+}
+
+func (s *WebhookSink) post(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("audit webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Close delivers the queued events and stops the worker.
+func (s *WebhookSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+	return nil
+}
+
+// RecentSinkMaxSubjects bounds the memory of the RecentSink, failed logins
+// may use any subject.
+const RecentSinkMaxSubjects = 10000
+
+// RecentSink keeps the last events of every subject in memory, so users can
+// review the recent activity of their account. The events are lost on
+// restart and not shared between instances. Once RecentSinkMaxSubjects is
+// reached, the subject with the oldest event is dropped.
+type RecentSink struct {
+	mu        sync.Mutex
+	size      int
+	bySubject map[string][]Event
+	// subjects in the order of their last event, oldest first
+	subjects []string
+}
+
+func NewRecentSink(size int) (sink *RecentSink) {
+	return &RecentSink{size: size, bySubject: make(map[string][]Event)}
+}
+
+func (s *RecentSink) Write(_ context.Context, event Event) error {
+	if event.Subject == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events, found := s.bySubject[event.Subject]
+	if found {
+		s.subjects = slices.DeleteFunc(s.subjects, func(subject string) bool { return subject == event.Subject })
+	} else if len(s.subjects) >= RecentSinkMaxSubjects {
+		delete(s.bySubject, s.subjects[0])
+		s.subjects = s.subjects[1:]
+	}
+	s.subjects = append(s.subjects, event.Subject)
+
+	events = append(events, event)
+	if len(events) > s.size {
+		events = events[len(events)-s.size:]
+	}
+	s.bySubject[event.Subject] = events
+	return nil
+}
+
+// Recent returns the events of the subject, newest first.
+func (s *RecentSink) Recent(subject string) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.bySubject[subject]
+	recent := make([]Event, len(events))
+	for i, event := range events {
+		recent[len(events)-1-i] = event
+	}
+	return recent
+}
+
+func (s *RecentSink) Close() error {
+	return nil
+}
@@ -0,0 +1,238 @@
+// Package breach checks passwords against a local corpus of breached
+// passwords, so the check works without network access. The corpus is either
+// a bloom filter built with the breach-filter command or a directory of
+// Have I Been Pwned range files.
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checker reports whether a password is part of the corpus.
+// Implementations must be safe for concurrent use.
+type Checker interface {
+	Breached(password string) (bool, error)
+}
+
+// NewFromEnv loads the bloom filter of PASSWORD_BREACH_FILTER or uses the
+// range files in PASSWORD_BREACH_DIR. Without either the check is disabled
+// and the checker is nil.
+func NewFromEnv() (checker Checker, err error) {
+	filterPath := strings.TrimSpace(os.Getenv("PASSWORD_BREACH_FILTER"))
+	rangeDir := strings.TrimSpace(os.Getenv("PASSWORD_BREACH_DIR"))
+
+	switch {
+	case filterPath != "" && rangeDir != "":
+		return nil, fmt.Errorf("PASSWORD_BREACH_FILTER and PASSWORD_BREACH_DIR must not be set both")
+	case filterPath != "":
+		return LoadFilter(filterPath)
+	case rangeDir != "":
+		return NewRangeDir(rangeDir)
+	default:
+		return nil, nil
+	}
+}
+
+func Must(checker Checker, err error) Checker {
+	if err != nil {
+		panic("could not load breached passwords: " + err.Error())
+	}
+	return checker
+}
+
+// Digest is the SHA-1 hash of a password, the key of both corpus formats.
+type Digest [sha1.Size]byte
+
+func DigestOf(password string) Digest {
+	return sha1.Sum([]byte(password))
+}
+
+// ParseDigest parses a hex encoded SHA-1 hash as found in the Have I Been
+// Pwned downloads.
+func ParseDigest(value string) (digest Digest, err error) {
+	if len(value) != hex.EncodedLen(sha1.Size) {
+		return digest, fmt.Errorf("invalid SHA-1 hash %q", value)
+	}
+	if _, err := hex.Decode(digest[:], []byte(value)); err != nil {
+		return digest, fmt.Errorf("invalid SHA-1 hash %q: %w", value, err)
+	}
+	return digest, nil
+}
+
+// filterMagic starts every filter file, followed by the version.
+const (
+	filterMagic   = "PWBF"
+	filterVersion = 1
+)
+
+// Filter is a bloom filter over the SHA-1 hashes of the passwords. It never
+// misses a breached password but reports a small share of other passwords as
+// breached as well.
+type Filter struct {
+	k    uint32
+	m    uint64
+	bits []uint64
+}
+
+// NewFilter sizes a filter for n passwords with the given false positive
+// rate, e.g. 0.001.
+func NewFilter(n uint64, falsePositiveRate float64) (filter *Filter, err error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, fmt.Errorf("false positive rate must be between 0 and 1")
+	}
+	if n == 0 {
+		n = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &Filter{k: k, m: m, bits: make([]uint64, m/64)}, nil
+}
+
+// positions derives the k bit positions from the hash by double hashing.
+func (f *Filter) positions(digest Digest, visit func(position uint64) bool) {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	for i := uint64(0); i < uint64(f.k); i++ {
+		if !visit((h1 + i*h2) % f.m) {
+			return
+		}
+	}
+}
+
+func (f *Filter) Add(digest Digest) {
+	f.positions(digest, func(position uint64) bool {
+		f.bits[position/64] |= 1 << (position % 64)
+		return true
+	})
+}
+
+func (f *Filter) Contains(digest Digest) bool {
+	contained := true
+	f.positions(digest, func(position uint64) bool {
+		contained = f.bits[position/64]&(1<<(position%64)) != 0
+		return contained
+	})
+	return contained
+}
+
+func (f *Filter) Breached(password string) (bool, error) {
+	return f.Contains(DigestOf(password)), nil
+}
+
+// WriteTo writes the filter in the format read by ReadFilter.
+func (f *Filter) WriteTo(w io.Writer) (n int64, err error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, 0, len(filterMagic)+1+4+8)
+	header = append(header, filterMagic...)
+	header = append(header, filterVersion)
+	header = binary.LittleEndian.AppendUint32(header, f.k)
+	header = binary.LittleEndian.AppendUint64(header, f.m)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	word := make([]byte, 8)
+	for _, bits := range f.bits {
+		binary.LittleEndian.PutUint64(word, bits)
+		if _, err := bw.Write(word); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(header) + 8*len(f.bits)), bw.Flush()
+}
+
+func ReadFilter(r io.Reader) (filter *Filter, err error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(filterMagic)+1+4+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("could not read filter header: %w", err)
+	}
+	if string(header[:len(filterMagic)]) != filterMagic || header[len(filterMagic)] != filterVersion {
+		return nil, errors.New("not a breached password filter")
+	}
+
+	k := binary.LittleEndian.Uint32(header[5:9])
+	m := binary.LittleEndian.Uint64(header[9:17])
+	if k == 0 || m == 0 || m%64 != 0 {
+		return nil, fmt.Errorf("invalid filter size k=%d m=%d", k, m)
+	}
+
+	filter = &Filter{k: k, m: m, bits: make([]uint64, m/64)}
+	word := make([]byte, 8)
+	for i := range filter.bits {
+		if _, err := io.ReadFull(br, word); err != nil {
+			return nil, fmt.Errorf("could not read filter: %w", err)
+		}
+		filter.bits[i] = binary.LittleEndian.Uint64(word)
+	}
+	return filter, nil
+}
+
+func LoadFilter(path string) (filter *Filter, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadFilter(file)
+}
+
+// RangeDir looks up passwords in range files as provided by the Have I Been
+// Pwned downloader: one file per 5 character prefix of the SHA-1 hash, named
+// like 21BD1 or 21BD1.txt, with lines of SUFFIX:COUNT.
+type RangeDir struct {
+	dir string
+}
+
+func NewRangeDir(dir string) (rangeDir *RangeDir, err error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &RangeDir{dir: dir}, nil
+}
+
+func (d *RangeDir) Breached(password string) (bool, error) {
+	digest := DigestOf(password)
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	file, err := os.Open(filepath.Join(d.dir, prefix+".txt"))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(d.dir, prefix))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		// padding entries of the range API have a count of 0
+		if strings.EqualFold(lineSuffix, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
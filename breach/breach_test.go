@@ -0,0 +1,125 @@
+package breach
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	//given
+	filter, err := NewFilter(1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		filter.Add(DigestOf(fmt.Sprint("breached-", i)))
+	}
+
+	//when
+	var buf bytes.Buffer
+	if _, err := filter.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadFilter(&buf)
+
+	//then
+	if err != nil {
+		log.Println("could not read filter:", err)
+		t.FailNow()
+	}
+	for i := 0; i < 1000; i++ {
+		if breached, _ := loaded.Breached(fmt.Sprint("breached-", i)); !breached {
+			log.Println("breached password missed:", i)
+			t.FailNow()
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if breached, _ := loaded.Breached(fmt.Sprint("unique-", i)); breached {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		log.Println("too many false positives:", falsePositives)
+		t.Fail()
+	}
+}
+
+func TestReadFilterRejectsOtherFiles(t *testing.T) {
+	//when
+	_, err := ReadFilter(strings.NewReader("password\n123456\n"))
+
+	//then
+	if err == nil {
+		log.Println("wordlist accepted as filter")
+		t.Fail()
+	}
+}
+
+func TestRangeDir(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	digest := DigestOf("password")
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	padding := DigestOf("padding")
+	paddingHash := strings.ToUpper(hex.EncodeToString(padding[:]))
+
+	if err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte("0000000000000000000000000000000000A:3\r\n"+strings.ToLower(hash[5:])+":9545824\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, paddingHash[:5]), []byte(paddingHash[5:]+":0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rangeDir, err := NewRangeDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{"password": true, "padding": false, "correct horse battery staple": false}
+
+	for password, expected := range cases {
+		//when
+		breached, err := rangeDir.Breached(password)
+
+		//then
+		if err != nil || breached != expected {
+			log.Println("unexpected result for", password, breached, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	//given
+	t.Setenv("PASSWORD_BREACH_FILTER", "")
+	t.Setenv("PASSWORD_BREACH_DIR", "")
+
+	//when
+	checker, err := NewFromEnv()
+
+	//then
+	if checker != nil || err != nil {
+		log.Println("check enabled without configuration:", checker, err)
+		t.FailNow()
+	}
+
+	//given
+	t.Setenv("PASSWORD_BREACH_FILTER", "filter.bin")
+	t.Setenv("PASSWORD_BREACH_DIR", t.TempDir())
+
+	//when
+	_, err = NewFromEnv()
+
+	//then
+	if err == nil {
+		log.Println("filter and range directory accepted together")
+		t.Fail()
+	}
+}
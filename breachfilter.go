@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"simple-login-endpoint/breach"
+	"strings"
+)
+
+// BreachFilterCommand builds the bloom filter for PASSWORD_BREACH_FILTER:
+//
+//	hydra-id-provider breach-filter -out filter.bin [-format plain|sha1] [-fp 0.001] FILE...
+//
+// plain files contain one password per line, sha1 files the hashes of the
+// Have I Been Pwned downloads as HASH:COUNT lines.
+const BreachFilterCommand = "breach-filter"
+
+func buildBreachFilter(args []string, output io.Writer) error {
+	flags := flag.NewFlagSet(BreachFilterCommand, flag.ContinueOnError)
+	flags.SetOutput(output)
+	out := flags.String("out", "", "path of the filter to write")
+	format := flags.String("format", "plain", "format of the input files: plain or sha1")
+	falsePositiveRate := flags.Float64("fp", 0.001, "share of other passwords reported as breached")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("-out and at least one input file are required")
+	}
+
+	var digest func(line string) (breach.Digest, error)
+	switch *format {
+	case "plain":
+		digest = func(line string) (breach.Digest, error) { return breach.DigestOf(line), nil }
+	case "sha1":
+		digest = func(line string) (breach.Digest, error) {
+			hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+			return breach.ParseDigest(hash)
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	// the filter is sized for the number of passwords, so the files are read
+	// twice
+	var count uint64
+	for _, path := range flags.Args() {
+		if err := eachLine(path, func(string) error { count++; return nil }); err != nil {
+			return err
+		}
+	}
+
+	filter, err := breach.NewFilter(count, *falsePositiveRate)
+	if err != nil {
+		return err
+	}
+	for _, path := range flags.Args() {
+		err := eachLine(path, func(line string) error {
+			d, err := digest(line)
+			if err != nil {
+				return err
+			}
+			filter.Add(d)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeFile(*out, filter); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "wrote filter of %d passwords to %s\n", count, *out)
+	return nil
+}
+
+// eachLine calls add for every non-empty line of the file. Only line breaks
+// are removed, a password may start or end with spaces.
+func eachLine(path string, add func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if err := add(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, number, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// writeFile replaces the filter only once it is written completely, so a
+// running identity provider never loads a partial filter.
+func writeFile(path string, filter *breach.Filter) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := filter.WriteTo(file); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
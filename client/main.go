@@ -5,10 +5,10 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"text/template"
 
 	"golang.org/x/oauth2"
 )
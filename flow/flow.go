@@ -0,0 +1,205 @@
+// Package flow abstracts the admin API of Hydra used by the identity
+// provider. Handlers only talk to a FlowBackend; adapters translate the calls
+// to the API of a Hydra version.
+package flow
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+const (
+	APIVersionV1 = "v1"
+	APIVersionV2 = "v2"
+)
+
+type Client struct {
+	ClientID   string                 `json:"client_id"`
+	ClientName string                 `json:"client_name,omitempty"`
+	LogoURI    string                 `json:"logo_uri,omitempty"`
+	PolicyURI  string                 `json:"policy_uri,omitempty"`
+	TosURI     string                 `json:"tos_uri,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type OIDCContext struct {
+	AcrValues         []string               `json:"acr_values,omitempty"`
+	Display           string                 `json:"display,omitempty"`
+	IDTokenHintClaims map[string]interface{} `json:"id_token_hint_claims,omitempty"`
+	LoginHint         string                 `json:"login_hint,omitempty"`
+	UILocales         []string               `json:"ui_locales,omitempty"`
+}
+
+type LoginRequest struct {
+	Challenge         string       `json:"challenge"`
+	Subject           string       `json:"subject"`
+	Skip              bool         `json:"skip"`
+	Client            *Client      `json:"client"`
+	RequestURL        string       `json:"request_url"`
+	RequestedScope    []string     `json:"requested_scope"`
+	RequestedAudience []string     `json:"requested_access_token_audience"`
+	OIDCContext       *OIDCContext `json:"oidc_context,omitempty"`
+	SessionID         string       `json:"session_id,omitempty"`
+}
+
+type ConsentRequest struct {
+	Challenge         string       `json:"challenge"`
+	Subject           string       `json:"subject"`
+	Skip              bool         `json:"skip"`
+	Client            *Client      `json:"client"`
+	RequestURL        string       `json:"request_url"`
+	RequestedScope    []string     `json:"requested_scope"`
+	RequestedAudience []string     `json:"requested_access_token_audience"`
+	OIDCContext       *OIDCContext `json:"oidc_context,omitempty"`
+	LoginChallenge    string       `json:"login_challenge,omitempty"`
+	LoginSessionID    string       `json:"login_session_id,omitempty"`
+	Acr               string       `json:"acr,omitempty"`
+	Context           interface{}  `json:"context,omitempty"`
+}
+
+type LogoutRequest struct {
+	Challenge string  `json:"challenge"`
+	Subject   string  `json:"subject"`
+	SessionID string  `json:"sid,omitempty"`
+	Client    *Client `json:"client,omitempty"`
+}
+
+// AcceptLogin is the result of a successful authentication. RememberFor is
+// given in seconds, 0 remembers the login for the session lifespan.
+type AcceptLogin struct {
+	Subject     string      `json:"subject"`
+	Remember    bool        `json:"remember"`
+	RememberFor int64       `json:"remember_for,omitempty"`
+	Acr         string      `json:"acr,omitempty"`
+	AMR         []string    `json:"amr,omitempty"`
+	Context     interface{} `json:"context,omitempty"`
+}
+
+// Session holds the additional claims of the access and ID token.
+type Session struct {
+	AccessToken map[string]interface{} `json:"access_token,omitempty"`
+	IDToken     map[string]interface{} `json:"id_token,omitempty"`
+}
+
+type AcceptConsent struct {
+	GrantScope    []string `json:"grant_scope"`
+	GrantAudience []string `json:"grant_access_token_audience"`
+	Remember      bool     `json:"remember"`
+	RememberFor   int64    `json:"remember_for,omitempty"`
+	Session       *Session `json:"session,omitempty"`
+}
+
+// ConsentSession is a consent the subject granted to a client and Hydra
+// remembers.
+type ConsentSession struct {
+	Client        *Client   `json:"client"`
+	GrantedScopes []string  `json:"grant_scope"`
+	HandledAt     time.Time `json:"handled_at"`
+}
+
+type Rejection struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	StatusCode       int    `json:"status_code"`
+}
+
+// FlowBackend is the part of the Hydra admin API the identity provider
+// needs. The accept and reject calls return the URL the browser has to be
+// redirected to.
+type FlowBackend interface {
+	GetLoginRequest(ctx context.Context, challenge string) (*LoginRequest, error)
+	AcceptLoginRequest(ctx context.Context, challenge string, accept AcceptLogin) (redirectTo string, err error)
+	RejectLoginRequest(ctx context.Context, challenge string, reject Rejection) (redirectTo string, err error)
+
+	GetConsentRequest(ctx context.Context, challenge string) (*ConsentRequest, error)
+	AcceptConsentRequest(ctx context.Context, challenge string, accept AcceptConsent) (redirectTo string, err error)
+	RejectConsentRequest(ctx context.Context, challenge string, reject Rejection) (redirectTo string, err error)
+
+	GetLogoutRequest(ctx context.Context, challenge string) (*LogoutRequest, error)
+	AcceptLogoutRequest(ctx context.Context, challenge string) (redirectTo string, err error)
+	RejectLogoutRequest(ctx context.Context, challenge string) error
+
+	ListConsentSessions(ctx context.Context, subject string) ([]*ConsentSession, error)
+	// RevokeConsentSessions revokes the consent sessions of the subject for
+	// the client or for all clients if clientID is empty.
+	RevokeConsentSessions(ctx context.Context, subject string, clientID string) error
+
+	// CreateClient registers the client given as Hydra client JSON as it is,
+	// so fields unknown to this package are kept.
+	CreateClient(ctx context.Context, client json.RawMessage) error
+	GetClient(ctx context.Context, clientID string) (*Client, error)
+	DeleteClient(ctx context.Context, clientID string) error
+}
+
+// StatusError is returned if Hydra answers with an unexpected status.
+type StatusError struct {
+	Operation  string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d: %s", e.Operation, e.StatusCode, e.Body)
+}
+
+// NewHTTPClient returns the client used for all calls to Hydra. Every call
+// becomes a span named after method and path. SKIP_TLS_VERIFY disables the
+// certificate check.
+func NewHTTPClient() *http.Client {
+	insecureSkipVerify, err := strconv.ParseBool(os.Getenv("SKIP_TLS_VERIFY"))
+
+	if err != nil {
+		insecureSkipVerify = false
+	}
+
+	return &http.Client{
+		Timeout: time.Second * 10,
+
+		Transport: otelhttp.NewTransport(&http.Transport{
+			IdleConnTimeout:       time.Second * 5,
+			ResponseHeaderTimeout: time.Second * 3,
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		}, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "hydra " + r.Method + " " + r.URL.Path
+		})),
+	}
+}
+
+// New returns the adapter for the given Hydra API version.
+func New(apiVersion string, adminURL string, httpClient *http.Client) (backend FlowBackend, err error) {
+	switch strings.ToLower(strings.TrimSpace(apiVersion)) {
+	case "", APIVersionV1:
+		return NewHydraV1(adminURL, httpClient)
+	case APIVersionV2:
+		return NewHydraV2(adminURL, httpClient)
+	default:
+		return nil, fmt.Errorf("unsupported Hydra API version %q", apiVersion)
+	}
+}
+
+// NewFromEnv talks to HYDRA_ADMIN_URL using the API selected by
+// HYDRA_API_VERSION (v1 or v2, default v1).
+func NewFromEnv() (backend FlowBackend, err error) {
+	adminURL, found := os.LookupEnv("HYDRA_ADMIN_URL")
+	if !found {
+		return nil, fmt.Errorf("HYDRA_ADMIN_URL is not set")
+	}
+
+	return New(os.Getenv("HYDRA_API_VERSION"), adminURL, NewHTTPClient())
+}
+
+func Must(backend FlowBackend, err error) FlowBackend {
+	if err != nil {
+		panic("could not create Hydra backend: " + err.Error())
+	}
+	return backend
+}
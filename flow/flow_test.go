@@ -0,0 +1,287 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/hydratest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ory/hydra-client-go/models"
+)
+
+var apiVersions = []string{flow.APIVersionV1, flow.APIVersionV2}
+
+func TestLoginAndConsent(t *testing.T) {
+	for _, apiVersion := range apiVersions {
+		t.Run(apiVersion, func(t *testing.T) {
+			//given
+			fakeHydra := hydratest.NewServer()
+			defer fakeHydra.Close()
+			backend := fakeHydra.Backend(apiVersion)
+			ctx := context.Background()
+
+			fakeHydra.AddClient(&models.OAuth2Client{
+				ClientID:   "app",
+				ClientName: "My App",
+				Metadata:   map[string]interface{}{"first_party": true},
+			})
+			loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{
+				ClientID:    "app",
+				Scopes:      []string{"openid", "email"},
+				OidcContext: &models.OpenIDConnectContext{UILocales: []string{"en"}},
+			})
+
+			//when
+			login, err := backend.GetLoginRequest(ctx, loginChallenge)
+
+			//then
+			if err != nil {
+				log.Println("could not get login request:", err)
+				t.FailNow()
+			}
+			if login.Client.ClientName != "My App" || login.Client.Metadata["first_party"] != true ||
+				strings.Join(login.RequestedScope, " ") != "openid email" || login.OIDCContext.UILocales[0] != "en" {
+				log.Println("unexpected login request:", login)
+				t.FailNow()
+			}
+
+			//when
+			redirectTo, err := backend.AcceptLoginRequest(ctx, loginChallenge, flow.AcceptLogin{Subject: "user", Remember: true, RememberFor: 3600, AMR: []string{"pwd", "otp"}})
+
+			//then
+			if err != nil || redirectTo != fakeHydra.RedirectURL(loginChallenge) {
+				log.Println("unexpected accept login result:", redirectTo, err)
+				t.FailNow()
+			}
+			accepted, _ := fakeHydra.AcceptedLogin(loginChallenge)
+			if *accepted.Subject != "user" || !accepted.Remember || accepted.RememberFor != 3600 ||
+				strings.Join(fakeHydra.AcceptedAMR(loginChallenge), " ") != "pwd otp" {
+				log.Println("unexpected accept login body:", accepted)
+				t.FailNow()
+			}
+
+			//given
+			consentChallenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge})
+
+			//when
+			consent, err := backend.GetConsentRequest(ctx, consentChallenge)
+
+			//then
+			if err != nil || consent.Subject != "user" || consent.LoginChallenge != loginChallenge {
+				log.Println("unexpected consent request:", consent, err)
+				t.FailNow()
+			}
+
+			//when
+			_, err = backend.AcceptConsentRequest(ctx, consentChallenge, flow.AcceptConsent{
+				GrantScope: consent.RequestedScope,
+				Remember:   true,
+				Session:    &flow.Session{IDToken: map[string]interface{}{"email": "user"}},
+			})
+
+			//then
+			if err != nil {
+				log.Println("could not accept consent:", err)
+				t.FailNow()
+			}
+			granted, _ := fakeHydra.AcceptedConsent(consentChallenge)
+			claims, _ := granted.Session.IDToken.(map[string]interface{})
+			if strings.Join(granted.GrantScope, " ") != "openid email" || claims["email"] != "user" {
+				log.Println("unexpected accept consent body:", granted)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestRejectAndLogout(t *testing.T) {
+	for _, apiVersion := range apiVersions {
+		t.Run(apiVersion, func(t *testing.T) {
+			//given
+			fakeHydra := hydratest.NewServer()
+			defer fakeHydra.Close()
+			backend := fakeHydra.Backend(apiVersion)
+			ctx := context.Background()
+			loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+			logoutChallenge := fakeHydra.NewLogoutRequest("user", "app")
+
+			//when
+			_, err := backend.RejectLoginRequest(ctx, loginChallenge, flow.Rejection{Error: "access_denied", StatusCode: http.StatusForbidden})
+
+			//then
+			rejected, found := fakeHydra.Rejected(loginChallenge)
+			if err != nil || !found || rejected.Error != "access_denied" || rejected.StatusCode != http.StatusForbidden {
+				log.Println("login not rejected:", rejected, err)
+				t.FailNow()
+			}
+
+			//when
+			logout, err := backend.GetLogoutRequest(ctx, logoutChallenge)
+
+			//then
+			if err != nil || logout.Subject != "user" || logout.Client.ClientID != "app" {
+				log.Println("unexpected logout request:", logout, err)
+				t.FailNow()
+			}
+
+			//when
+			if _, err := backend.AcceptLogoutRequest(ctx, logoutChallenge); err != nil || !fakeHydra.AcceptedLogout(logoutChallenge) {
+				log.Println("logout not accepted:", err)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestConsentSessions(t *testing.T) {
+	for _, apiVersion := range apiVersions {
+		t.Run(apiVersion, func(t *testing.T) {
+			//given
+			fakeHydra := hydratest.NewServer()
+			defer fakeHydra.Close()
+			backend := fakeHydra.Backend(apiVersion)
+			ctx := context.Background()
+
+			fakeHydra.AddClient(&models.OAuth2Client{ClientID: "app", ClientName: "My App"})
+			appConsent := fakeHydra.AddConsentSession("user", "app", "openid", "email")
+			otherConsent := fakeHydra.AddConsentSession("user", "other", "openid")
+			fakeHydra.AddConsentSession("someone-else", "app", "openid")
+
+			//when
+			sessions, err := backend.ListConsentSessions(ctx, "user")
+
+			//then
+			if err != nil || len(sessions) != 2 {
+				log.Println("unexpected consent sessions:", sessions, err)
+				t.FailNow()
+			}
+			for _, session := range sessions {
+				if session.Client.ClientID == "app" && (session.Client.ClientName != "My App" || len(session.GrantedScopes) != 2 || session.HandledAt.IsZero()) {
+					log.Println("unexpected consent session:", session)
+					t.FailNow()
+				}
+			}
+
+			//when
+			err = backend.RevokeConsentSessions(ctx, "user", "app")
+
+			//then
+			if err != nil || !fakeHydra.ConsentRevoked(appConsent) || fakeHydra.ConsentRevoked(otherConsent) {
+				log.Println("consent of app not revoked:", err)
+				t.FailNow()
+			}
+
+			//when
+			err = backend.RevokeConsentSessions(ctx, "user", "")
+
+			//then
+			if err != nil || !fakeHydra.ConsentRevoked(otherConsent) {
+				log.Println("consents not revoked:", err)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestClients(t *testing.T) {
+	for _, apiVersion := range apiVersions {
+		t.Run(apiVersion, func(t *testing.T) {
+			//given
+			fakeHydra := hydratest.NewServer()
+			defer fakeHydra.Close()
+			backend := fakeHydra.Backend(apiVersion)
+			ctx := context.Background()
+
+			//when
+			err := backend.CreateClient(ctx, []byte(`{"client_id": "app", "client_name": "My App", "scope": "openid"}`))
+
+			//then
+			if err != nil {
+				log.Println("could not create client:", err)
+				t.FailNow()
+			}
+
+			client, err := backend.GetClient(ctx, "app")
+			if err != nil || client.ClientName != "My App" {
+				log.Println("unexpected client:", client, err)
+				t.FailNow()
+			}
+
+			//when
+			err = backend.CreateClient(ctx, []byte(`{"client_id": "app"}`))
+
+			//then
+			var statusErr *flow.StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusConflict {
+				log.Println("expected conflict, got:", err)
+				t.FailNow()
+			}
+
+			//when
+			if err := backend.DeleteClient(ctx, "app"); err != nil {
+				log.Println("could not delete client:", err)
+				t.FailNow()
+			}
+
+			//then
+			if _, found := fakeHydra.ClientByID("app"); found {
+				log.Println("client not deleted")
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestUnsupportedAPIVersion(t *testing.T) {
+	if _, err := flow.New("v3", "http://localhost:4445", nil); err == nil {
+		log.Println("expected error for unsupported version")
+		t.Fail()
+	}
+}
+
+func TestPromptAndMaxAgeOfLoginRequest(t *testing.T) {
+	for _, apiVersion := range apiVersions {
+		t.Run(apiVersion, func(t *testing.T) {
+			//given
+			fakeHydra := hydratest.NewServer()
+			defer fakeHydra.Close()
+			backend := fakeHydra.Backend(apiVersion)
+			challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{
+				ClientID: "app",
+				Params:   url.Values{"prompt": {"login select_account"}, "max_age": {"300"}, "login_hint": {"user"}},
+			})
+
+			//when
+			login, err := backend.GetLoginRequest(context.Background(), challenge)
+
+			//then
+			if err != nil {
+				log.Println("could not get login request:", err)
+				t.FailNow()
+			}
+			maxAge, found := login.RequestedMaxAge()
+			if !login.HasPrompt(flow.PromptLogin) || !login.HasPrompt(flow.PromptSelectAccount) || login.HasPrompt(flow.PromptNone) ||
+				!found || maxAge != 5*time.Minute {
+				log.Println("unexpected prompt or max_age:", login.RequestURL)
+				t.FailNow()
+			}
+
+			switchURL, _ := url.Parse(login.SwitchAccountURL())
+			if query := switchURL.Query(); query.Get("prompt") != "login" || query.Has("login_hint") || query.Get("client_id") != "app" {
+				log.Println("unexpected switch account url:", switchURL)
+				t.Fail()
+			}
+		})
+	}
+
+	if _, found := (&flow.LoginRequest{RequestURL: "https://hydra/oauth2/auth?max_age=abc"}).RequestedMaxAge(); found {
+		log.Println("invalid max_age accepted")
+		t.Fail()
+	}
+}
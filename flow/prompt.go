@@ -0,0 +1,71 @@
+package flow
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of the prompt parameter of an authorization request.
+const (
+	PromptNone          = "none"
+	PromptLogin         = "login"
+	PromptConsent       = "consent"
+	PromptSelectAccount = "select_account"
+)
+
+// Hydra does not pass prompt and max_age to the login and consent app, so
+// they are read from the original authorization URL.
+func authorizationParams(requestURL string) url.Values {
+	parsed, err := url.Parse(requestURL)
+	if err != nil {
+		return url.Values{}
+	}
+	return parsed.Query()
+}
+
+func hasPrompt(requestURL string, prompt string) bool {
+	return slices.Contains(strings.Fields(authorizationParams(requestURL).Get("prompt")), prompt)
+}
+
+// HasPrompt reports whether the client requested the prompt value, e.g.
+// PromptNone.
+func (l *LoginRequest) HasPrompt(prompt string) bool {
+	return hasPrompt(l.RequestURL, prompt)
+}
+
+// RequestedMaxAge returns the max_age of the authorization request and
+// whether a valid one was given. A max age of 0 requires a new
+// authentication.
+func (l *LoginRequest) RequestedMaxAge() (maxAge time.Duration, found bool) {
+	value := authorizationParams(l.RequestURL).Get("max_age")
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// SwitchAccountURL returns the authorization URL with prompt=login and
+// without login_hint. Following it starts a new login in which the user may
+// sign in with another account than the remembered one.
+func (l *LoginRequest) SwitchAccountURL() string {
+	parsed, err := url.Parse(l.RequestURL)
+	if err != nil {
+		return ""
+	}
+
+	query := parsed.Query()
+	query.Set("prompt", PromptLogin)
+	query.Del("login_hint")
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// HasPrompt reports whether the client requested the prompt value, e.g.
+// PromptNone.
+func (c *ConsentRequest) HasPrompt(prompt string) bool {
+	return hasPrompt(c.RequestURL, prompt)
+}
@@ -0,0 +1,341 @@
+package flow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	hydra "github.com/ory/hydra-client-go/client"
+	"github.com/ory/hydra-client-go/client/admin"
+	"github.com/ory/hydra-client-go/models"
+)
+
+// HydraV1 talks to the admin API of Hydra 1.x using hydra-client-go.
+type HydraV1 struct {
+	adminURL   string
+	client     *hydra.OryHydra
+	httpClient *http.Client
+}
+
+func NewHydraV1(adminURL string, httpClient *http.Client) (backend *HydraV1, err error) {
+	parsed, err := url.Parse(adminURL)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &HydraV1{
+		adminURL: strings.TrimSuffix(adminURL, "/"),
+		client: hydra.NewHTTPClientWithConfig(nil, &hydra.TransportConfig{
+			Schemes:  []string{parsed.Scheme},
+			Host:     parsed.Host,
+			BasePath: parsed.Path,
+		}),
+		httpClient: httpClient,
+	}, nil
+}
+
+func (h *HydraV1) GetLoginRequest(ctx context.Context, challenge string) (*LoginRequest, error) {
+	params := admin.NewGetLoginRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetLoginChallenge(challenge)
+
+	resp, err := h.client.Admin.GetLoginRequest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := resp.GetPayload()
+	login := &LoginRequest{
+		Challenge:         challenge,
+		Client:            clientFromV1(payload.Client),
+		RequestedScope:    payload.RequestedScope,
+		RequestedAudience: payload.RequestedAccessTokenAudience,
+		OIDCContext:       oidcContextFromV1(payload.OidcContext),
+		SessionID:         payload.SessionID,
+	}
+	if payload.Subject != nil {
+		login.Subject = *payload.Subject
+	}
+	if payload.Skip != nil {
+		login.Skip = *payload.Skip
+	}
+	if payload.RequestURL != nil {
+		login.RequestURL = *payload.RequestURL
+	}
+
+	return login, nil
+}
+
+// AcceptLoginRequest sends the JSON directly, since the accept model of
+// hydra-client-go has no amr. Hydra supports amr since 1.11.
+func (h *HydraV1) AcceptLoginRequest(ctx context.Context, challenge string, accept AcceptLogin) (string, error) {
+	body, err := json.Marshal(&accept)
+	if err != nil {
+		return "", err
+	}
+
+	target := h.adminURL + "/oauth2/auth/requests/login/accept?" + url.Values{"login_challenge": {challenge}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", &StatusError{Operation: "accept login request", StatusCode: resp.StatusCode, Body: string(content)}
+	}
+
+	var completed completedRequest
+	if err := json.NewDecoder(resp.Body).Decode(&completed); err != nil {
+		return "", err
+	}
+	return completed.RedirectTo, nil
+}
+
+func (h *HydraV1) RejectLoginRequest(ctx context.Context, challenge string, reject Rejection) (string, error) {
+	params := admin.NewRejectLoginRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetLoginChallenge(challenge)
+	params.SetBody(rejectionToV1(reject))
+
+	resp, err := h.client.Admin.RejectLoginRequest(params)
+	if err != nil {
+		return "", err
+	}
+	return *resp.GetPayload().RedirectTo, nil
+}
+
+func (h *HydraV1) GetConsentRequest(ctx context.Context, challenge string) (*ConsentRequest, error) {
+	params := admin.NewGetConsentRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetConsentChallenge(challenge)
+
+	resp, err := h.client.Admin.GetConsentRequest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := resp.GetPayload()
+	return &ConsentRequest{
+		Challenge:         challenge,
+		Subject:           payload.Subject,
+		Skip:              payload.Skip,
+		Client:            clientFromV1(payload.Client),
+		RequestURL:        payload.RequestURL,
+		RequestedScope:    payload.RequestedScope,
+		RequestedAudience: payload.RequestedAccessTokenAudience,
+		OIDCContext:       oidcContextFromV1(payload.OidcContext),
+		LoginChallenge:    payload.LoginChallenge,
+		LoginSessionID:    payload.LoginSessionID,
+		Acr:               payload.Acr,
+		Context:           payload.Context,
+	}, nil
+}
+
+func (h *HydraV1) AcceptConsentRequest(ctx context.Context, challenge string, accept AcceptConsent) (string, error) {
+	params := admin.NewAcceptConsentRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetConsentChallenge(challenge)
+
+	body := &models.AcceptConsentRequest{
+		GrantScope:               accept.GrantScope,
+		GrantAccessTokenAudience: accept.GrantAudience,
+		Remember:                 accept.Remember,
+		RememberFor:              accept.RememberFor,
+	}
+	if accept.Session != nil {
+		body.Session = &models.ConsentRequestSession{
+			AccessToken: accept.Session.AccessToken,
+			IDToken:     accept.Session.IDToken,
+		}
+	}
+	params.SetBody(body)
+
+	resp, err := h.client.Admin.AcceptConsentRequest(params)
+	if err != nil {
+		return "", err
+	}
+	return *resp.GetPayload().RedirectTo, nil
+}
+
+func (h *HydraV1) RejectConsentRequest(ctx context.Context, challenge string, reject Rejection) (string, error) {
+	params := admin.NewRejectConsentRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetConsentChallenge(challenge)
+	params.SetBody(rejectionToV1(reject))
+
+	resp, err := h.client.Admin.RejectConsentRequest(params)
+	if err != nil {
+		return "", err
+	}
+	return *resp.GetPayload().RedirectTo, nil
+}
+
+func (h *HydraV1) GetLogoutRequest(ctx context.Context, challenge string) (*LogoutRequest, error) {
+	params := admin.NewGetLogoutRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetLogoutChallenge(challenge)
+
+	resp, err := h.client.Admin.GetLogoutRequest(params)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := resp.GetPayload()
+	return &LogoutRequest{
+		Challenge: challenge,
+		Subject:   payload.Subject,
+		SessionID: payload.Sid,
+		Client:    clientFromV1(payload.Client),
+	}, nil
+}
+
+func (h *HydraV1) AcceptLogoutRequest(ctx context.Context, challenge string) (string, error) {
+	params := admin.NewAcceptLogoutRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetLogoutChallenge(challenge)
+
+	resp, err := h.client.Admin.AcceptLogoutRequest(params)
+	if err != nil {
+		return "", err
+	}
+	return *resp.GetPayload().RedirectTo, nil
+}
+
+func (h *HydraV1) RejectLogoutRequest(ctx context.Context, challenge string) error {
+	params := admin.NewRejectLogoutRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetLogoutChallenge(challenge)
+
+	_, err := h.client.Admin.RejectLogoutRequest(params)
+	return err
+}
+
+func (h *HydraV1) ListConsentSessions(ctx context.Context, subject string) ([]*ConsentSession, error) {
+	params := admin.NewListSubjectConsentSessionsParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetSubject(subject)
+
+	resp, err := h.client.Admin.ListSubjectConsentSessions(params)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*ConsentSession, 0, len(resp.GetPayload()))
+	for _, previous := range resp.GetPayload() {
+		session := &ConsentSession{
+			GrantedScopes: previous.GrantScope,
+			HandledAt:     time.Time(previous.HandledAt),
+		}
+		if previous.ConsentRequest != nil {
+			session.Client = clientFromV1(previous.ConsentRequest.Client)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (h *HydraV1) RevokeConsentSessions(ctx context.Context, subject string, clientID string) error {
+	params := admin.NewRevokeConsentSessionsParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetSubject(subject)
+	if clientID == "" {
+		all := true
+		params.SetAll(&all)
+	} else {
+		params.SetClient(&clientID)
+	}
+
+	_, err := h.client.Admin.RevokeConsentSessions(params)
+	return err
+}
+
+// CreateClient posts the JSON directly, since the client model of
+// hydra-client-go would drop fields it does not know.
+func (h *HydraV1) CreateClient(ctx context.Context, client json.RawMessage) error {
+	return postClient(ctx, h.httpClient, h.adminURL+"/clients", client)
+}
+
+func (h *HydraV1) GetClient(ctx context.Context, clientID string) (*Client, error) {
+	params := admin.NewGetOAuth2ClientParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetID(clientID)
+
+	resp, err := h.client.Admin.GetOAuth2Client(params)
+	if err != nil {
+		return nil, err
+	}
+	return clientFromV1(resp.GetPayload()), nil
+}
+
+func (h *HydraV1) DeleteClient(ctx context.Context, clientID string) error {
+	params := admin.NewDeleteOAuth2ClientParamsWithContext(ctx).WithHTTPClient(h.httpClient)
+	params.SetID(clientID)
+
+	_, err := h.client.Admin.DeleteOAuth2Client(params)
+	return err
+}
+
+func postClient(ctx context.Context, httpClient *http.Client, clientsURL string, client json.RawMessage) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, clientsURL, bytes.NewReader(client))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{Operation: "create client", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+func clientFromV1(client *models.OAuth2Client) *Client {
+	if client == nil {
+		return nil
+	}
+
+	metadata, _ := client.Metadata.(map[string]interface{})
+	return &Client{
+		ClientID:   client.ClientID,
+		ClientName: client.ClientName,
+		LogoURI:    client.LogoURI,
+		PolicyURI:  client.PolicyURI,
+		TosURI:     client.TosURI,
+		Metadata:   metadata,
+	}
+}
+
+func oidcContextFromV1(oidcContext *models.OpenIDConnectContext) *OIDCContext {
+	if oidcContext == nil {
+		return nil
+	}
+
+	claims, _ := oidcContext.IDTokenHintClaims.(map[string]interface{})
+	return &OIDCContext{
+		AcrValues:         oidcContext.AcrValues,
+		Display:           oidcContext.Display,
+		IDTokenHintClaims: claims,
+		LoginHint:         oidcContext.LoginHint,
+		UILocales:         oidcContext.UILocales,
+	}
+}
+
+func rejectionToV1(reject Rejection) *models.RejectRequest {
+	return &models.RejectRequest{
+		Error:            reject.Error,
+		ErrorDescription: reject.ErrorDescription,
+		StatusCode:       int64(reject.StatusCode),
+	}
+}
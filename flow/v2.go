@@ -0,0 +1,196 @@
+package flow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HydraV2 talks to the admin API of Hydra 2.x, which moved all endpoints
+// below /admin. There is no maintained Go SDK compatible with the v1 client,
+// so the adapter uses plain JSON requests.
+type HydraV2 struct {
+	adminURL   string
+	httpClient *http.Client
+}
+
+func NewHydraV2(adminURL string, httpClient *http.Client) (backend *HydraV2, err error) {
+	if _, err := url.Parse(adminURL); err != nil {
+		return nil, err
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &HydraV2{
+		adminURL:   strings.TrimSuffix(adminURL, "/"),
+		httpClient: httpClient,
+	}, nil
+}
+
+type completedRequest struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// call sends body as JSON and decodes the response into result if the
+// expected status is returned.
+func (h *HydraV2) call(ctx context.Context, operation string, method string, path string, query url.Values, body interface{}, expected int, result interface{}) error {
+	target := h.adminURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if raw, ok := body.(json.RawMessage); ok {
+		reader = bytes.NewReader(raw)
+	} else if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expected {
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &StatusError{Operation: operation, StatusCode: resp.StatusCode, Body: string(content)}
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (h *HydraV2) getRequest(ctx context.Context, flowType string, challenge string, result interface{}) error {
+	return h.call(ctx, "get "+flowType+" request", http.MethodGet, "/admin/oauth2/auth/requests/"+flowType,
+		url.Values{flowType + "_challenge": {challenge}}, nil, http.StatusOK, result)
+}
+
+func (h *HydraV2) completeRequest(ctx context.Context, flowType string, action string, challenge string, body interface{}) (string, error) {
+	var completed completedRequest
+	err := h.call(ctx, action+" "+flowType+" request", http.MethodPut, "/admin/oauth2/auth/requests/"+flowType+"/"+action,
+		url.Values{flowType + "_challenge": {challenge}}, body, http.StatusOK, &completed)
+	return completed.RedirectTo, err
+}
+
+func (h *HydraV2) GetLoginRequest(ctx context.Context, challenge string) (*LoginRequest, error) {
+	var login LoginRequest
+	if err := h.getRequest(ctx, "login", challenge, &login); err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+func (h *HydraV2) AcceptLoginRequest(ctx context.Context, challenge string, accept AcceptLogin) (string, error) {
+	return h.completeRequest(ctx, "login", "accept", challenge, &accept)
+}
+
+func (h *HydraV2) RejectLoginRequest(ctx context.Context, challenge string, reject Rejection) (string, error) {
+	return h.completeRequest(ctx, "login", "reject", challenge, &reject)
+}
+
+func (h *HydraV2) GetConsentRequest(ctx context.Context, challenge string) (*ConsentRequest, error) {
+	var consent ConsentRequest
+	if err := h.getRequest(ctx, "consent", challenge, &consent); err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+func (h *HydraV2) AcceptConsentRequest(ctx context.Context, challenge string, accept AcceptConsent) (string, error) {
+	return h.completeRequest(ctx, "consent", "accept", challenge, &accept)
+}
+
+func (h *HydraV2) RejectConsentRequest(ctx context.Context, challenge string, reject Rejection) (string, error) {
+	return h.completeRequest(ctx, "consent", "reject", challenge, &reject)
+}
+
+func (h *HydraV2) GetLogoutRequest(ctx context.Context, challenge string) (*LogoutRequest, error) {
+	var logout LogoutRequest
+	if err := h.getRequest(ctx, "logout", challenge, &logout); err != nil {
+		return nil, err
+	}
+	return &logout, nil
+}
+
+func (h *HydraV2) AcceptLogoutRequest(ctx context.Context, challenge string) (string, error) {
+	return h.completeRequest(ctx, "logout", "accept", challenge, nil)
+}
+
+func (h *HydraV2) RejectLogoutRequest(ctx context.Context, challenge string) error {
+	return h.call(ctx, "reject logout request", http.MethodPut, "/admin/oauth2/auth/requests/logout/reject",
+		url.Values{"logout_challenge": {challenge}}, nil, http.StatusNoContent, nil)
+}
+
+type consentSessionV2 struct {
+	ConsentRequest *ConsentRequest `json:"consent_request"`
+	GrantScope     []string        `json:"grant_scope"`
+	HandledAt      time.Time       `json:"handled_at"`
+}
+
+func (h *HydraV2) ListConsentSessions(ctx context.Context, subject string) ([]*ConsentSession, error) {
+	var previous []*consentSessionV2
+	if err := h.call(ctx, "list consent sessions", http.MethodGet, "/admin/oauth2/auth/sessions/consent",
+		url.Values{"subject": {subject}}, nil, http.StatusOK, &previous); err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*ConsentSession, 0, len(previous))
+	for _, p := range previous {
+		session := &ConsentSession{GrantedScopes: p.GrantScope, HandledAt: p.HandledAt}
+		if p.ConsentRequest != nil {
+			session.Client = p.ConsentRequest.Client
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (h *HydraV2) RevokeConsentSessions(ctx context.Context, subject string, clientID string) error {
+	query := url.Values{"subject": {subject}}
+	if clientID == "" {
+		query.Set("all", "true")
+	} else {
+		query.Set("client", clientID)
+	}
+
+	return h.call(ctx, "revoke consent sessions", http.MethodDelete, "/admin/oauth2/auth/sessions/consent",
+		query, nil, http.StatusNoContent, nil)
+}
+
+func (h *HydraV2) CreateClient(ctx context.Context, client json.RawMessage) error {
+	return h.call(ctx, "create client", http.MethodPost, "/admin/clients", nil, client, http.StatusCreated, nil)
+}
+
+func (h *HydraV2) GetClient(ctx context.Context, clientID string) (*Client, error) {
+	var client Client
+	if err := h.call(ctx, "get client", http.MethodGet, "/admin/clients/"+url.PathEscape(clientID), nil, nil, http.StatusOK, &client); err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (h *HydraV2) DeleteClient(ctx context.Context, clientID string) error {
+	return h.call(ctx, "delete client", http.MethodDelete, "/admin/clients/"+url.PathEscape(clientID), nil, nil, http.StatusNoContent, nil)
+}
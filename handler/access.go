@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/logging"
+	"strings"
+)
+
+// accessDenied is sent to the client when the user lacks a role the client
+// requires or belongs to another realm.
+var accessDenied = flow.Rejection{
+	Error:            "access_denied",
+	ErrorDescription: "The user is not allowed to access this client",
+	StatusCode:       http.StatusForbidden,
+}
+
+// missingRoles returns the roles required by the client the subject does not
+// have. An unknown subject lacks every required role.
+func (h *Handler) missingRoles(ctx context.Context, client *flow.Client, subject string) []string {
+	required := h.Access.RequiredRoles(client)
+	if len(required) == 0 {
+		return nil
+	}
+
+	u, err := h.getUser(ctx, subject)
+	if err != nil {
+		return required
+	}
+	return h.Access.Missing(client, h.effectiveRoles(ctx, subject, u))
+}
+
+// registrationDomainDenied reports whether the subject registered itself
+// with an email of a domain the client does not allow to register.
+func (h *Handler) registrationDomainDenied(ctx context.Context, client *flow.Client, subject string) bool {
+	u, err := h.getUser(ctx, subject)
+	if err != nil || !u.Registered {
+		return false
+	}
+	return !h.Registration.SignInAllowed(client, u.Email)
+}
+
+// accessDeniedReason returns why the subject may not log in to the client,
+// or an empty string.
+func (h *Handler) accessDeniedReason(r *http.Request, client *flow.Client, subject string) string {
+	if reason := h.realmDenied(r, client, subject); reason != "" {
+		return reason
+	}
+	if missing := h.missingRoles(r.Context(), client, subject); len(missing) > 0 {
+		return "missing roles: " + strings.Join(missing, ",")
+	}
+	if h.registrationDomainDenied(r.Context(), client, subject) {
+		return "registration domain not allowed"
+	}
+	return ""
+}
+
+// loginAccessDenied rejects the login request if the subject may not log in
+// to the client. It reports whether the request was rejected.
+func (h *Handler) loginAccessDenied(w http.ResponseWriter, r *http.Request, event audit.Event, loginRequest *flow.LoginRequest) bool {
+	reason := h.accessDeniedReason(r, loginRequest.Client, event.Subject)
+	if reason == "" {
+		return false
+	}
+
+	redirectTo, err := h.Flow.RejectLoginRequest(r.Context(), loginRequest.Challenge, accessDenied)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("RejectLoginRequest failed", "error", err)
+	}
+	h.showAccessDenied(w, r, event, loginRequest.Client, reason, redirectTo, loginRequest.HasPrompt(flow.PromptNone))
+	return true
+}
+
+// consentAccessDenied rejects the consent request if the subject may not log
+// in to the client, e.g. because the roles changed while the login was
+// remembered. It reports whether the request was rejected.
+func (h *Handler) consentAccessDenied(w http.ResponseWriter, r *http.Request, consentChallenge string, consentRequest *flow.ConsentRequest) bool {
+	reason := h.accessDeniedReason(r, consentRequest.Client, consentRequest.Subject)
+	if reason == "" {
+		return false
+	}
+
+	redirectTo, err := h.Flow.RejectConsentRequest(r.Context(), consentChallenge, accessDenied)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("RejectConsentRequest failed", "error", err)
+	}
+	event := consentEvent(consentRequest, audit.EventConsentRejected)
+	h.showAccessDenied(w, r, event, consentRequest.Client, reason, redirectTo, consentRequest.HasPrompt(flow.PromptNone))
+	return true
+}
+
+// showAccessDenied renders the error page with a link back to the client,
+// which receives the access_denied error. A client that requested
+// prompt=none gets the error without the page.
+func (h *Handler) showAccessDenied(w http.ResponseWriter, r *http.Request, event audit.Event, client *flow.Client, reason string, redirectTo string, promptNone bool) {
+	logger := logging.FromContext(r.Context())
+
+	event.Type, event.ClientID = audit.EventAccessDenied, clientID(client)
+	event.Outcome, event.Reason = audit.OutcomeFailure, reason
+	h.Audit.Emit(r, event)
+	logger.Info("access denied", "subject", event.Subject, "client_id", event.ClientID, "reason", reason)
+
+	if promptNone && redirectTo != "" {
+		http.Redirect(w, r, h.rewriteRedirect(r, redirectTo), http.StatusFound)
+		return
+	}
+
+	continueURL := ""
+	if redirectTo != "" {
+		continueURL = h.rewriteRedirect(r, redirectTo)
+	}
+
+	name := clientID(client)
+	if client != nil && client.ClientName != "" {
+		name = client.ClientName
+	}
+
+	l := h.localizer(r)
+	h.renderPage(w, r, http.StatusForbidden, clientID(client), "error.html", map[string]interface{}{
+		"ErrorTitle":   l.T("error.access_denied.title"),
+		"ErrorContent": l.T("error.access_denied.content", name),
+		"ContinueURL":  continueURL,
+	})
+}
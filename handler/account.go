@@ -0,0 +1,513 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/i18n"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/session"
+	"simple-login-endpoint/user"
+	"strings"
+	"time"
+)
+
+const (
+	AccountPath         = "/idp/account"
+	AccountLoginPath    = "/idp/account/login"
+	AccountLogoutPath   = "/idp/account/logout"
+	AccountProfilePath  = "/idp/account/profile"
+	AccountPasswordPath = "/idp/account/password"
+	AccountTOTPPath     = "/idp/account/totp"
+	AccountPasskeysPath = "/idp/account/passkeys"
+	AccountConsentsPath = "/idp/account/consents"
+)
+
+// accountStatuses are the confirmations the account page shows after a
+// change, passed as status query parameter.
+var accountStatuses = map[string]bool{
+	"profile_updated":  true,
+	"password_changed": true,
+	"totp_enabled":     true,
+	"totp_disabled":    true,
+	"passkey_added":    true,
+	"passkey_removed":  true,
+}
+
+// loginActivity are the events shown as recent login activity.
+var loginActivity = map[audit.EventType]bool{
+	audit.EventLogin:        true,
+	audit.EventLoginSkipped: true,
+	audit.EventAccountLogin: true,
+}
+
+type consentView struct {
+	ClientID   string
+	ClientName string
+	Scopes     []string
+	GrantedAt  time.Time
+}
+
+func (h *Handler) HandleAccountLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.accountLoginGet(w, r)
+	case http.MethodPost:
+		h.accountLoginPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccountLogout(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.accountLogoutPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccount(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.accountGet(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccountProfile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.accountProfilePOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccountPassword(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.accountPasswordPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccountConsents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.accountConsentsGet(w, r)
+	case http.MethodPost:
+		h.accountConsentsPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// accountNext only allows redirects to the account pages after the login,
+// everything else would be an open redirect.
+func accountNext(next string) string {
+	if next == AccountPath {
+		return next
+	}
+	if next == "" || !strings.HasPrefix(next, AccountPath+"/") || strings.ContainsAny(next, "\\") ||
+		strings.HasPrefix(next, AccountLoginPath) || strings.Contains(next, "/../") {
+		return AccountPath
+	}
+	return next
+}
+
+// accountSession returns the session of the account pages or redirects to
+// the account login. A session of a user that can not be loaded is ended.
+func (h *Handler) accountSession(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	s, err := h.Sessions.Load(r)
+	if err != nil {
+		logging.FromContext(r.Context()).Debug("no account session", "error", err)
+		http.Redirect(w, r, AccountLoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return nil, false
+	}
+
+	// the session ends with the password or when the user is removed
+	if u, err := h.getUser(r.Context(), s.Subject); err != nil || !h.Sessions.ValidPassword(s, u.Password) {
+		logging.FromContext(r.Context()).Info("account session ended by password change or removed user", "subject", s.Subject, "error", err)
+		h.Sessions.End(w)
+		http.Redirect(w, r, AccountLoginPath+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return nil, false
+	}
+	return s, true
+}
+
+// withAccountLocale uses the Accept-Language header, the account pages are
+// not part of an OAuth flow with ui_locales.
+func (h *Handler) withAccountLocale(r *http.Request) *http.Request {
+	return r.WithContext(i18n.WithLocale(r.Context(), h.Messages.Resolve(nil, r.Header.Get("Accept-Language"))))
+}
+
+// validCSRF checks the token of the submitted form and renders the error
+// page if it does not match the session.
+func (h *Handler) validCSRF(w http.ResponseWriter, r *http.Request, s *session.Session) bool {
+	if s.ValidCSRF(r.FormValue("csrf_token")) {
+		return true
+	}
+
+	logging.FromContext(r.Context()).Warn("invalid csrf token", "subject", s.Subject)
+	l := h.localizer(r)
+	h.renderPage(w, r, http.StatusForbidden, "", "error.html", map[string]interface{}{
+		"ErrorTitle":   l.T("account.csrf_invalid.title"),
+		"ErrorContent": l.T("account.csrf_invalid.content"),
+	})
+	return false
+}
+
+func (h *Handler) accountLoginGet(w http.ResponseWriter, r *http.Request) {
+	r = h.withAccountLocale(r)
+	next := accountNext(r.URL.Query().Get("next"))
+
+	if _, err := h.Sessions.Load(r); err == nil {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	h.renderPage(w, r, http.StatusOK, "", "account_login.html", map[string]interface{}{
+		"Next":          next,
+		"PasswordReset": h.passwordResetEnabled(),
+	})
+}
+
+func (h *Handler) accountLoginPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountLoginPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	logger := logging.FromContext(r.Context())
+	email := r.FormValue("username")
+	next := accountNext(r.FormValue("next"))
+	r, rl, ok := h.requestRealm(w, r, nil)
+	if !ok {
+		return
+	}
+
+	event := audit.Event{
+		Type:    audit.EventAccountLogin,
+		Outcome: audit.OutcomeSuccess,
+		Subject: rl.Subject(email),
+	}
+
+	u, valid := h.validUser(r.Context(), event.Subject, r.FormValue("password"))
+	if !valid {
+		logger.Info("invalid credentials for account", "username", email)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid credentials"
+		h.Audit.Emit(r, event)
+		l := h.localizer(r)
+		h.renderPage(w, r, http.StatusUnauthorized, "", "account_login.html", map[string]interface{}{
+			"Next":          next,
+			"ErrorTitle":    l.T("login.invalid_credentials.title"),
+			"ErrorContent":  l.T("login.invalid_credentials.content"),
+			"PasswordReset": h.passwordResetEnabled(),
+		})
+		return
+	}
+
+	if u.HasSecondFactor() {
+		logger.Info("second factor required for account", "username", email)
+		h.showLoginMFA(w, r, http.StatusOK, u, &mfaTicket{Subject: event.Subject, Next: next}, "")
+		return
+	}
+
+	h.startAccountSession(w, r, event, next)
+}
+
+// startAccountSession signs the user in to the account pages after all
+// factors are verified.
+func (h *Handler) startAccountSession(w http.ResponseWriter, r *http.Request, event audit.Event, next string) {
+	logger := logging.FromContext(r.Context())
+
+	if h.passwordExpired(w, r, event, "") {
+		return
+	}
+
+	u, err := h.getUser(r.Context(), event.Subject)
+	if err != nil {
+		logger.Error("user of account login not found", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+	if _, err := h.Sessions.Start(w, event.Subject, u.Password); err != nil {
+		logger.Error("could not start account session", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+
+	h.Audit.Emit(r, event)
+	logger.Info("account login", "subject", event.Subject)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (h *Handler) accountLogoutPOST(w http.ResponseWriter, r *http.Request) {
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok || !h.validCSRF(w, r, s) {
+		return
+	}
+
+	h.Sessions.End(w)
+	h.Audit.Emit(r, audit.Event{Type: audit.EventAccountLogout, Outcome: audit.OutcomeSuccess, Subject: s.Subject})
+	http.Redirect(w, r, AccountLoginPath, http.StatusSeeOther)
+}
+
+func (h *Handler) accountConsentsGet(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountConsentsGet")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Subject":   s.Subject,
+		"CSRFToken": s.CSRFToken,
+	}
+
+	sessions, err := h.Flow.ListConsentSessions(r.Context(), s.Subject)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("ListConsentSessions failed", "error", err)
+		data["ErrorTitle"] = h.localizer(r).T("account.consents.error.title")
+		data["ErrorContent"] = h.localizer(r).T("error.retry")
+		h.renderPage(w, r, http.StatusBadGateway, "", "account_consents.html", data)
+		return
+	}
+
+	consents := make([]consentView, 0, len(sessions))
+	for _, consent := range sessions {
+		if consent.Client == nil {
+			continue
+		}
+		consents = append(consents, consentView{
+			ClientID:   consent.Client.ClientID,
+			ClientName: consent.Client.ClientName,
+			Scopes:     consent.GrantedScopes,
+			GrantedAt:  consent.HandledAt,
+		})
+	}
+	data["Consents"] = consents
+
+	h.renderPage(w, r, http.StatusOK, "", "account_consents.html", data)
+}
+
+func (h *Handler) accountConsentsPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountConsentsPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok || !h.validCSRF(w, r, s) {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+
+	event := audit.Event{
+		Type:    audit.EventConsentRevoked,
+		Outcome: audit.OutcomeSuccess,
+		Subject: s.Subject,
+	}
+
+	clientID := ""
+	if r.FormValue("revoke_all") == "" {
+		clientID = r.FormValue("client_id")
+		if clientID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		event.ClientID = clientID
+	} else {
+		event.Reason = "all clients"
+	}
+
+	if err := h.Flow.RevokeConsentSessions(r.Context(), s.Subject, clientID); err != nil {
+		logger.Error("RevokeConsentSessions failed", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "revoke consent sessions failed"
+		h.Audit.Emit(r, event)
+		l := h.localizer(r)
+		h.renderPage(w, r, http.StatusBadGateway, "", "error.html", map[string]interface{}{
+			"ErrorTitle":   l.T("account.consents.revoke_error.title"),
+			"ErrorContent": l.T("error.retry"),
+		})
+		return
+	}
+
+	h.Audit.Emit(r, event)
+	logger.Info("consent revoked", "subject", s.Subject, "client_id", clientID)
+	http.Redirect(w, r, AccountConsentsPath, http.StatusSeeOther)
+}
+
+// accountUser returns the user of the session. A session of a deleted user
+// is ended.
+func (h *Handler) accountUser(w http.ResponseWriter, r *http.Request, s *session.Session) (*user.User, bool) {
+	u, err := h.getUser(r.Context(), s.Subject)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("user of account session not found", "subject", s.Subject)
+		h.Sessions.End(w)
+		http.Redirect(w, r, AccountLoginPath, http.StatusSeeOther)
+		return nil, false
+	}
+	return u, true
+}
+
+// accountData returns the data of the account page.
+func (h *Handler) accountData(s *session.Session, u *user.User) map[string]interface{} {
+	activity := make([]audit.Event, 0)
+	for _, event := range h.Activity.Recent(s.Subject) {
+		if loginActivity[event.Type] {
+			activity = append(activity, event)
+		}
+	}
+
+	return map[string]interface{}{
+		"Subject":         s.Subject,
+		"CSRFToken":       s.CSRFToken,
+		"User":            u,
+		"Locales":         h.Messages.Locales(),
+		"PasskeysEnabled": h.Passkeys.Enabled(),
+		"Activity":        activity,
+	}
+}
+
+// showAccountError renders the account page again with an error, e.g. when
+// a form was filled in wrongly.
+func (h *Handler) showAccountError(w http.ResponseWriter, r *http.Request, status int, s *session.Session, u *user.User, errorTitleKey string, errorContentKey string) {
+	l := h.localizer(r)
+	data := h.accountData(s, u)
+	data["ErrorTitle"] = l.T(errorTitleKey)
+	data["ErrorContent"] = l.T(errorContentKey)
+	h.renderPage(w, r, status, "", "account.html", data)
+}
+
+// accountChanged emits the audit event and shows the account page with a
+// confirmation of the change.
+func (h *Handler) accountChanged(w http.ResponseWriter, r *http.Request, event audit.Event) {
+	h.Audit.Emit(r, event)
+	logging.FromContext(r.Context()).Info("account changed", "subject", event.Subject, "change", event.Type)
+	http.Redirect(w, r, AccountPath+"?status="+string(event.Type), http.StatusSeeOther)
+}
+
+func (h *Handler) accountGet(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountGet")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok {
+		return
+	}
+	u, ok := h.accountUser(w, r, s)
+	if !ok {
+		return
+	}
+
+	data := h.accountData(s, u)
+	if status := r.URL.Query().Get("status"); accountStatuses[status] {
+		data["Status"] = h.localizer(r).T("account.status." + status)
+	}
+	h.renderPage(w, r, http.StatusOK, "", "account.html", data)
+}
+
+func (h *Handler) accountProfilePOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountProfilePOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok || !h.validCSRF(w, r, s) {
+		return
+	}
+	u, ok := h.accountUser(w, r, s)
+	if !ok {
+		return
+	}
+
+	updated := *u
+	updated.GivenName = strings.TrimSpace(r.FormValue("given_name"))
+	updated.FamilyName = strings.TrimSpace(r.FormValue("family_name"))
+	updated.Locale = r.FormValue("locale")
+
+	if updated.Locale != "" && !h.Messages.Supports(updated.Locale) {
+		h.showAccountError(w, r, http.StatusBadRequest, s, u, "account.profile.error.title", "account.profile.invalid_locale")
+		return
+	}
+
+	_, err := h.modifyUser(s.Subject, func(stored *user.User) error {
+		stored.GivenName, stored.FamilyName, stored.Locale = updated.GivenName, updated.FamilyName, updated.Locale
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("could not update profile", "error", err)
+		h.showAccountError(w, r, http.StatusInternalServerError, s, u, "account.profile.error.title", "error.retry")
+		return
+	}
+
+	h.accountChanged(w, r, audit.Event{Type: audit.EventProfileUpdated, Outcome: audit.OutcomeSuccess, Subject: s.Subject})
+}
+
+func (h *Handler) accountPasswordPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountPasswordPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok || !h.validCSRF(w, r, s) {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+
+	event := audit.Event{
+		Type:    audit.EventPasswordChanged,
+		Outcome: audit.OutcomeSuccess,
+		Subject: s.Subject,
+	}
+
+	u, valid := h.validUser(r.Context(), s.Subject, r.FormValue("current_password"))
+	if !valid {
+		logger.Info("invalid current password", "subject", s.Subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid current password"
+		h.Audit.Emit(r, event)
+		if u, ok = h.accountUser(w, r, s); ok {
+			h.showAccountError(w, r, http.StatusUnauthorized, s, u, "account.password.error.title", "account.password.invalid_current")
+		}
+		return
+	}
+
+	newPassword := r.FormValue("new_password")
+	if newPassword == "" || newPassword != r.FormValue("new_password_confirm") {
+		h.showAccountError(w, r, http.StatusBadRequest, s, u, "account.password.error.title", "account.password.mismatch")
+		return
+	}
+
+	updated := *u
+	if err := h.passwordPolicy(s.Subject).Set(&updated, newPassword, time.Now()); err != nil {
+		logger.Info("new password rejected", "subject", s.Subject, "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "password policy violated"
+		h.Audit.Emit(r, event)
+		l := h.localizer(r)
+		data := h.accountData(s, u)
+		data["ErrorTitle"] = l.T("account.password.error.title")
+		data["ErrorContent"] = passwordViolation(l, err)
+		h.renderPage(w, r, http.StatusBadRequest, "", "account.html", data)
+		return
+	}
+	if _, err := h.modifyUser(s.Subject, unchangedPassword(u, &updated)); err != nil {
+		logger.Error("could not change password", "error", err)
+		h.showAccountError(w, r, http.StatusInternalServerError, s, u, "account.password.error.title", "error.retry")
+		return
+	}
+
+	// other sessions end, the session of this browser continues
+	s.Password = h.Sessions.Fingerprint(updated.Password)
+	if err := h.Sessions.Save(w, s); err != nil {
+		logger.Error("could not update account session", "error", err)
+	}
+	h.accountChanged(w, r, event)
+}
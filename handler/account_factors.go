@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/mfa"
+	"simple-login-endpoint/session"
+	"simple-login-endpoint/user"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	purposeTOTPEnrollment      = "totp_enrollment"
+	purposePasskeyRegistration = "passkey_registration"
+	// enrollmentTTL limits the time to scan the secret or to touch the
+	// authenticator.
+	enrollmentTTL = 10 * time.Minute
+)
+
+// totpEnrollment keeps the new secret until the user confirmed it with a
+// code, so a mistyped secret never locks the user out.
+type totpEnrollment struct {
+	Subject string `json:"sub"`
+	Secret  string `json:"secret"`
+}
+
+type passkeyRegistration struct {
+	Subject  string        `json:"sub"`
+	Ceremony *mfa.Ceremony `json:"ceremony"`
+}
+
+func (h *Handler) HandleAccountTOTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.accountTOTPGet(w, r)
+	case http.MethodPost:
+		h.accountTOTPPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccountPasskeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.accountPasskeysGet(w, r)
+	case http.MethodPost:
+		h.accountPasskeysPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// confirmPassword verifies the current password before a second factor is
+// removed, so a forgotten session can not be used to weaken the account.
+func (h *Handler) confirmPassword(w http.ResponseWriter, r *http.Request, s *session.Session, event audit.Event) (*user.User, bool) {
+	u, valid := h.validUser(r.Context(), s.Subject, r.FormValue("current_password"))
+	if valid {
+		return u, true
+	}
+
+	logging.FromContext(r.Context()).Info("invalid current password", "subject", s.Subject)
+	event.Outcome, event.Reason = audit.OutcomeFailure, "invalid current password"
+	h.Audit.Emit(r, event)
+	if u, ok := h.accountUser(w, r, s); ok {
+		h.showAccountError(w, r, http.StatusUnauthorized, s, u, "account.factors.error.title", "account.password.invalid_current")
+	}
+	return nil, false
+}
+
+func (h *Handler) showTOTPEnrollment(w http.ResponseWriter, r *http.Request, status int, s *session.Session, enrollment *totpEnrollment, ticket string) {
+	data := map[string]interface{}{
+		"CSRFToken": s.CSRFToken,
+		"Secret":    enrollment.Secret,
+		"URI":       mfa.TOTPURI(h.totpIssuer, s.Subject, enrollment.Secret),
+		"Ticket":    ticket,
+	}
+	if status != http.StatusOK {
+		l := h.localizer(r)
+		data["ErrorTitle"] = l.T("account.totp.invalid.title")
+		data["ErrorContent"] = l.T("account.totp.invalid.content")
+	}
+	h.renderPage(w, r, status, "", "account_totp.html", data)
+}
+
+func (h *Handler) accountTOTPGet(w http.ResponseWriter, r *http.Request) {
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok {
+		return
+	}
+	u, ok := h.accountUser(w, r, s)
+	if !ok {
+		return
+	}
+	if u.TOTPSecret != "" {
+		http.Redirect(w, r, AccountPath, http.StatusSeeOther)
+		return
+	}
+
+	secret, err := mfa.GenerateTOTPSecret()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("could not generate totp secret", "error", err)
+		h.showErrorPage(w, r, "account.factors.error.title", "error.retry")
+		return
+	}
+
+	enrollment := &totpEnrollment{Subject: s.Subject, Secret: secret}
+	ticket, err := h.Sessions.Seal(purposeTOTPEnrollment, enrollment, enrollmentTTL)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("could not seal totp enrollment", "error", err)
+		h.showErrorPage(w, r, "account.factors.error.title", "error.retry")
+		return
+	}
+
+	h.showTOTPEnrollment(w, r, http.StatusOK, s, enrollment, ticket)
+}
+
+func (h *Handler) accountTOTPPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountTOTPPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok || !h.validCSRF(w, r, s) {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+
+	if r.FormValue("action") == "remove" {
+		event := audit.Event{Type: audit.EventTOTPDisabled, Outcome: audit.OutcomeSuccess, Subject: s.Subject}
+		u, ok := h.confirmPassword(w, r, s, event)
+		if !ok {
+			return
+		}
+
+		_, err := h.modifyUser(s.Subject, func(stored *user.User) error {
+			stored.TOTPSecret = ""
+			stored.TOTPLastStep = 0
+			return nil
+		})
+		if err != nil {
+			logger.Error("could not remove totp", "error", err)
+			h.showAccountError(w, r, http.StatusInternalServerError, s, u, "account.factors.error.title", "error.retry")
+			return
+		}
+		h.accountChanged(w, r, event)
+		return
+	}
+
+	ticket := r.FormValue("ticket")
+	var enrollment totpEnrollment
+	if err := h.Sessions.Open(purposeTOTPEnrollment, ticket, &enrollment); err != nil || enrollment.Subject != s.Subject {
+		logger.Info("invalid totp enrollment", "error", err)
+		http.Redirect(w, r, AccountTOTPPath, http.StatusSeeOther)
+		return
+	}
+
+	step, valid := mfa.MatchTOTP(enrollment.Secret, r.FormValue("code"), time.Now())
+	if !valid {
+		h.showTOTPEnrollment(w, r, http.StatusBadRequest, s, &enrollment, ticket)
+		return
+	}
+
+	u, ok := h.accountUser(w, r, s)
+	if !ok {
+		return
+	}
+	_, err := h.modifyUser(s.Subject, func(stored *user.User) error {
+		stored.TOTPSecret = enrollment.Secret
+		// the code of the enrollment cannot be used for a login
+		stored.TOTPLastStep = step
+		return nil
+	})
+	if err != nil {
+		logger.Error("could not enable totp", "error", err)
+		h.showAccountError(w, r, http.StatusInternalServerError, s, u, "account.factors.error.title", "error.retry")
+		return
+	}
+	h.accountChanged(w, r, audit.Event{Type: audit.EventTOTPEnabled, Outcome: audit.OutcomeSuccess, Subject: s.Subject})
+}
+
+func (h *Handler) accountPasskeysGet(w http.ResponseWriter, r *http.Request) {
+	if !h.Passkeys.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok {
+		return
+	}
+	u, ok := h.accountUser(w, r, s)
+	if !ok {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+
+	options, ceremony, err := h.Passkeys.BeginRegistration(u)
+	if err != nil {
+		logger.Error("could not begin passkey registration", "error", err)
+		h.showErrorPage(w, r, "account.factors.error.title", "error.retry")
+		return
+	}
+
+	ticket, err := h.Sessions.Seal(purposePasskeyRegistration, &passkeyRegistration{Subject: s.Subject, Ceremony: ceremony}, enrollmentTTL)
+	if err != nil {
+		logger.Error("could not seal passkey registration", "error", err)
+		h.showErrorPage(w, r, "account.factors.error.title", "error.retry")
+		return
+	}
+
+	h.renderPage(w, r, http.StatusOK, "", "account_passkey.html", map[string]interface{}{
+		"CSRFToken":      s.CSRFToken,
+		"Ticket":         ticket,
+		"PasskeyOptions": string(options),
+		"Scripts":        []string{"passkey.js"},
+	})
+}
+
+func (h *Handler) accountPasskeysPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountPasskeysPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	s, ok := h.accountSession(w, r)
+	if !ok || !h.validCSRF(w, r, s) {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+
+	if r.FormValue("action") == "remove" {
+		event := audit.Event{Type: audit.EventPasskeyRemoved, Outcome: audit.OutcomeSuccess, Subject: s.Subject}
+		u, ok := h.confirmPassword(w, r, s, event)
+		if !ok {
+			return
+		}
+
+		id := r.FormValue("passkey_id")
+		_, err := h.modifyUser(s.Subject, func(stored *user.User) error {
+			stored.Passkeys = slices.DeleteFunc(slices.Clone(stored.Passkeys), func(passkey user.Passkey) bool {
+				return passkey.ID == id
+			})
+			return nil
+		})
+		if err != nil {
+			logger.Error("could not remove passkey", "error", err)
+			h.showAccountError(w, r, http.StatusInternalServerError, s, u, "account.factors.error.title", "error.retry")
+			return
+		}
+		h.accountChanged(w, r, event)
+		return
+	}
+
+	if !h.Passkeys.Enabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	event := audit.Event{Type: audit.EventPasskeyAdded, Outcome: audit.OutcomeSuccess, Subject: s.Subject}
+
+	var registration passkeyRegistration
+	if err := h.Sessions.Open(purposePasskeyRegistration, r.FormValue("ticket"), &registration); err != nil ||
+		registration.Subject != s.Subject || registration.Ceremony == nil {
+		logger.Info("invalid passkey registration", "error", err)
+		http.Redirect(w, r, AccountPasskeysPath, http.StatusSeeOther)
+		return
+	}
+
+	u, ok := h.accountUser(w, r, s)
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		name = h.localizer(r).T("account.passkeys.default_name")
+	}
+
+	passkey, err := h.Passkeys.FinishRegistration(u, *registration.Ceremony, r.FormValue("credential"), name)
+	if err != nil {
+		logger.Info("passkey registration failed", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid passkey"
+		h.Audit.Emit(r, event)
+		h.showAccountError(w, r, http.StatusBadRequest, s, u, "account.factors.error.title", "account.passkeys.invalid")
+		return
+	}
+
+	_, err = h.modifyUser(s.Subject, func(stored *user.User) error {
+		stored.Passkeys = append(slices.Clone(stored.Passkeys), *passkey)
+		return nil
+	})
+	if err != nil {
+		logger.Error("could not add passkey", "error", err)
+		h.showAccountError(w, r, http.StatusInternalServerError, s, u, "account.factors.error.title", "error.retry")
+		return
+	}
+	h.accountChanged(w, r, event)
+}
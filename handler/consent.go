@@ -2,203 +2,246 @@ package handler
 
 import (
 	"context"
-	"log"
 	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/user"
+	"slices"
 	"strings"
-	"text/template"
-
-	"github.com/ory/hydra-client-go/client/admin"
-	"github.com/ory/hydra-client-go/models"
 )
 
 func (h *Handler) consentGet(w http.ResponseWriter, r *http.Request) {
-	log.Println("consentGet")
-	consent_challenge := r.URL.Query().Get("consent_challenge")
+	r, span := h.startSpan(r, "consentGet")
+	defer span.End()
 
-	tmpl := template.Must(template.ParseFiles("view/consent.html"))
+	consent_challenge := r.URL.Query().Get("consent_challenge")
+	r = r.WithContext(logging.WithChallenge(r.Context(), consent_challenge))
+	logger := logging.FromContext(r.Context())
+	logger.Debug("GET consent")
 
 	if consent_challenge == "" {
-		log.Println("consent_challenge missed")
-
-		err := tmpl.Execute(w, nil)
+		logger.Info("consent_challenge missed")
+		l := h.localizer(r)
+		h.renderPage(w, r, http.StatusOK, "", "consent.html", map[string]interface{}{
+			"ErrorTitle":   l.T("consent.challenge_missing.title"),
+			"ErrorContent": l.T("consent.challenge_missing.content"),
+		})
+		return
+	}
 
-		if err != nil {
-			log.Println("error during templating: ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			if _, err := w.Write([]byte("An expected error occured")); err != nil {
-				panic("unexpected error:" + err.Error())
-			}
-		}
+	consentRequest, err := h.Flow.GetConsentRequest(r.Context(), consent_challenge)
 
+	if err != nil {
+		logger.Error("GetConsentRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
 
-	consentGETparams := admin.NewGetConsentRequestParamsWithContext(r.Context()).WithHTTPClient(h.httpClient)
-	consentGETparams.SetConsentChallenge(consent_challenge)
-
-	consentGETResp, err := h.HydraClient.Admin.GetConsentRequest(consentGETparams)
+	r = r.WithContext(logging.WithChallenge(r.Context(), consentRequest.LoginChallenge))
+	logger = logging.FromContext(r.Context())
+	r = h.withLocale(r, consentRequest.OIDCContext)
 
-	if err != nil {
-		log.Println("GetConsentRequest failed", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err := w.Write([]byte("GetConsentRequest failed")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+	if h.consentAccessDenied(w, r, consent_challenge, consentRequest) {
 		return
 	}
 
-	session, err := h.createSessionWithCustomClaims(consentGETResp)
+	session, err := h.createSessionWithCustomClaims(r.Context(), consentRequest)
 
 	if err != nil {
-		log.Println("Error on setting custom claims", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err := w.Write([]byte("Error on setting custom claims")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+		logger.Error("Error on setting custom claims", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
 
-	if consentGETResp.GetPayload().Skip {
+	trusted := h.Trust.IsTrusted(consentRequest.Client)
+	if consentRequest.Skip || trusted {
 		//grant the consent request.
-		log.Println("skip consent")
-		consentAcceptResp, err := h.acceptConsentRequest(r.Context(), consent_challenge, consentGETResp, session)
+		logger.Info("skip consent", "trusted_client", trusted)
+		event := consentEvent(consentRequest, audit.EventConsentAccepted)
+		event.Reason = "consent remembered"
+		if !consentRequest.Skip {
+			event.Reason = "trusted client"
+		}
+		redirectTo, err := h.acceptConsentRequest(r.Context(), consent_challenge, consentRequest, session)
 		if err != nil {
-			log.Println("AcceptConsentRequest failed", err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			if _, err := w.Write([]byte("AcceptConsentRequest failed")); err != nil {
-				panic("unexpected error:" + err.Error())
-			}
+			logger.Error("AcceptConsentRequest failed", "error", err)
+			event.Outcome, event.Reason = audit.OutcomeFailure, "accept consent request failed"
+			h.Audit.Emit(r, event)
+			h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 			return
 		}
 
-		redirectUrl := *consentAcceptResp.GetPayload().RedirectTo
-		if len(strings.TrimSpace(h.alt_redirect_hydra_url)) > 0 {
-			log.Println("use alt redirect url ", h.alt_redirect_hydra_url)
-			matchUrl := h.hydra_public_url
-			if len(strings.TrimSpace(h.issuerUri)) > 0 {
-				matchUrl = h.issuerUri
-			}
-			redirectUrl = strings.Replace(redirectUrl, matchUrl, h.alt_redirect_hydra_url, 1)
-		}
-		log.Println("redirect to after consent: ", redirectUrl)
+		redirectUrl := h.rewriteRedirect(r, redirectTo)
+		h.Audit.Emit(r, event)
+		logger.Info("consent accepted", "redirect_to", redirectUrl)
 
 		http.Redirect(w, r, redirectUrl, http.StatusFound)
+		return
 	}
 
-	err = tmpl.Execute(w, map[string]interface{}{
-		"RequestedScopes":  consentGETResp.GetPayload().RequestedScope,
-		"ConsentApp":       consentGETResp.GetPayload().Client.ClientName,
+	if consentRequest.HasPrompt(flow.PromptNone) {
+		h.rejectConsentWithoutPrompt(w, r, consent_challenge, consentRequest)
+		return
+	}
+
+	client := consentRequest.Client
+	h.renderPage(w, r, http.StatusOK, clientID(client), "consent.html", map[string]interface{}{
+		"RequestedScopes":  consentRequest.RequestedScope,
+		"ConsentApp":       client.ClientName,
+		"ClientLogo":       client.LogoURI,
+		"ClientPolicy":     client.PolicyURI,
+		"ClientTos":        client.TosURI,
 		"ConsentChallenge": consent_challenge,
 	})
-
-	if err != nil {
-		log.Println("error during templating: ", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err := w.Write([]byte("An expected error occured")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
-	}
 }
 
 func (h *Handler) consentPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "consentPOST")
+	defer span.End()
+
 	formData := struct {
 		ConsentChallenge string `validate:"required"`
 	}{
 		ConsentChallenge: r.FormValue("consent_challenge"),
 	}
+	r = r.WithContext(logging.WithChallenge(r.Context(), formData.ConsentChallenge))
+	logger := logging.FromContext(r.Context())
 
-	//TODO if access denied
-	//h.HydraClient.Admin.RejectConsentRequest()
-
-	consentGETParams := admin.NewGetConsentRequestParamsWithContext(r.Context()).WithHTTPClient(h.httpClient)
-	consentGETParams.SetConsentChallenge(formData.ConsentChallenge)
-	consentGETResp, err := h.HydraClient.Admin.GetConsentRequest(consentGETParams)
+	consentRequest, err := h.Flow.GetConsentRequest(r.Context(), formData.ConsentChallenge)
 	if err != nil {
-		log.Println("error GetConsentRequest", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err := w.Write([]byte("GetConsentRequest failed")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+		logger.Error("GetConsentRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+
+	r = r.WithContext(logging.WithChallenge(r.Context(), consentRequest.LoginChallenge))
+	logger = logging.FromContext(r.Context())
+
+	if r.FormValue("decline") != "" {
+		h.rejectConsent(w, r, formData.ConsentChallenge, consentRequest)
+		return
+	}
+
+	// checked again, the form can be posted without showing the page
+	if h.consentAccessDenied(w, r, formData.ConsentChallenge, consentRequest) {
 		return
 	}
 
-	session, err := h.createSessionWithCustomClaims(consentGETResp)
+	event := consentEvent(consentRequest, audit.EventConsentAccepted)
+
+	session, err := h.createSessionWithCustomClaims(r.Context(), consentRequest)
 
 	if err != nil {
-		log.Println("Error on setting custom claims", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err := w.Write([]byte("Error on setting custom claims")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+		logger.Error("Error on setting custom claims", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
 	//TODO  read and provide granted scopes from the form
-	consentAcceptResp, err := h.acceptConsentRequest(r.Context(), formData.ConsentChallenge, consentGETResp, session)
+	redirectTo, err := h.acceptConsentRequest(r.Context(), formData.ConsentChallenge, consentRequest, session)
 	if err != nil {
-		log.Println("AcceptConsentRequest failed", err.Error())
-		w.WriteHeader(http.StatusBadRequest)
-		if _, err := w.Write([]byte("AcceptConsentRequest failed")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+		logger.Error("AcceptConsentRequest failed", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "accept consent request failed"
+		h.Audit.Emit(r, event)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
 
-	redirectUrl := *consentAcceptResp.GetPayload().RedirectTo
-	if len(strings.TrimSpace(h.alt_redirect_hydra_url)) > 0 {
-		log.Println("use alt redirect url ", h.alt_redirect_hydra_url)
-		matchUrl := h.hydra_public_url
-		if len(strings.TrimSpace(h.issuerUri)) > 0 {
-			matchUrl = h.issuerUri
-		}
-		redirectUrl = strings.Replace(redirectUrl, matchUrl, h.alt_redirect_hydra_url, 1)
-	}
+	redirectUrl := h.rewriteRedirect(r, redirectTo)
 
-	log.Println("after consent redirect to: ", redirectUrl)
+	h.Audit.Emit(r, event)
+	logger.Info("consent accepted", "redirect_to", redirectUrl)
 	http.Redirect(w, r, redirectUrl, http.StatusFound)
 }
 
-func (h *Handler) acceptConsentRequest(ctx context.Context,
-	consentChallenge string,
-	consentGETResp *admin.GetConsentRequestOK,
-	session *models.ConsentRequestSession) (acceptConsentResp *admin.AcceptConsentRequestOK, err error) {
-
-	consentAcceptParams := admin.NewAcceptConsentRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
-	consentAcceptParams.SetConsentChallenge(consentChallenge)
-	consentAcceptParams.SetBody(&models.AcceptConsentRequest{
-		GrantAccessTokenAudience: consentGETResp.GetPayload().RequestedAccessTokenAudience,
-		GrantScope:               consentGETResp.GetPayload().RequestedScope,
-		Session:                  session,
-		Remember:                 true,
+func (h *Handler) rejectConsent(w http.ResponseWriter, r *http.Request, consentChallenge string, consentRequest *flow.ConsentRequest) {
+	logger := logging.FromContext(r.Context())
+	event := consentEvent(consentRequest, audit.EventConsentRejected)
+	event.Reason = "declined by user"
+
+	redirectTo, err := h.Flow.RejectConsentRequest(r.Context(), consentChallenge, flow.Rejection{
+		Error:            "access_denied",
+		ErrorDescription: "The resource owner denied the request",
+		StatusCode:       http.StatusForbidden,
 	})
+	if err != nil {
+		logger.Error("RejectConsentRequest failed", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "reject consent request failed"
+		h.Audit.Emit(r, event)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
 
-	consentAcceptResp, err := h.HydraClient.Admin.AcceptConsentRequest(consentAcceptParams)
+	redirectUrl := h.rewriteRedirect(r, redirectTo)
 
-	if err != nil {
-		return nil, err
+	h.Audit.Emit(r, event)
+	logger.Info("consent rejected", "redirect_to", redirectUrl)
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+func consentEvent(consentRequest *flow.ConsentRequest, eventType audit.EventType) audit.Event {
+	return audit.Event{
+		Type:     eventType,
+		Outcome:  audit.OutcomeSuccess,
+		Subject:  consentRequest.Subject,
+		ClientID: clientID(consentRequest.Client),
+		Scopes:   consentRequest.RequestedScope,
 	}
+}
 
-	return consentAcceptResp, nil
+func (h *Handler) acceptConsentRequest(ctx context.Context,
+	consentChallenge string,
+	consentRequest *flow.ConsentRequest,
+	session *flow.Session) (redirectTo string, err error) {
+
+	remember, rememberFor := h.Remember.Consent(consentRequest.Client, consentRequest.RequestedScope)
+	return h.Flow.AcceptConsentRequest(ctx, consentChallenge, flow.AcceptConsent{
+		GrantAudience: consentRequest.RequestedAudience,
+		GrantScope:    consentRequest.RequestedScope,
+		Session:       session,
+		Remember:      remember,
+		RememberFor:   rememberFor,
+	})
 }
-func (h *Handler) createSessionWithCustomClaims(consentGETResp *admin.GetConsentRequestOK) (session *models.ConsentRequestSession, err error) {
-	user, err := h.UserRepo.GetUserByEmail(consentGETResp.GetPayload().Subject)
+func (h *Handler) createSessionWithCustomClaims(ctx context.Context, consentRequest *flow.ConsentRequest) (session *flow.Session, err error) {
+	user, err := h.getUser(ctx, consentRequest.Subject)
 
 	if err != nil {
 		return nil, err
 	}
 
-	roles := make([]string, 0)
-	if user.Roles != nil {
-		roles = user.Roles
+	roles := h.effectiveRoles(ctx, consentRequest.Subject, user)
+
+	idToken := map[string]interface{}{
+		"groups":         roles,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	}
+	if slices.Contains(consentRequest.RequestedScope, "profile") {
+		addProfileClaims(idToken, user)
 	}
 
-	return &models.ConsentRequestSession{
+	return &flow.Session{
 		AccessToken: map[string]interface{}{
 			"groups": roles,
 		},
-		IDToken: map[string]interface{}{
-			"groups":         roles,
-			"email":          user.Email,
-			"email_verified": true,
-		},
+		IDToken: idToken,
 	}, nil
 }
+
+// addProfileClaims adds the profile attributes the user maintains on the
+// account page.
+func addProfileClaims(claims map[string]interface{}, u *user.User) {
+	if u.GivenName != "" {
+		claims["given_name"] = u.GivenName
+	}
+	if u.FamilyName != "" {
+		claims["family_name"] = u.FamilyName
+	}
+	if name := strings.TrimSpace(u.GivenName + " " + u.FamilyName); name != "" {
+		claims["name"] = name
+	}
+	if u.Locale != "" {
+		claims["locale"] = u.Locale
+	}
+}
@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/i18n"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/mail"
+	"simple-login-endpoint/realm"
+	"simple-login-endpoint/user"
+	"strings"
+	"time"
+)
+
+const (
+	LoginEmailPath       = "/idp/login/email"
+	LoginEmailVerifyPath = "/idp/login/email/verify"
+
+	purposeEmailLogin     = "email_login"
+	purposeEmailLoginLink = "email_login_link"
+)
+
+// emailLoginTicket is sealed into the form for the code. It holds only the
+// fingerprint of the code, the ticket itself can be read by the browser.
+type emailLoginTicket struct {
+	Subject   string `json:"sub"`
+	Challenge string `json:"challenge"`
+	ClientID  string `json:"client_id,omitempty"`
+	Locale    string `json:"locale,omitempty"`
+	Code      string `json:"code"`
+}
+
+// emailLoginLink is sent by mail as magic link. Like the ticket it is bound
+// to the login challenge, so it can not be used once the login is accepted.
+type emailLoginLink struct {
+	Subject   string `json:"sub"`
+	Challenge string `json:"challenge"`
+	Locale    string `json:"locale,omitempty"`
+}
+
+func (h *Handler) HandleLoginEmail(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.loginEmailGet(w, r)
+	case http.MethodPost:
+		h.loginEmailPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleLoginEmailVerify(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.loginEmailLinkGet(w, r)
+	case http.MethodPost:
+		h.loginEmailCodePOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// emailLoginEnabled reports whether login codes can be sent.
+func (h *Handler) emailLoginEnabled() bool {
+	return h.emailLogin && h.Mailer != nil
+}
+
+// emailLoginRequest loads the client of the login challenge and its realm,
+// the email login is only offered within an OAuth login.
+func (h *Handler) emailLoginRequest(w http.ResponseWriter, r *http.Request, challenge string) (*http.Request, string, *realm.Realm, bool) {
+	if !h.emailLoginEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return r, "", nil, false
+	}
+	if challenge == "" {
+		h.showErrorPage(w, r, "error.login_challenge_missing.title", "error.login_challenge_missing.content")
+		return r, "", nil, false
+	}
+
+	r, client, ok := h.challengeClient(w, r, challenge)
+	if !ok {
+		return r, "", nil, false
+	}
+	r, rl, ok := h.requestRealm(w, r, client)
+	return r, clientID(client), rl, ok
+}
+
+func (h *Handler) loginEmailGet(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("login_challenge")
+	r, clientID, _, ok := h.emailLoginRequest(w, r, challenge)
+	if !ok {
+		return
+	}
+
+	h.renderPage(w, r, http.StatusOK, clientID, "login_email.html", map[string]interface{}{
+		"LoginChallenge": challenge,
+	})
+}
+
+// loginEmailPOST shows the code form whether the user exists or not, so the
+// form can not be used to find out registered emails. The rate limit applies
+// to unknown addresses as well.
+func (h *Handler) loginEmailPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "loginEmailPOST")
+	defer span.End()
+
+	challenge := r.FormValue("login_challenge")
+	r, clientID, rl, ok := h.emailLoginRequest(w, r, challenge)
+	if !ok {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+	l := h.localizer(r)
+	email := strings.TrimSpace(r.FormValue("email"))
+	subject := rl.Subject(email)
+
+	event := audit.Event{
+		Type:     audit.EventEmailLoginRequested,
+		Outcome:  audit.OutcomeSuccess,
+		Subject:  subject,
+		ClientID: clientID,
+	}
+
+	if !h.mailSends.Allow(strings.ToLower(email), time.Now()) {
+		logger.Warn("email login rate limited", "username", email)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "rate limited"
+		h.Audit.Emit(r, event)
+		h.renderPage(w, r, http.StatusTooManyRequests, clientID, "login_email.html", map[string]interface{}{
+			"LoginChallenge": challenge,
+			"ErrorTitle":     l.T("login.email.error.title"),
+			"ErrorContent":   l.T("login.email.rate_limited"),
+		})
+		return
+	}
+
+	code, err := emailLoginCode()
+	if err != nil {
+		logger.Error("could not generate email login code", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+
+	ticket := &emailLoginTicket{
+		Subject:   subject,
+		Challenge: challenge,
+		ClientID:  clientID,
+		Locale:    l.Locale(),
+		Code:      h.Sessions.Fingerprint(subject + ":" + code),
+	}
+	sealed, err := h.Sessions.Seal(purposeEmailLogin, ticket, h.emailLoginTTL)
+	if err != nil {
+		logger.Error("could not seal email login ticket", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+
+	if u, err := h.getUser(r.Context(), subject); err != nil {
+		logger.Info("email login for unknown user", "username", subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "unknown user"
+	} else if err := h.sendEmailLogin(r, subject, u.Email, challenge, code); err != nil {
+		logger.Error("could not send email login", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "mail delivery failed"
+	}
+	h.Audit.Emit(r, event)
+
+	h.showEmailLoginCode(w, r, http.StatusOK, ticket, sealed, "")
+}
+
+func (h *Handler) showEmailLoginCode(w http.ResponseWriter, r *http.Request, status int, ticket *emailLoginTicket, sealed string, errorContentKey string) {
+	l := h.localizer(r)
+	data := map[string]interface{}{
+		"LoginChallenge": ticket.Challenge,
+		"Ticket":         sealed,
+	}
+	if errorContentKey != "" {
+		data["ErrorTitle"] = l.T("login.email.error.title")
+		data["ErrorContent"] = l.T(errorContentKey)
+	}
+	h.renderPage(w, r, status, ticket.ClientID, "login_email.html", data)
+}
+
+// emailLoginCode returns a random code of six digits.
+func emailLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// sendEmailLogin sends the code and, if the public URL is known, a magic
+// link.
+func (h *Handler) sendEmailLogin(r *http.Request, subject string, email string, challenge string, code string) error {
+	l := h.localizer(r)
+	minutes := int(h.emailLoginTTL / time.Minute)
+	body := l.T("mail.email_login.body", code, minutes)
+
+	if h.publicURL != "" {
+		token, err := h.Sessions.Seal(purposeEmailLoginLink, &emailLoginLink{
+			Subject:   subject,
+			Challenge: challenge,
+			Locale:    l.Locale(),
+		}, h.emailLoginTTL)
+		if err != nil {
+			return err
+		}
+		// the challenge next to the token only selects the theme if the
+		// token is expired
+		link := h.publicURL + LoginEmailVerifyPath + "?token=" + url.QueryEscape(token) + "&login_challenge=" + url.QueryEscape(challenge)
+		body = l.T("mail.email_login.body_link", code, link, minutes)
+	}
+
+	return h.Mailer.Send(r.Context(), mail.Message{
+		To:      email,
+		Subject: l.T("mail.email_login.subject"),
+		Body:    body,
+	})
+}
+
+func (h *Handler) loginEmailCodePOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "loginEmailCodePOST")
+	defer span.End()
+
+	if !h.emailLoginEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	sealed := r.FormValue("ticket")
+	var ticket emailLoginTicket
+	if err := h.Sessions.Open(purposeEmailLogin, sealed, &ticket); err != nil {
+		logging.FromContext(r.Context()).Info("invalid email login ticket", "error", err)
+		h.showErrorPage(w, r, "login.email.expired.title", "login.email.expired.content")
+		return
+	}
+	if h.Messages.Supports(ticket.Locale) {
+		r = r.WithContext(i18n.WithLocale(r.Context(), ticket.Locale))
+	}
+	r = r.WithContext(logging.WithChallenge(r.Context(), ticket.Challenge))
+	logger := logging.FromContext(r.Context())
+
+	event := audit.Event{
+		Type:    audit.EventLogin,
+		Outcome: audit.OutcomeSuccess,
+		Subject: ticket.Subject,
+	}
+
+	if !h.emailLoginAttempts.Allow(strings.ToLower(ticket.Subject), time.Now()) {
+		logger.Warn("too many email login codes", "username", ticket.Subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "rate limited"
+		h.Audit.Emit(r, event)
+		h.showEmailLoginCode(w, r, http.StatusTooManyRequests, &ticket, sealed, "login.email.rate_limited")
+		return
+	}
+
+	code := h.Sessions.Fingerprint(ticket.Subject + ":" + strings.TrimSpace(r.FormValue("code")))
+	u, err := h.getUser(r.Context(), ticket.Subject)
+	if err != nil || subtle.ConstantTimeCompare([]byte(code), []byte(ticket.Code)) != 1 {
+		logger.Info("invalid email login code", "username", ticket.Subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid code"
+		h.Audit.Emit(r, event)
+		h.showEmailLoginCode(w, r, http.StatusUnauthorized, &ticket, sealed, "login.email.invalid_code")
+		return
+	}
+	h.emailLoginAttempts.Reset(strings.ToLower(ticket.Subject))
+
+	h.completeEmailLogin(w, r, event, u, ticket.Challenge, ticket.ClientID, []string{"otp"})
+}
+
+func (h *Handler) loginEmailLinkGet(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "loginEmailLinkGet")
+	defer span.End()
+
+	if !h.emailLoginEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var link emailLoginLink
+	if err := h.Sessions.Open(purposeEmailLoginLink, r.URL.Query().Get("token"), &link); err != nil {
+		logging.FromContext(r.Context()).Info("invalid email login link", "error", err)
+		h.showEmailLinkExpired(w, r, clientID(h.themeClient(r, r.URL.Query().Get("login_challenge"))))
+		return
+	}
+	if h.Messages.Supports(link.Locale) {
+		r = r.WithContext(i18n.WithLocale(r.Context(), link.Locale))
+	}
+	r = r.WithContext(logging.WithChallenge(r.Context(), link.Challenge))
+	logger := logging.FromContext(r.Context())
+
+	event := audit.Event{
+		Type:    audit.EventLogin,
+		Outcome: audit.OutcomeSuccess,
+		Subject: link.Subject,
+	}
+
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), link.Challenge)
+	if err != nil {
+		logger.Error("GetLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+
+	u, err := h.getUser(r.Context(), link.Subject)
+	if err != nil {
+		logger.Info("user of email login link not found", "username", link.Subject)
+		h.showEmailLinkExpired(w, r, clientID(loginRequest.Client))
+		return
+	}
+
+	h.completeEmailLogin(w, r, event, u, link.Challenge, clientID(loginRequest.Client), []string{"email"})
+}
+
+// themeClient returns the client of the login challenge, or nil if it can
+// not be loaded. The challenge is not verified, so the client may only
+// select the theme.
+func (h *Handler) themeClient(r *http.Request, challenge string) *flow.Client {
+	if challenge == "" {
+		return nil
+	}
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), challenge)
+	if err != nil {
+		return nil
+	}
+	return loginRequest.Client
+}
+
+// showEmailLinkExpired renders the error page of an invalid link with the
+// theme of the client.
+func (h *Handler) showEmailLinkExpired(w http.ResponseWriter, r *http.Request, clientID string) {
+	l := h.localizer(r)
+	h.renderPage(w, r, http.StatusBadRequest, clientID, "error.html", map[string]interface{}{
+		"ErrorTitle":   l.T("login.email.expired.title"),
+		"ErrorContent": l.T("login.email.expired.content"),
+	})
+}
+
+// completeEmailLogin asks for the second factor of the user, if any, before
+// the login is accepted. The email login is not remembered. The code or link
+// proves that the user receives mails to the address, which is marked as
+// verified, unless a registration waits for its own verification link.
+func (h *Handler) completeEmailLogin(w http.ResponseWriter, r *http.Request, event audit.Event, u *user.User, challenge string, clientID string, amr []string) {
+	if !u.EmailVerified && !u.PendingVerification() {
+		_, err := h.modifyUser(event.Subject, func(stored *user.User) error {
+			stored.EmailVerified = true
+			return nil
+		})
+		if err != nil {
+			logging.FromContext(r.Context()).Error("could not verify email", "error", err)
+		}
+	}
+
+	if u.HasSecondFactor() {
+		logging.FromContext(r.Context()).Info("second factor required", "username", u.Email)
+		h.showLoginMFA(w, r, http.StatusOK, u, &mfaTicket{
+			Subject:   event.Subject,
+			Challenge: challenge,
+			ClientID:  clientID,
+			Locale:    h.localizer(r).Locale(),
+			AMR:       amr,
+		}, "")
+		return
+	}
+
+	h.completeLogin(w, r, event, challenge, false, amr)
+}
@@ -3,51 +3,250 @@ package handler
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"simple-login-endpoint/access"
+	"simple-login-endpoint/acr"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/i18n"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/mail"
+	"simple-login-endpoint/mfa"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/ratelimit"
+	"simple-login-endpoint/realm"
+	"simple-login-endpoint/redirect"
+	"simple-login-endpoint/registration"
+	"simple-login-endpoint/remember"
+	"simple-login-endpoint/render"
+	"simple-login-endpoint/session"
+	"simple-login-endpoint/theme"
+	"simple-login-endpoint/tracing"
+	"simple-login-endpoint/trust"
 	"simple-login-endpoint/user"
+	"simple-login-endpoint/view"
 	"strconv"
-	"text/template"
+	"strings"
 	"time"
 
-	hydra "github.com/ory/hydra-client-go/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultContentSecurityPolicy forbids scripts and inline styles on all pages.
+// Pages listing Scripts in their data additionally allow scripts from
+// /idp/static.
+// Images are allowed from https since the consent page shows the logo_uri of
+// the client. form-action is not restricted because the browser would apply
+// it to the redirects to Hydra and the client as well.
+const DefaultContentSecurityPolicy = "default-src 'none'; style-src 'self'; img-src 'self' https: data:; base-uri 'none'; frame-ancestors 'none'"
+
+// RequiredTemplates must be provided by the embedded views or the override
+// directory, otherwise the handler does not start.
+var RequiredTemplates = []string{"login.html", "login_mfa.html", "consent.html", "error.html", "account_login.html",
+	"account.html", "account_totp.html", "account_passkey.html", "account_consents.html", "password_forgot.html",
+	"password_reset.html", "register.html", "login_email.html", "login_select_account.html"}
+
+// RecentActivitySize is the number of events kept per user for the account
+// page.
+const RecentActivitySize = 20
+
+// DefaultPasswordResetTTL is the validity of a password reset link.
+const DefaultPasswordResetTTL = 30 * time.Minute
+
+// Defaults of the email login: the validity of a code or link and the number
+// of mails per address and hour. EmailLoginMaxAttempts limits the wrong codes
+// per address within the validity.
+const (
+	DefaultEmailLoginTTL       = 10 * time.Minute
+	DefaultEmailLoginRateLimit = 5
+	EmailLoginMaxAttempts      = 5
 )
 
 type Handler struct {
-	HydraClient            *hydra.OryHydra
-	UserRepo               user.UserRepository
-	httpClient             *http.Client
-	hydra_public_url       string
-	issuerUri              string
-	alt_redirect_hydra_url string
+	Flow             flow.FlowBackend
+	UserRepo         user.UserRepository
+	GroupRepo        user.GroupRepository
+	Realms           *realm.Registry
+	Audit            *audit.Auditor
+	Views            *render.Renderer
+	Themes           *theme.Registry
+	Messages         *i18n.Bundle
+	Remember         *remember.Policy
+	Trust            *trust.Policy
+	Sessions         *session.Manager
+	Passkeys         *mfa.Passkeys
+	Activity         *audit.RecentSink
+	Mailer           mail.Mailer
+	Registration     *registration.Policy
+	Passwords        *password.Policy
+	Access           *access.Policy
+	ACR              *acr.Levels
+	totpIssuer       string
+	publicURL        string
+	passwordResetTTL time.Duration
+	emailLogin       bool
+	emailLoginTTL    time.Duration
+	// mailSends limits the login codes, reset and verification links sent
+	// to an address.
+	mailSends             *ratelimit.Limiter
+	emailLoginAttempts    *ratelimit.Limiter
+	mfaAttempts           *ratelimit.Limiter
+	httpClient            *http.Client
+	tracer                trace.Tracer
+	redirects             *redirect.Rewriter
+	contentSecurityPolicy string
 }
 
-func NewHandler(hydraClient *hydra.OryHydra, userRepo user.UserRepository) (handler *Handler) {
-	insecureSkipVerify, err := strconv.ParseBool(os.Getenv("SKIP_TLS_VERIFY"))
+// NewHandler configures the handler from env. The password policy, realms
+// and groups only get defaults that load no files, the caller sets the ones
+// loaded together with the users.
+func NewHandler(backend flow.FlowBackend, userRepo user.UserRepository) (handler *Handler) {
+	views := render.Must(render.NewFromEnv(view.Files, RequiredTemplates...))
 
-	if err != nil {
-		insecureSkipVerify = false
+	contentSecurityPolicy, found := os.LookupEnv("CONTENT_SECURITY_POLICY")
+	if !found {
+		contentSecurityPolicy = DefaultContentSecurityPolicy
 	}
 
-	client := &http.Client{
-		Timeout: time.Second * 10,
+	totpIssuer, found := os.LookupEnv("TOTP_ISSUER")
+	if !found {
+		totpIssuer = "IdP"
+	}
+	activity := audit.NewRecentSink(RecentActivitySize)
+
+	emailLogin, _ := strconv.ParseBool(os.Getenv("EMAIL_LOGIN_ENABLED"))
+	emailLoginTTL := envTTL("EMAIL_LOGIN_TTL", DefaultEmailLoginTTL)
+	emailLoginRateLimit := DefaultEmailLoginRateLimit
+	if value, found := os.LookupEnv("EMAIL_LOGIN_RATE_LIMIT"); found {
+		if limit, err := strconv.Atoi(value); err == nil && limit > 0 {
+			emailLoginRateLimit = limit
+		} else {
+			slog.Warn("invalid EMAIL_LOGIN_RATE_LIMIT, using default", "value", value, "default", emailLoginRateLimit)
+		}
+	}
 
-		Transport: &http.Transport{
-			IdleConnTimeout:       time.Second * 5,
-			ResponseHeaderTimeout: time.Second * 3,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: insecureSkipVerify},
-		}}
+	publicURL := strings.TrimSuffix(os.Getenv("IDP_PUBLIC_URL"), "/")
+	mailer := mail.Must(mail.NewFromEnv())
+	if mailer == nil && (publicURL != "" || emailLogin) {
+		slog.Warn("MAIL_TRANSPORT is not set, password reset, registration and email login are disabled")
+	}
 
 	return &Handler{
-		httpClient:             client,
-		HydraClient:            hydraClient,
-		UserRepo:               userRepo,
-		issuerUri:              os.Getenv("ISSUER_URI"),
-		alt_redirect_hydra_url: os.Getenv("ALTERNATIVE_REDIRECT_HYDRA_URL"),
+		httpClient:            flow.NewHTTPClient(),
+		tracer:                tracing.Tracer(),
+		Flow:                  backend,
+		UserRepo:              userRepo,
+		GroupRepo:             user.NewEmptyGroupInMemoryRepo(),
+		Realms:                realm.Must(realm.NewRegistry()),
+		Audit:                 audit.New(activity),
+		Views:                 views,
+		Themes:                theme.Must(theme.Load(os.Getenv("THEME_DIR"), views)),
+		Messages:              i18n.Must(i18n.Load()),
+		Remember:              remember.Must(remember.NewPolicyFromEnv()),
+		Trust:                 trust.NewPolicyFromEnv(),
+		Sessions:              session.Must(session.NewManagerFromEnv()),
+		Passkeys:              mfa.Must(mfa.NewPasskeysFromEnv()),
+		Activity:              activity,
+		Mailer:                mailer,
+		Registration:          registration.NewPolicyFromEnv(),
+		Passwords:             password.Must(password.NewPolicy(password.DefaultMinLength, password.DefaultMinClasses, nil, 0, 0)),
+		Access:                access.Must(access.NewPolicyFromEnv()),
+		ACR:                   acr.Must(acr.NewLevelsFromEnv()),
+		totpIssuer:            totpIssuer,
+		publicURL:             publicURL,
+		passwordResetTTL:      envTTL("PASSWORD_RESET_TTL", DefaultPasswordResetTTL),
+		emailLogin:            emailLogin,
+		emailLoginTTL:         emailLoginTTL,
+		mailSends:             ratelimit.NewLimiter(emailLoginRateLimit, time.Hour),
+		emailLoginAttempts:    ratelimit.NewLimiter(EmailLoginMaxAttempts, emailLoginTTL),
+		mfaAttempts:           ratelimit.NewLimiter(MFAMaxAttempts, mfaTicketTTL),
+		redirects:             redirect.Must(redirect.NewRewriterFromEnv()),
+		contentSecurityPolicy: contentSecurityPolicy,
+	}
+}
+
+// envTTL reads a positive duration, invalid values fall back to the default.
+func envTTL(key string, fallback time.Duration) time.Duration {
+	value, found := os.LookupEnv(key)
+	if !found {
+		return fallback
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		slog.Warn("invalid "+key+", using default", "value", value, "default", fallback.String())
+		return fallback
+	}
+	return ttl
+}
+
+// startSpan starts a span for the given handler step and returns the request
+// carrying the span context, so Hydra calls made with it become child spans.
+func (h *Handler) startSpan(r *http.Request, name string) (*http.Request, trace.Span) {
+	ctx, span := h.tracer.Start(r.Context(), name)
+	return r.WithContext(ctx), span
+}
+
+// getUser returns the user of the subject from the repository of its realm.
+func (h *Handler) getUser(ctx context.Context, subject string) (*user.User, error) {
+	_, span := h.tracer.Start(ctx, "UserRepository.GetUserByEmail")
+	defer span.End()
+
+	rl, email := h.subjectRealm(subject)
+	u, err := rl.Users.GetUserByEmail(email)
+	span.SetAttributes(attribute.Bool("user.found", err == nil))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return u, err
+}
+
+// effectiveRoles returns the roles of the user including those inherited
+// from the groups of its realm.
+func (h *Handler) effectiveRoles(ctx context.Context, subject string, u *user.User) []string {
+	_, span := h.tracer.Start(ctx, "GroupRepository.AllGroups")
+	defer span.End()
+
+	rl, _ := h.subjectRealm(subject)
+	return user.EffectiveRoles(rl.Groups.AllGroups(), u)
+}
+
+// rewriteRedirect applies the redirect rules to a RedirectTo returned by
+// Hydra. Rules may be restricted to the host the request was sent to.
+func (h *Handler) rewriteRedirect(r *http.Request, redirectTo string) string {
+	rewritten := h.redirects.Rewrite(r.Host, redirectTo)
+	if rewritten != redirectTo {
+		logging.FromContext(r.Context()).Debug("redirect rewritten", "from", redirectTo, "to", rewritten)
+	}
+	return rewritten
+}
+
+// withLocale resolves the locale from the ui_locales of the OIDC context and
+// the Accept-Language header and stores it in the request context.
+func (h *Handler) withLocale(r *http.Request, oidcContext *flow.OIDCContext) *http.Request {
+	var uiLocales []string
+	if oidcContext != nil {
+		uiLocales = oidcContext.UILocales
+	}
+
+	locale := h.Messages.Resolve(uiLocales, r.Header.Get("Accept-Language"))
+	return r.WithContext(i18n.WithLocale(r.Context(), locale))
+}
+
+// localizer uses the locale of the request context, falling back to the
+// Accept-Language header.
+func (h *Handler) localizer(r *http.Request) *i18n.Localizer {
+	locale, found := i18n.LocaleFromContext(r.Context())
+	if !found {
+		locale = h.Messages.Resolve(nil, r.Header.Get("Accept-Language"))
 	}
+	return h.Messages.Localizer(locale)
 }
 
 func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
@@ -69,7 +268,7 @@ func (h *Handler) HandleError(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) healthGet(w http.ResponseWriter, r *http.Request) {
-	log.Print("GET health")
+	slog.Debug("GET health")
 	w.WriteHeader(http.StatusOK)
 	resp := make(map[string]string)
 	resp["status"] = "OK"
@@ -84,23 +283,86 @@ func (h *Handler) healthGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) errorGet(w http.ResponseWriter, r *http.Request) {
-	log.Print("GET error")
 	error_title := r.URL.Query().Get("error")
 	error_description := r.URL.Query().Get("error_description")
+	logging.FromContext(r.Context()).Info("GET error", "error", error_title, "error_description", error_description)
 
-	tmpl := template.Must(template.ParseFiles("view/error.html"))
-
-	err := tmpl.Execute(w, map[string]interface{}{
+	h.renderPage(w, r, http.StatusOK, "", "error.html", map[string]interface{}{
 		"ErrorTitle":   error_title,
 		"ErrorContent": error_description,
 	})
-	if err != nil {
-		log.Println("error during templating: ", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err := w.Write([]byte("An expected error occured")); err != nil {
-			panic("unexpected error:" + err.Error())
+}
+
+// renderPage renders the page with the theme of the given client, else the
+// theme of the realm. All pages go through the html/template based renderer,
+// so values coming from query parameters or Hydra are escaped according to
+// their context. The page is rendered into a buffer first, so a failing
+// template does not leave a half written page behind.
+func (h *Handler) renderPage(w http.ResponseWriter, r *http.Request, status int, clientID string, name string, data map[string]interface{}) {
+	theme, found := h.Themes.Lookup(clientID)
+	if !found {
+		theme = h.Themes.ForClient(h.realmTheme(r))
+	}
+	views := h.Views
+	if theme.Views() != nil {
+		views = theme.Views()
+	}
+	data["Theme"] = theme
+	data["L"] = h.localizer(r)
+
+	var buf bytes.Buffer
+	if err := views.Render(&buf, name, data); err != nil {
+		logging.FromContext(r.Context()).Error("error during templating", "template", name, "error", err)
+		l := h.localizer(r)
+		if name != "error.html" {
+			h.renderPage(w, r, http.StatusInternalServerError, "", "error.html", map[string]interface{}{
+				"ErrorTitle":   l.T("error.flow_start.title"),
+				"ErrorContent": l.T("error.retry"),
+			})
+			return
+		}
+		// the error page itself failed, so only the message is left
+		http.Error(w, l.T("error.flow_start.title")+". "+l.T("error.retry"), http.StatusInternalServerError)
+		return
+	}
+
+	contentSecurityPolicy := h.contentSecurityPolicy
+	if scripts, _ := data["Scripts"].([]string); len(scripts) > 0 {
+		contentSecurityPolicy = allowOwnScripts(contentSecurityPolicy)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		panic("unexpected error:" + err.Error())
+	}
+}
+
+// allowOwnScripts adds script-src 'self' to the policy, unless the policy
+// already has a script-src directive of its own.
+func allowOwnScripts(policy string) string {
+	for _, directive := range strings.Split(policy, ";") {
+		if name, _, _ := strings.Cut(strings.TrimSpace(directive), " "); strings.EqualFold(name, "script-src") {
+			return policy
 		}
 	}
+	if strings.TrimSpace(policy) == "" {
+		return "script-src 'self'"
+	}
+	return policy + "; script-src 'self'"
+}
+
+func (h *Handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.logoutGet(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
 }
 
 func (h *Handler) HandleConsent(w http.ResponseWriter, r *http.Request) {
@@ -126,23 +388,31 @@ func (h *Handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) RegisterClients(ctx context.Context, clientsJsonRaw []byte) {
-	log.Println("importing clients...")
+	slog.Info("importing clients")
 	timeout := time.Duration(60 * time.Second)
 	ctxWithTimeOut, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	ch := make(chan bool)
+	ch := make(chan bool, 1)
 
 	go h.waitForHydraIsHealthy(ctxWithTimeOut, ch)
 
 	select {
 	case <-ctxWithTimeOut.Done():
-		log.Printf("Hydra not responded after %s", timeout.String())
+		if ctx.Err() != nil {
+			slog.Info("client registration cancelled")
+			return
+		}
+		slog.Warn("Hydra not responded", "timeout", timeout.String())
 	case healthy := <-ch:
-		log.Println("Hydra is healthy: ", healthy)
+		slog.Info("Hydra health checked", "healthy", healthy)
 
 		if healthy {
-			h.parseClientFile(clientsJsonRaw, h.postNewClient)
+			h.parseClientFile(clientsJsonRaw, func(jsonContent []byte) {
+				if err := h.Flow.CreateClient(ctx, jsonContent); err != nil {
+					slog.Warn("client is not created", "error", err)
+				}
+			})
 		}
 	}
 }
@@ -156,61 +426,57 @@ func (h *Handler) parseClientFile(jsonContent []byte, proceed func([]byte)) {
 	} else {
 		var results []map[string]interface{}
 		if err := json.Unmarshal([]byte(jsonContent), &results); err != nil {
-			log.Println("error on json unmarshaling", err.Error())
+			slog.Error("error on json unmarshaling", "error", err)
 			return
 		}
 
 		for _, result := range results {
 			jsonContent, err := json.Marshal(result)
 			if err == nil {
-				log.Println("post a new client to hydra")
+				slog.Info("post a new client to hydra", "client_id", result["client_id"])
 				proceed(jsonContent)
 			}
 		}
 	}
 }
-func (h *Handler) postNewClient(jsonContent []byte) {
-	req, _ := http.NewRequest(http.MethodPost, os.Getenv("HYDRA_ADMIN_URL")+"/clients", bytes.NewBuffer(jsonContent))
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := h.httpClient.Do(req)
-	if err != nil {
-		log.Println("Error on posting new client to hydra: ", err.Error())
-		return
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusCreated {
-		log.Println("client is not created, response code: " + resp.Status)
-	}
-}
 
 func (h *Handler) waitForHydraIsHealthy(cont context.Context, ch chan bool) {
 	hydra_public_url, found := os.LookupEnv("HYDRA_PUBLIC_URL")
 	if !found {
-		log.Fatal("HYDRA_PUBLIC_URL is not set")
+		slog.Error("HYDRA_PUBLIC_URL is not set")
+		os.Exit(1)
 	}
 
-	h.hydra_public_url = hydra_public_url
-
 	for i := 0; i < 100; i++ {
 		select {
 		case <-cont.Done():
-			log.Println("TIME OUT")
+			slog.Warn("waiting for Hydra timed out")
 			return
 		default:
-			_, err := h.httpClient.Get(hydra_public_url + "/health/ready")
+			req, _ := http.NewRequestWithContext(cont, http.MethodGet, hydra_public_url+"/health/ready", nil)
+			resp, err := h.httpClient.Do(req)
 
 			if err == nil {
+				resp.Body.Close()
 				ch <- true
 				return
 			}
-			log.Printf("#%d failed due to: %s ", i, err.Error())
+			slog.Debug("Hydra is not ready", "attempt", i, "error", err)
 
-			time.Sleep(1 * time.Second)
+			select {
+			case <-cont.Done():
+				return
+			case <-time.After(1 * time.Second):
+			}
 		}
 	}
 
 	ch <- false
 }
+
+func clientID(client *flow.Client) string {
+	if client == nil {
+		return ""
+	}
+	return client.ClientID
+}
@@ -1,10 +1,30 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/hydratest"
+	"simple-login-endpoint/mail"
+	"simple-login-endpoint/mfa"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/realm"
+	"simple-login-endpoint/theme"
+	"simple-login-endpoint/user"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ory/hydra-client-go/models"
 )
 
 func TestImportClients(t *testing.T) {
@@ -30,12 +50,19 @@ func TestImportClients(t *testing.T) {
 
 	handler.parseClientFile([]byte(jsonContent), func(content []byte) {
 		log.Println(string(content))
-		if err := json.Unmarshal([]byte(content), &results); err != nil {
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(content), &result); err != nil {
 			t.FailNow()
 		}
+		results = append(results, result)
 	})
 
 	//then
+	if len(results) != 2 {
+		log.Println("unexpected clients amount:", len(results))
+		t.FailNow()
+	}
+
 	for _, result := range results {
 		clientid := result["client_id"]
 		secret := result["client_secret"]
@@ -49,3 +76,1768 @@ func TestImportClients(t *testing.T) {
 		}
 	}
 }
+
+const xssPayload = `<script>alert("xss")</script>`
+
+func assertEscaped(t *testing.T, rr *httptest.ResponseRecorder) {
+	body := rr.Body.String()
+	if strings.Contains(body, xssPayload) {
+		log.Println("payload rendered unescaped:", body)
+		t.FailNow()
+	}
+
+	if !strings.Contains(body, "&lt;script&gt;") {
+		log.Println("payload not rendered:", body)
+		t.FailNow()
+	}
+
+	csp := rr.Header().Get("Content-Security-Policy")
+	if !strings.Contains(csp, "default-src 'none'") || strings.Contains(csp, "unsafe-inline") {
+		log.Println("unexpected Content-Security-Policy:", csp)
+		t.FailNow()
+	}
+}
+
+func TestAllowOwnScriptsKeepsConfiguredScriptSrc(t *testing.T) {
+	//given
+	policies := map[string]string{
+		"default-src 'none'":                              "default-src 'none'; script-src 'self'",
+		"default-src 'none'; script-src https://cdn.test": "default-src 'none'; script-src https://cdn.test",
+		"default-src 'none';Script-Src 'self';":           "default-src 'none';Script-Src 'self';",
+		"":                                                "script-src 'self'",
+	}
+
+	for policy, expected := range policies {
+		//when
+		result := allowOwnScripts(policy)
+
+		//then
+		if result != expected {
+			log.Println("unexpected policy for", policy+":", result)
+			t.Fail()
+		}
+	}
+}
+
+func TestErrorPageEscapesQueryParameters(t *testing.T) {
+	//given
+	handler := NewHandler(nil, nil)
+	query := url.Values{
+		"error":             {xssPayload},
+		"error_description": {xssPayload},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/idp/error?"+query.Encode(), nil)
+	rr := httptest.NewRecorder()
+
+	//when
+	handler.HandleError(rr, req)
+
+	//then
+	assertEscaped(t, rr)
+}
+
+func TestConsentPageEscapesClientName(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{
+		ClientID:   "evil",
+		ClientName: xssPayload,
+		LogoURI:    "javascript:alert(1)",
+	})
+	challenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{
+		ClientID: "evil",
+		Subject:  "user",
+		Scopes:   []string{"openid", xssPayload},
+	})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+
+	req := httptest.NewRequest(http.MethodGet, "/idp/consent?consent_challenge="+challenge, nil)
+	rr := httptest.NewRecorder()
+
+	//when
+	handler.HandleConsent(rr, req)
+
+	//then
+	if rr.Code != http.StatusOK {
+		log.Println("unexpected status:", rr.Code, rr.Body.String())
+		t.FailNow()
+	}
+
+	assertEscaped(t, rr)
+
+	if strings.Contains(rr.Body.String(), "javascript:alert") {
+		log.Println("unsafe logo_uri rendered")
+		t.FailNow()
+	}
+}
+
+func TestLoginAndConsentFlow(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "app", ClientName: "My App"})
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{
+		ClientID: "app",
+		Scopes:   []string{"openid", "email"},
+	})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user@example.com", Password: "secret", Roles: []string{"admin"}}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+
+	//when
+	rr := httptest.NewRecorder()
+	handler.HandleLogin(rr, httptest.NewRequest(http.MethodGet, "/idp/login?login_challenge="+loginChallenge, nil))
+
+	//then
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), loginChallenge) {
+		log.Println("unexpected login page:", rr.Code, rr.Body.String())
+		t.FailNow()
+	}
+
+	//when
+	form := url.Values{
+		"login_challenge": {loginChallenge},
+		"username":        {"user@example.com"},
+		"password":        {"secret"},
+		"remember":        {"on"},
+	}
+	req := httptest.NewRequest(http.MethodPost, "/idp/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.HandleLogin(rr, req)
+
+	//then
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != fakeHydra.RedirectURL(loginChallenge) {
+		log.Println("unexpected login response:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+
+	accepted, found := fakeHydra.AcceptedLogin(loginChallenge)
+	if !found || *accepted.Subject != "user@example.com" || !accepted.Remember {
+		log.Println("login not accepted as expected:", accepted)
+		t.FailNow()
+	}
+
+	//given
+	consentChallenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge})
+
+	//when
+	rr = httptest.NewRecorder()
+	handler.HandleConsent(rr, httptest.NewRequest(http.MethodGet, "/idp/consent?consent_challenge="+consentChallenge, nil))
+
+	//then
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "My App") {
+		log.Println("unexpected consent page:", rr.Code, rr.Body.String())
+		t.FailNow()
+	}
+
+	//when
+	form = url.Values{"consent_challenge": {consentChallenge}, "accept": {"true"}}
+	req = httptest.NewRequest(http.MethodPost, "/idp/consent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	handler.HandleConsent(rr, req)
+
+	//then
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != fakeHydra.RedirectURL(consentChallenge) {
+		log.Println("unexpected consent response:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+
+	consent, found := fakeHydra.AcceptedConsent(consentChallenge)
+	if !found || strings.Join(consent.GrantScope, " ") != "openid email" {
+		log.Println("consent not accepted as expected:", consent)
+		t.FailNow()
+	}
+
+	claims, _ := consent.Session.IDToken.(map[string]interface{})
+	if claims["email"] != "user@example.com" {
+		log.Println("unexpected id token claims:", consent.Session.IDToken)
+		t.FailNow()
+	}
+}
+
+func TestFailedLoginKeepsThemeOfLoginRequest(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	dir := t.TempDir()
+	for name, title := range map[string]string{"app": "App Theme", "other": "Other Theme"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, theme.ConfigFile), []byte(`{"title": "`+title+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), user.NewEmptyUserInMemoryRepo())
+	handler.Themes = theme.Must(theme.Load(dir, handler.Views))
+	challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+
+	//when
+	rr := postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"wrong"}, "client_id": {"other"}}, nil)
+
+	//then
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), "App Theme") || strings.Contains(rr.Body.String(), "Other Theme") {
+		log.Println("theme not taken from login request:", rr.Code, rr.Body.String())
+		t.Fail()
+	}
+}
+
+func TestConsentDeclineRejectsRequest(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	challenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{ClientID: "app", Subject: "user", Scopes: []string{"openid"}})
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), user.NewEmptyUserInMemoryRepo())
+
+	form := url.Values{"consent_challenge": {challenge}, "decline": {"true"}}
+	req := httptest.NewRequest(http.MethodPost, "/idp/consent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	//when
+	handler.HandleConsent(rr, req)
+
+	//then
+	rejected, found := fakeHydra.Rejected(challenge)
+	if !found || rejected.Error != "access_denied" {
+		log.Println("consent not rejected:", rejected)
+		t.FailNow()
+	}
+
+	if _, found := fakeHydra.AcceptedConsent(challenge); found {
+		log.Println("consent must not be accepted")
+		t.FailNow()
+	}
+}
+
+func TestRememberPolicyIsAppliedToLoginAndConsent(t *testing.T) {
+	//given
+	t.Setenv("SENSITIVE_SCOPES", "offline_access")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{
+		ClientID: "app",
+		Metadata: map[string]interface{}{"login_remember_for": "1h"},
+	})
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Scopes: []string{"openid", "offline_access"}})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+
+	form := url.Values{"login_challenge": {loginChallenge}, "username": {"user"}, "password": {"user"}, "remember": {"on"}}
+	req := httptest.NewRequest(http.MethodPost, "/idp/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	//when
+	handler.HandleLogin(httptest.NewRecorder(), req)
+
+	//then
+	accepted, found := fakeHydra.AcceptedLogin(loginChallenge)
+	if !found || accepted.RememberFor != 3600 {
+		log.Println("unexpected login remember_for:", accepted)
+		t.FailNow()
+	}
+
+	//given
+	consentChallenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge})
+	form = url.Values{"consent_challenge": {consentChallenge}}
+	req = httptest.NewRequest(http.MethodPost, "/idp/consent", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	//when
+	handler.HandleConsent(httptest.NewRecorder(), req)
+
+	//then
+	consent, found := fakeHydra.AcceptedConsent(consentChallenge)
+	if !found || consent.Remember {
+		log.Println("consent with sensitive scope must not be remembered:", consent)
+		t.FailNow()
+	}
+}
+
+func TestConsentIsSkippedForTrustedClient(t *testing.T) {
+	//given
+	t.Setenv("TRUSTED_CLIENTS", "intranet")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "app", Metadata: map[string]interface{}{"first_party": true}})
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "partner"})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var events bytes.Buffer
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	handler.Audit = audit.New(audit.NewWriterSink(&events))
+
+	for clientID, trusted := range map[string]bool{"app": true, "intranet": true, "partner": false} {
+		challenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{ClientID: clientID, Subject: "user", Scopes: []string{"openid"}})
+		rr := httptest.NewRecorder()
+
+		//when
+		handler.HandleConsent(rr, httptest.NewRequest(http.MethodGet, "/idp/consent?consent_challenge="+challenge, nil))
+
+		//then
+		_, accepted := fakeHydra.AcceptedConsent(challenge)
+		if accepted != trusted {
+			log.Println("unexpected consent handling for", clientID, rr.Code)
+			t.FailNow()
+		}
+	}
+
+	if strings.Count(events.String(), `"reason":"trusted client"`) != 2 {
+		log.Println("expected audit events for trusted clients:", events.String())
+		t.FailNow()
+	}
+}
+
+func TestClientRequiredRolesAreChecked(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{
+		ClientID:   "admin-ui",
+		ClientName: "Admin UI",
+		Metadata:   map[string]interface{}{"required_roles": []interface{}{"admin"}},
+	})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	for _, u := range []*user.User{
+		{Email: "user", Password: "secret", Roles: []string{"user"}},
+		{Email: "admin", Password: "secret", Roles: []string{"user", "admin"}},
+	} {
+		if err := repo.AddUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var events bytes.Buffer
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	handler.Audit = audit.New(audit.NewWriterSink(&events))
+
+	for email, allowed := range map[string]bool{"user": false, "admin": true} {
+		challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "admin-ui", Scopes: []string{"openid"}})
+		form := url.Values{"login_challenge": {challenge}, "username": {email}, "password": {"secret"}, "remember": {"on"}}
+
+		//when
+		rr := postForm(handler.HandleLogin, "/idp/login", form, nil)
+
+		//then
+		_, accepted := fakeHydra.AcceptedLogin(challenge)
+		rejected, found := fakeHydra.Rejected(challenge)
+		if accepted != allowed || found == allowed || (found && rejected.Error != "access_denied") {
+			log.Println("unexpected login handling for", email, rr.Code, rejected)
+			t.FailNow()
+		}
+
+		if !allowed && (rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "Admin UI") ||
+			!strings.Contains(rr.Body.String(), fakeHydra.RedirectURL(challenge))) {
+			log.Println("unexpected access denied page:", rr.Code, rr.Body.String())
+			t.FailNow()
+		}
+	}
+
+	//given
+	challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "admin-ui", Skip: true, Subject: "user"})
+
+	//when
+	rr := getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, nil)
+
+	//then
+	if _, found := fakeHydra.Rejected(challenge); !found || rr.Code != http.StatusForbidden {
+		log.Println("remembered login not rejected:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewConsentRequest(hydratest.ConsentOptions{ClientID: "admin-ui", Subject: "user", Scopes: []string{"openid"}, Skip: true})
+
+	//when
+	rr = getWithCookies(handler.HandleConsent, "/idp/consent?consent_challenge="+challenge, nil)
+
+	//then
+	if _, found := fakeHydra.Rejected(challenge); !found || rr.Code != http.StatusForbidden {
+		log.Println("consent not rejected:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewConsentRequest(hydratest.ConsentOptions{ClientID: "admin-ui", Subject: "user", Scopes: []string{"openid"}})
+
+	//when
+	rr = postForm(handler.HandleConsent, "/idp/consent", url.Values{"consent_challenge": {challenge}, "submit": {"Allow access"}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedConsent(challenge); accepted || rr.Code != http.StatusForbidden {
+		log.Println("posted consent not rejected:", rr.Code)
+		t.FailNow()
+	}
+
+	if strings.Count(events.String(), `"type":"access_denied"`) != 4 {
+		log.Println("expected audit events for denied access:", events.String())
+		t.Fail()
+	}
+}
+
+func TestGroupsClaimContainsInheritedRoles(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{
+		ClientID: "admin-ui",
+		Metadata: map[string]interface{}{"required_roles": "admin"},
+	})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "secret", Roles: []string{"user"}}); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := user.NewGroupInMemoryRepo([]*user.Group{
+		{Name: "staff", Roles: []string{"staff"}, Groups: []string{"admins"}},
+		{Name: "admins", Roles: []string{"admin"}, Members: []string{"user"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	handler.GroupRepo = groups
+
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "admin-ui", Scopes: []string{"openid"}})
+	form := url.Values{"login_challenge": {loginChallenge}, "username": {"user"}, "password": {"secret"}, "remember": {"on"}}
+
+	//when
+	postForm(handler.HandleLogin, "/idp/login", form, nil)
+
+	//then
+	if _, found := fakeHydra.AcceptedLogin(loginChallenge); !found {
+		log.Println("role of group not considered for access")
+		t.FailNow()
+	}
+
+	//given
+	consentChallenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge})
+
+	//when
+	postForm(handler.HandleConsent, "/idp/consent", url.Values{"consent_challenge": {consentChallenge}}, nil)
+
+	//then
+	consent, found := fakeHydra.AcceptedConsent(consentChallenge)
+	if !found {
+		log.Println("consent not accepted")
+		t.FailNow()
+	}
+	claims, _ := consent.Session.IDToken.(map[string]interface{})
+	if groupsClaim, _ := claims["groups"].([]interface{}); len(groupsClaim) != 3 || groupsClaim[1] != "admin" || groupsClaim[2] != "staff" {
+		log.Println("unexpected groups claim:", claims["groups"])
+		t.Fail()
+	}
+}
+
+func TestRealmsSeparateUsers(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "shop-web", Metadata: map[string]interface{}{"realm": "shop"}})
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "intranet"})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "anna@example.com", Password: "intranet secret"}); err != nil {
+		t.Fatal(err)
+	}
+	shopUsers := user.NewEmptyUserInMemoryRepo()
+	if err := shopUsers.AddUser(&user.User{Email: "anna@example.com", Password: "shop secret"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	handler.Realms = realm.Must(realm.NewRegistry(&realm.Realm{
+		Name:      "shop",
+		Hosts:     []string{"login.shop.example"},
+		Users:     shopUsers,
+		Groups:    user.NewEmptyGroupInMemoryRepo(),
+		Passwords: handler.Passwords,
+	}))
+
+	cases := []struct {
+		clientID string
+		password string
+		subject  string
+	}{
+		{"shop-web", "shop secret", "shop:anna@example.com"},
+		{"shop-web", "intranet secret", ""},
+		{"intranet", "intranet secret", "anna@example.com"},
+		{"intranet", "shop secret", ""},
+	}
+
+	for _, c := range cases {
+		challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: c.clientID, Scopes: []string{"openid"}})
+		form := url.Values{"login_challenge": {challenge}, "username": {"anna@example.com"}, "password": {c.password}, "remember": {"on"}}
+
+		//when
+		rr := postForm(handler.HandleLogin, "/idp/login", form, nil)
+
+		//then
+		accepted, found := fakeHydra.AcceptedLogin(challenge)
+		if found != (c.subject != "") || (found && *accepted.Subject != c.subject) {
+			log.Println("unexpected login to", c.clientID, "with", c.password, rr.Code, accepted)
+			t.FailNow()
+		}
+	}
+
+	//given
+	challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "intranet", Skip: true, Subject: "shop:anna@example.com"})
+
+	//when
+	rr := getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, nil)
+
+	//then
+	if _, found := fakeHydra.Rejected(challenge); !found || rr.Code != http.StatusForbidden {
+		log.Println("subject of another realm not rejected:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "intranet", Scopes: []string{"openid"}})
+	form := url.Values{"login_challenge": {challenge}, "username": {"anna@example.com"}, "password": {"shop secret"}, "remember": {"on"}}
+	req := httptest.NewRequest(http.MethodPost, "http://login.shop.example/idp/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	//when
+	handler.HandleLogin(httptest.NewRecorder(), req)
+
+	//then
+	if accepted, found := fakeHydra.AcceptedLogin(challenge); !found || *accepted.Subject != "shop:anna@example.com" {
+		log.Println("realm of host not used:", accepted)
+		t.Fail()
+	}
+}
+
+func postForm(handle http.HandlerFunc, path string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handle(rr, req)
+	return rr
+}
+
+func getWithCookies(handle http.HandlerFunc, path string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rr := httptest.NewRecorder()
+	handle(rr, req)
+	return rr
+}
+
+var csrfPattern = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+func TestAccountConsentsRequireLogin(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), user.NewEmptyUserInMemoryRepo())
+
+	//when
+	rr := getWithCookies(handler.HandleAccountConsents, AccountConsentsPath, nil)
+
+	//then
+	if rr.Code != http.StatusSeeOther || !strings.HasPrefix(rr.Header().Get("Location"), AccountLoginPath+"?next=") {
+		log.Println("unexpected response:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+}
+
+func TestAccountConsentsListAndRevoke(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "app", ClientName: "My App"})
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "other", ClientName: "Other App"})
+	appConsent := fakeHydra.AddConsentSession("user", "app", "openid", "email")
+	otherConsent := fakeHydra.AddConsentSession("user", "other", "openid")
+	foreignConsent := fakeHydra.AddConsentSession("someone-else", "app", "openid")
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+
+	//when
+	rr := postForm(handler.HandleAccountLogin, AccountLoginPath, url.Values{"username": {"user"}, "password": {"wrong"}}, nil)
+
+	//then
+	if rr.Code != http.StatusUnauthorized || len(rr.Result().Cookies()) != 0 {
+		log.Println("login with wrong password:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountLogin, AccountLoginPath, url.Values{"username": {"user"}, "password": {"user"}, "next": {"https://evil.example.com"}}, nil)
+	cookies := rr.Result().Cookies()
+
+	//then
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != AccountPath || len(cookies) != 1 {
+		log.Println("unexpected account login response:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+
+	//when
+	rr = getWithCookies(handler.HandleAccountConsents, AccountConsentsPath, cookies)
+
+	//then
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || !strings.Contains(body, "My App") || !strings.Contains(body, "Other App") {
+		log.Println("unexpected consents page:", rr.Code, body)
+		t.FailNow()
+	}
+	match := csrfPattern.FindStringSubmatch(body)
+	if match == nil {
+		log.Println("csrf token missing")
+		t.FailNow()
+	}
+	csrfToken := match[1]
+
+	//when
+	rr = postForm(handler.HandleAccountConsents, AccountConsentsPath, url.Values{"client_id": {"app"}, "csrf_token": {"forged"}}, cookies)
+
+	//then
+	if rr.Code != http.StatusForbidden || fakeHydra.ConsentRevoked(appConsent) {
+		log.Println("revoke without valid csrf token:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountConsents, AccountConsentsPath, url.Values{"client_id": {"app"}, "csrf_token": {csrfToken}}, cookies)
+
+	//then
+	if rr.Code != http.StatusSeeOther || !fakeHydra.ConsentRevoked(appConsent) || fakeHydra.ConsentRevoked(otherConsent) {
+		log.Println("consent of app not revoked:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountConsents, AccountConsentsPath, url.Values{"revoke_all": {"true"}, "csrf_token": {csrfToken}}, cookies)
+
+	//then
+	if rr.Code != http.StatusSeeOther || !fakeHydra.ConsentRevoked(otherConsent) || fakeHydra.ConsentRevoked(foreignConsent) {
+		log.Println("consents not revoked:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	laterConsent := fakeHydra.AddConsentSession("user", "app", "openid")
+	if err := repo.DeleteUserByEmail("user"); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountConsents, AccountConsentsPath, url.Values{"revoke_all": {"true"}, "csrf_token": {csrfToken}}, cookies)
+
+	//then
+	if ended := rr.Result().Cookies(); rr.Code != http.StatusSeeOther || !strings.HasPrefix(rr.Header().Get("Location"), AccountLoginPath) ||
+		fakeHydra.ConsentRevoked(laterConsent) || len(ended) != 1 || ended[0].MaxAge >= 0 {
+		log.Println("session of removed user still valid:", rr.Code, rr.Header().Get("Location"))
+		t.Fail()
+	}
+}
+
+var ticketPattern = regexp.MustCompile(`name="ticket" value="([^"]+)"`)
+
+// accountLogin signs the user in to the account pages and returns the
+// session cookies and the CSRF token.
+func accountLogin(t *testing.T, handler *Handler, email string, password string) ([]*http.Cookie, string) {
+	rr := postForm(handler.HandleAccountLogin, AccountLoginPath, url.Values{"username": {email}, "password": {password}}, nil)
+	cookies := rr.Result().Cookies()
+	if rr.Code != http.StatusSeeOther || len(cookies) != 1 {
+		log.Println("account login failed:", rr.Code)
+		t.FailNow()
+	}
+
+	rr = getWithCookies(handler.HandleAccount, AccountPath, cookies)
+	match := csrfPattern.FindStringSubmatch(rr.Body.String())
+	if rr.Code != http.StatusOK || match == nil {
+		log.Println("account page not shown:", rr.Code)
+		t.FailNow()
+	}
+	return cookies, match[1]
+}
+
+func TestAccountPasswordChangeRequiresCurrentPassword(t *testing.T) {
+	//given
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(nil, repo)
+	cookies, csrf := accountLogin(t, handler, "user", "user")
+
+	//when
+	rr := postForm(handler.HandleAccountPassword, AccountPasswordPath, url.Values{
+		"csrf_token": {csrf}, "current_password": {"wrong"}, "new_password": {"secret"}, "new_password_confirm": {"secret"},
+	}, cookies)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user"); rr.Code != http.StatusUnauthorized || !u.PasswordMatches("user") {
+		log.Println("password changed without current password:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountPassword, AccountPasswordPath, url.Values{
+		"csrf_token": {csrf}, "current_password": {"user"}, "new_password": {"secret"}, "new_password_confirm": {"secret"},
+	}, cookies)
+
+	//then
+	l := handler.Messages.Localizer(handler.Messages.Resolve(nil, ""))
+	if u, _ := repo.GetUserByEmail("user"); rr.Code != http.StatusBadRequest || !u.PasswordMatches("user") ||
+		!strings.Contains(rr.Body.String(), l.T("password.policy.min_length", handler.Passwords.MinLength)) {
+		log.Println("password policy not applied:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountPassword, AccountPasswordPath, url.Values{
+		"csrf_token": {csrf}, "current_password": {"user"}, "new_password": {"new secret"}, "new_password_confirm": {"new secret"},
+	}, cookies)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user"); rr.Code != http.StatusSeeOther || !u.PasswordMatches("new secret") {
+		log.Println("password not changed:", rr.Code, rr.Body.String())
+		t.FailNow()
+	}
+	location, renewed := rr.Header().Get("Location"), rr.Result().Cookies()
+
+	//when
+	rr = getWithCookies(handler.HandleAccount, location, cookies)
+
+	//then
+	if rr.Code != http.StatusSeeOther || !strings.HasPrefix(rr.Header().Get("Location"), AccountLoginPath) {
+		log.Println("session of the old password still valid:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = getWithCookies(handler.HandleAccount, location, renewed)
+
+	//then
+	body := rr.Body.String()
+	if !strings.Contains(body, l.T("account.status.password_changed")) || !strings.Contains(body, l.T("account.activity.account_login")) {
+		log.Println("confirmation or login activity missing:", body)
+		t.Fail()
+	}
+}
+
+func TestAccountProfileIsAddedToIDToken(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	cookies, csrf := accountLogin(t, handler, "user", "user")
+
+	//when
+	rr := postForm(handler.HandleAccountProfile, AccountProfilePath, url.Values{
+		"csrf_token": {csrf}, "given_name": {" Ada "}, "family_name": {"Lovelace"}, "locale": {"en"},
+	}, cookies)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user"); rr.Code != http.StatusSeeOther || u.GivenName != "Ada" || u.Locale != "en" {
+		log.Println("profile not saved:", rr.Code, u)
+		t.FailNow()
+	}
+
+	//given
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Scopes: []string{"openid", "profile"}})
+	postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"user"}, "password": {"user"}}, nil)
+	consentChallenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge})
+
+	//when
+	postForm(handler.HandleConsent, "/idp/consent", url.Values{"consent_challenge": {consentChallenge}, "submit": {"Allow access"}}, nil)
+
+	//then
+	accepted, found := fakeHydra.AcceptedConsent(consentChallenge)
+	if !found {
+		log.Println("consent not accepted")
+		t.FailNow()
+	}
+	claims, _ := accepted.Session.IDToken.(map[string]interface{})
+	if claims["name"] != "Ada Lovelace" || claims["locale"] != "en" {
+		log.Println("unexpected id token claims:", claims)
+		t.Fail()
+	}
+}
+
+func TestTOTPEnrollmentAndLogin(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	cookies, csrf := accountLogin(t, handler, "user", "user")
+
+	rr := getWithCookies(handler.HandleAccountTOTP, AccountTOTPPath, cookies)
+	secret := regexp.MustCompile(`<p class="secret">([A-Z2-7]+)</p>`).FindStringSubmatch(rr.Body.String())
+	ticket := ticketPattern.FindStringSubmatch(rr.Body.String())
+	if secret == nil || ticket == nil {
+		log.Println("totp enrollment not shown:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleAccountTOTP, AccountTOTPPath, url.Values{"csrf_token": {csrf}, "ticket": {ticket[1]}, "code": {"000000"}}, cookies)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user"); rr.Code != http.StatusBadRequest || u.TOTPSecret != "" {
+		log.Println("totp enabled with wrong code:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	code, _ := mfa.TOTPCode(secret[1], time.Now())
+	rr = postForm(handler.HandleAccountTOTP, AccountTOTPPath, url.Values{"csrf_token": {csrf}, "ticket": {ticket[1]}, "code": {code}}, cookies)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user"); rr.Code != http.StatusSeeOther || u.TOTPSecret != secret[1] {
+		log.Println("totp not enabled:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"user"}, "password": {"user"}}, nil)
+
+	//then
+	ticket = ticketPattern.FindStringSubmatch(rr.Body.String())
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusOK || ticket == nil || accepted {
+		log.Println("second factor not requested:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket[1]}, "code": {"000000"}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusUnauthorized || accepted {
+		log.Println("login accepted with wrong code:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket[1]}, "code": {code}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusUnauthorized || accepted {
+		log.Println("login accepted with the code of the enrollment:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	next, _ := mfa.TOTPCode(secret[1], time.Now().Add(mfa.TOTPPeriod))
+	rr = postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket[1]}, "code": {next}}, nil)
+
+	//then
+	accepted, found := fakeHydra.AcceptedLogin(loginChallenge)
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != fakeHydra.RedirectURL(loginChallenge) || !found || *accepted.Subject != "user" {
+		log.Println("login not accepted after second factor:", rr.Code, rr.Header().Get("Location"))
+		t.Fail()
+	}
+}
+
+func TestTOTPCodeCannotBeReplayedOrGuessed(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	secret := "JBSWY3DPEHPK3PXP"
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user", TOTPSecret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	code, _ := mfa.TOTPCode(secret, time.Now())
+
+	login := func() string {
+		challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+		rr := postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"user"}}, nil)
+		ticket := ticketPattern.FindStringSubmatch(rr.Body.String())
+		if ticket == nil {
+			log.Println("second factor not requested:", rr.Code)
+			t.FailNow()
+		}
+		return ticket[1]
+	}
+
+	//when
+	rr := postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {login()}, "code": {code}}, nil)
+
+	//then
+	if rr.Code != http.StatusFound {
+		log.Println("login not accepted with valid code:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {login()}, "code": {code}}, nil)
+
+	//then
+	if rr.Code != http.StatusUnauthorized {
+		log.Println("used code accepted again:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	ticket := login()
+	for i := 1; i < MFAMaxAttempts; i++ {
+		postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket}, "code": {"000000"}}, nil)
+	}
+	next, _ := mfa.TOTPCode(secret, time.Now().Add(mfa.TOTPPeriod))
+
+	//when
+	rr = postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket}, "code": {next}}, nil)
+
+	//then
+	if rr.Code != http.StatusTooManyRequests {
+		log.Println("second factor not limited:", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestTOTPCodeSubmittedConcurrentlyIsAcceptedOnce(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	secret := "JBSWY3DPEHPK3PXP"
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "user", TOTPSecret: secret}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	code, _ := mfa.TOTPCode(secret, time.Now())
+
+	tickets := make([]string, MFAMaxAttempts-1)
+	for i := range tickets {
+		challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+		rr := postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"user"}}, nil)
+		ticket := ticketPattern.FindStringSubmatch(rr.Body.String())
+		if ticket == nil {
+			log.Println("second factor not requested:", rr.Code)
+			t.FailNow()
+		}
+		tickets[i] = ticket[1]
+	}
+
+	//when
+	codes := make(chan int, len(tickets))
+	var wg sync.WaitGroup
+	for _, ticket := range tickets {
+		wg.Add(1)
+		go func(ticket string) {
+			defer wg.Done()
+			codes <- postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket}, "code": {code}}, nil).Code
+		}(ticket)
+	}
+	wg.Wait()
+	close(codes)
+
+	//then
+	accepted := 0
+	for code := range codes {
+		if code == http.StatusFound {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		log.Println("concurrently submitted code accepted", accepted, "times")
+		t.Fail()
+	}
+}
+
+func TestACRValuesRequireStepUp(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	secret := "JBSWY3DPEHPK3PXP"
+	repo := user.NewEmptyUserInMemoryRepo()
+	for _, u := range []*user.User{
+		{Email: "user", Password: "secret"},
+		{Email: "mfa", Password: "secret", TOTPSecret: secret},
+	} {
+		if err := repo.AddUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	acrValues := func(values ...string) *models.OpenIDConnectContext {
+		return &models.OpenIDConnectContext{AcrValues: values}
+	}
+
+	challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+	form := url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"secret"}, "remember": {"on"}}
+
+	//when
+	rr := postForm(handler.HandleLogin, "/idp/login", form, nil)
+
+	//then
+	accepted, found := fakeHydra.AcceptedLogin(challenge)
+	if !found || accepted.Acr != "pwd" {
+		log.Println("password login not accepted with acr pwd:", rr.Code, accepted)
+		t.FailNow()
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != LoginACRCookie {
+		log.Println("remembered login not stored:", cookies)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Skip: true, Subject: "user", OidcContext: acrValues("pwd")})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, cookies)
+
+	//then
+	if accepted, found := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusFound || !found || accepted.Acr != "pwd" {
+		log.Println("sufficient remembered login not skipped:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Skip: true, Subject: "user", OidcContext: acrValues("pwd")})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusOK || accepted || !strings.Contains(rr.Body.String(), `value="user" readonly`) {
+		log.Println("step-up not required without remembered login:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Skip: true, Subject: "user", OidcContext: acrValues("mfa")})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, cookies)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusOK || accepted {
+		log.Println("remembered password login skipped for mfa:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"secret"}}, nil)
+
+	//then
+	if rejected, found := fakeHydra.Rejected(challenge); rr.Code != http.StatusForbidden || !found || rejected.Error != "unmet_authentication_requirements" {
+		log.Println("login without second factor not rejected:", rr.Code, rejected)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", OidcContext: acrValues("mfa")})
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"mfa"}, "password": {"secret"}}, nil)
+	ticket := ticketPattern.FindStringSubmatch(rr.Body.String())
+	if ticket == nil {
+		log.Println("second factor not requested:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	code, _ := mfa.TOTPCode(secret, time.Now())
+	rr = postForm(handler.HandleLoginMFA, LoginMFAPath, url.Values{"ticket": {ticket[1]}, "code": {code}}, nil)
+
+	//then
+	if accepted, found := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusFound || !found || accepted.Acr != "mfa" {
+		log.Println("login with second factor not accepted with acr mfa:", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestPromptMaxAgeAndLoginHint(t *testing.T) {
+	//given
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	for _, u := range []*user.User{{Email: "user", Password: "secret"}, {Email: "other", Password: "other secret"}} {
+		if err := repo.AddUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	skipped := func(params url.Values) string {
+		return fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Skip: true, Subject: "user", Params: params})
+	}
+
+	challenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", OidcContext: &models.OpenIDConnectContext{LoginHint: "user"}})
+
+	//when
+	rr := getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, nil)
+
+	//then
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `value="user" readonly`) {
+		log.Println("username not locked to login_hint:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"wrong"}, "username_locked": {"on"}}, nil)
+
+	//then
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `value="user" readonly`) {
+		log.Println("username not locked after invalid credentials:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"other"}, "password": {"other secret"}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); accepted || rr.Code != http.StatusUnauthorized ||
+		!strings.Contains(rr.Body.String(), "Bitte melden Sie sich mit dem angezeigten Benutzernamen an") || !strings.Contains(rr.Body.String(), `value="user" readonly`) {
+		log.Println("login of another user than login_hint accepted:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"user"}, "password": {"secret"}, "remember": {"on"}}, nil)
+	cookies := rr.Result().Cookies()
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); !accepted || len(cookies) != 1 {
+		log.Println("login not accepted:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Params: url.Values{"prompt": {"none"}}})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, nil)
+
+	//then
+	if rejected, found := fakeHydra.Rejected(challenge); rr.Code != http.StatusFound || !found || rejected.Error != "login_required" ||
+		rr.Header().Get("Location") != fakeHydra.RedirectURL(challenge) {
+		log.Println("prompt=none without login not rejected:", rr.Code, rejected)
+		t.FailNow()
+	}
+
+	for _, params := range []url.Values{{"max_age": {"0"}}, {"prompt": {"login"}}} {
+		//given
+		challenge = skipped(params)
+
+		//when
+		rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, cookies)
+
+		//then
+		if _, accepted := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusOK || accepted || !strings.Contains(rr.Body.String(), `value="user" readonly`) {
+			log.Println("credentials not required for", params, rr.Code)
+			t.FailNow()
+		}
+	}
+
+	//given
+	challenge = skipped(url.Values{"prompt": {"login"}})
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {challenge}, "username": {"other"}, "password": {"other secret"}, "username_locked": {"on"}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); accepted || rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `value="user" readonly`) {
+		log.Println("reauthentication as another user accepted:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = skipped(url.Values{"max_age": {"0"}, "prompt": {"none"}})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, cookies)
+
+	//then
+	if rejected, found := fakeHydra.Rejected(challenge); rr.Code != http.StatusFound || !found || rejected.Error != "login_required" {
+		log.Println("prompt=none with exceeded max_age not rejected:", rr.Code, rejected)
+		t.FailNow()
+	}
+
+	//given
+	challenge = skipped(url.Values{"max_age": {"3600"}})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, cookies)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusFound || !accepted {
+		log.Println("recent login not skipped:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	challenge = skipped(url.Values{"prompt": {"select_account"}, "login_hint": {"user"}})
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+challenge, cookies)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusOK || accepted ||
+		!strings.Contains(rr.Body.String(), "client_id=app&amp;prompt=login") || strings.Contains(rr.Body.String(), "login_hint") {
+		log.Println("account selection not shown:", rr.Code, rr.Body.String())
+		t.FailNow()
+	}
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?account=continue&login_challenge="+challenge, cookies)
+
+	//then
+	if accepted, found := fakeHydra.AcceptedLogin(challenge); rr.Code != http.StatusFound || !found || *accepted.Subject != "user" {
+		log.Println("selected account not accepted:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Scopes: []string{"openid"}, Params: url.Values{"prompt": {"none"}}})
+	challenge = fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge, Subject: "user"})
+
+	//when
+	rr = getWithCookies(handler.HandleConsent, "/idp/consent?consent_challenge="+challenge, nil)
+
+	//then
+	if rejected, found := fakeHydra.Rejected(challenge); rr.Code != http.StatusFound || !found || rejected.Error != "consent_required" {
+		log.Println("prompt=none without consent not rejected:", rr.Code, rejected)
+		t.Fail()
+	}
+}
+
+var resetLinkPattern = regexp.MustCompile(`https://idp\.example\.com/idp/password/reset\?token=(\S+)`)
+
+func TestPasswordResetContinuesLogin(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com/")
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user@example.com", Password: "forgotten"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(nil, repo)
+	var mails bytes.Buffer
+	handler.Mailer = mail.NewWriterMailer(&mails, "idp@example.com")
+
+	//when
+	rr := postForm(handler.HandlePasswordForgot, PasswordForgotPath, url.Values{"email": {"unknown@example.com"}, "login_challenge": {"challenge"}}, nil)
+	unknownBody := rr.Body.String()
+	rr = postForm(handler.HandlePasswordForgot, PasswordForgotPath, url.Values{"email": {"user@example.com"}, "login_challenge": {"challenge"}}, nil)
+
+	//then
+	link := resetLinkPattern.FindStringSubmatch(mails.String())
+	if rr.Code != http.StatusOK || rr.Body.String() != unknownBody || strings.Count(mails.String(), "To: ") != 1 || link == nil {
+		log.Println("unexpected reset mail:", rr.Code, mails.String())
+		t.FailNow()
+	}
+	token, _ := url.QueryUnescape(link[1])
+
+	//when
+	rr = getWithCookies(handler.HandlePasswordReset, PasswordResetPath+"?token="+url.QueryEscape(token), nil)
+
+	//then
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `name="token"`) {
+		log.Println("reset form not shown:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandlePasswordReset, PasswordResetPath, url.Values{"token": {token}, "new_password": {"new password"}, "new_password_confirm": {"new password"}}, nil)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user@example.com"); rr.Code != http.StatusSeeOther ||
+		rr.Header().Get("Location") != "/idp/login?login_challenge=challenge" || !u.PasswordMatches("new password") || !u.EmailVerified {
+		log.Println("password not reset:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandlePasswordReset, PasswordResetPath, url.Values{"token": {token}, "new_password": {"another password"}, "new_password_confirm": {"another password"}}, nil)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user@example.com"); rr.Code != http.StatusBadRequest || !u.PasswordMatches("new password") {
+		log.Println("reset token used twice:", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestPasswordResetIsDisabledWithoutPublicURL(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "")
+	handler := NewHandler(nil, user.NewEmptyUserInMemoryRepo())
+
+	//when
+	rr := postForm(handler.HandlePasswordForgot, PasswordForgotPath, url.Values{"email": {"user@example.com"}}, nil)
+
+	//then
+	if rr.Code != http.StatusNotFound {
+		log.Println("password reset enabled without public url:", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestMailFeaturesAreDisabledWithoutMailTransport(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com/")
+	t.Setenv("MAIL_TRANSPORT", "")
+	handler := NewHandler(nil, user.NewEmptyUserInMemoryRepo())
+
+	//when
+	rr := postForm(handler.HandlePasswordForgot, PasswordForgotPath, url.Values{"email": {"user@example.com"}}, nil)
+
+	//then
+	if rr.Code != http.StatusNotFound || handler.registrationEnabled(nil) || handler.emailLoginEnabled() {
+		log.Println("mail features enabled without mail transport:", rr.Code)
+		t.Fail()
+	}
+}
+
+func TestRegistrationOfSomeoneElsesEmailCannotTakeOverTheAccount(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com")
+	t.Setenv("REGISTRATION_ENABLED", "true")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	var mails bytes.Buffer
+	handler.Mailer = mail.NewWriterMailer(&mails, "idp@example.com")
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+	register := func(password string) {
+		rr := postForm(handler.HandleRegister, RegisterPath, url.Values{
+			"login_challenge": {loginChallenge}, "email": {"victim@example.com"}, "password": {password}, "password_confirm": {password},
+		}, nil)
+		if rr.Code != http.StatusOK {
+			log.Println("registration failed:", rr.Code)
+			t.FailNow()
+		}
+	}
+	login := func(password string) int {
+		return postForm(handler.HandleLogin, "/idp/login", url.Values{
+			"login_challenge": {loginChallenge}, "username": {"victim@example.com"}, "password": {password},
+		}, nil).Code
+	}
+
+	//when
+	register("correct horse battery")
+
+	//then
+	link := verifyLinkPattern.FindStringSubmatch(mails.String())
+	if code := login("correct horse battery"); code != http.StatusUnauthorized || link == nil {
+		log.Println("unverified registration can sign in:", code)
+		t.FailNow()
+	}
+	attackerToken, _ := url.QueryUnescape(link[1])
+
+	//when
+	mails.Reset()
+	register("owner chosen secret")
+
+	//then
+	if verifyLinkPattern.MatchString(mails.String()) || !resetLinkPattern.MatchString(mails.String()) {
+		log.Println("unexpected mail for registered email:", mails.String())
+		t.FailNow()
+	}
+
+	//when
+	rr := getWithCookies(handler.HandleRegisterVerify, RegisterVerifyPath+"?token="+url.QueryEscape(attackerToken), nil)
+
+	//then
+	if u, _ := repo.GetUserByEmail("victim@example.com"); rr.Code != http.StatusBadRequest || u.EmailVerified {
+		log.Println("verification link of the first registration accepted:", rr.Code)
+		t.FailNow()
+	}
+	if code := login("correct horse battery"); code != http.StatusUnauthorized {
+		log.Println("password of the first registration accepted:", code)
+		t.FailNow()
+	}
+
+	//when
+	resetToken, _ := url.QueryUnescape(resetLinkPattern.FindStringSubmatch(mails.String())[1])
+	postForm(handler.HandlePasswordReset, PasswordResetPath, url.Values{
+		"token": {resetToken}, "new_password": {"owner chosen secret"}, "new_password_confirm": {"owner chosen secret"},
+	}, nil)
+
+	//then
+	if code := login("owner chosen secret"); code != http.StatusFound {
+		log.Println("owner cannot sign in after the reset:", code)
+		t.Fail()
+	}
+}
+
+func TestRegistrationWithoutChallengeCannotSignInToRestrictedClient(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com")
+	t.Setenv("REGISTRATION_ENABLED", "true")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "app", Metadata: map[string]interface{}{
+		"registration": true, "registration_domains": "example.com",
+	}})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	var mails bytes.Buffer
+	handler.Mailer = mail.NewWriterMailer(&mails, "idp@example.com")
+
+	rr := postForm(handler.HandleRegister, RegisterPath, url.Values{
+		"email": {"user@example.org"}, "password": {"correct horse"}, "password_confirm": {"correct horse"},
+	}, nil)
+	link := verifyLinkPattern.FindStringSubmatch(mails.String())
+	if rr.Code != http.StatusOK || link == nil {
+		log.Println("registration without challenge failed:", rr.Code)
+		t.FailNow()
+	}
+	token, _ := url.QueryUnescape(link[1])
+	getWithCookies(handler.HandleRegisterVerify, RegisterVerifyPath+"?token="+url.QueryEscape(token), nil)
+
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"user@example.org"}, "password": {"correct horse"}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); accepted || rr.Code != http.StatusForbidden {
+		log.Println("login to restricted client accepted:", rr.Code)
+		t.FailNow()
+	}
+	if rejected, found := fakeHydra.Rejected(loginChallenge); !found || rejected.Error != "access_denied" {
+		log.Println("login request not rejected:", rejected)
+		t.Fail()
+	}
+}
+
+func TestPasswordResetMailsAreLimitedPerAddress(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com/")
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user@example.com", Password: "forgotten"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(nil, repo)
+	var mails bytes.Buffer
+	handler.Mailer = mail.NewWriterMailer(&mails, "idp@example.com")
+	for i := 0; i < DefaultEmailLoginRateLimit; i++ {
+		postForm(handler.HandlePasswordForgot, PasswordForgotPath, url.Values{"email": {"user@example.com"}}, nil)
+	}
+
+	//when
+	rr := postForm(handler.HandlePasswordForgot, PasswordForgotPath, url.Values{"email": {"User@example.com"}}, nil)
+
+	//then
+	if rr.Code != http.StatusTooManyRequests || strings.Count(mails.String(), "To: ") != DefaultEmailLoginRateLimit {
+		log.Println("reset mails not limited:", rr.Code, strings.Count(mails.String(), "To: "))
+		t.Fail()
+	}
+}
+
+var verifyLinkPattern = regexp.MustCompile(`https://idp\.example\.com/idp/register/verify\?token=(\S+)`)
+
+func TestRegistrationVerifiesEmail(t *testing.T) {
+	//given
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com")
+	t.Setenv("REGISTRATION_ENABLED", "false")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "app", Metadata: map[string]interface{}{
+		"registration": true, "registration_domains": "example.com",
+	}})
+	fakeHydra.AddClient(&models.OAuth2Client{ClientID: "partner"})
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	var mails bytes.Buffer
+	handler.Mailer = mail.NewWriterMailer(&mails, "idp@example.com")
+
+	partnerChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "partner"})
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app", Scopes: []string{"openid"}})
+
+	//when
+	rr := getWithCookies(handler.HandleRegister, RegisterPath+"?login_challenge="+partnerChallenge, nil)
+
+	//then
+	if rr.Code != http.StatusNotFound {
+		log.Println("registration enabled for partner:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = getWithCookies(handler.HandleLogin, "/idp/login?login_challenge="+loginChallenge, nil)
+
+	//then
+	if !strings.Contains(rr.Body.String(), RegisterPath+"?login_challenge="+loginChallenge) {
+		log.Println("registration link missing on login page")
+		t.FailNow()
+	}
+
+	for email, password := range map[string]string{"user@example.org": "correct horse", "user@example.com": "short"} {
+		//when
+		rr = postForm(handler.HandleRegister, RegisterPath, url.Values{
+			"login_challenge": {loginChallenge}, "email": {email}, "password": {password}, "password_confirm": {password},
+		}, nil)
+
+		//then
+		if _, err := repo.GetUserByEmail(email); rr.Code != http.StatusBadRequest || err == nil {
+			log.Println("invalid registration accepted:", email, rr.Code)
+			t.FailNow()
+		}
+	}
+
+	//when
+	rr = postForm(handler.HandleRegister, RegisterPath, url.Values{
+		"login_challenge": {loginChallenge}, "email": {"user@example.com"}, "password": {"correct horse"}, "password_confirm": {"correct horse"},
+	}, nil)
+
+	//then
+	link := verifyLinkPattern.FindStringSubmatch(mails.String())
+	if u, err := repo.GetUserByEmail("user@example.com"); rr.Code != http.StatusOK || err != nil || u.EmailVerified || link == nil {
+		log.Println("user not registered:", rr.Code, err, mails.String())
+		t.FailNow()
+	}
+	token, _ := url.QueryUnescape(link[1])
+
+	//when
+	rr = getWithCookies(handler.HandleRegisterVerify, RegisterVerifyPath+"?token="+url.QueryEscape(token), nil)
+
+	//then
+	if u, _ := repo.GetUserByEmail("user@example.com"); rr.Code != http.StatusSeeOther ||
+		rr.Header().Get("Location") != "/idp/login?login_challenge="+loginChallenge || !u.EmailVerified {
+		log.Println("email not verified:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+
+	//given
+	postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"user@example.com"}, "password": {"correct horse"}}, nil)
+	consentChallenge := fakeHydra.NewConsentRequest(hydratest.ConsentOptions{LoginChallenge: loginChallenge})
+
+	//when
+	postForm(handler.HandleConsent, "/idp/consent", url.Values{"consent_challenge": {consentChallenge}, "submit": {"Allow access"}}, nil)
+
+	//then
+	accepted, found := fakeHydra.AcceptedConsent(consentChallenge)
+	if !found {
+		log.Println("consent not accepted")
+		t.FailNow()
+	}
+	claims, _ := accepted.Session.IDToken.(map[string]interface{})
+	if claims["email_verified"] != true {
+		log.Println("unexpected id token claims:", claims)
+		t.Fail()
+	}
+}
+
+func TestExpiredPasswordMustBeChangedAtLogin(t *testing.T) {
+	//given
+	t.Setenv("PASSWORD_MAX_AGE", "720h")
+	t.Setenv("PASSWORD_HISTORY", "3")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "user", Password: "old password", PasswordChangedAt: time.Now().Add(-800 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	handler.Passwords = password.Must(password.NewPolicyFromEnv())
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+
+	//when
+	rr := postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"user"}, "password": {"old password"}}, nil)
+
+	//then
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusSeeOther || location.Path != PasswordResetPath || accepted {
+		log.Println("expired password not changed first:", rr.Code, rr.Header().Get("Location"))
+		t.FailNow()
+	}
+	token := location.Query().Get("token")
+
+	//when
+	rr = postForm(handler.HandlePasswordReset, PasswordResetPath, url.Values{"token": {token}, "new_password": {"old password"}, "new_password_confirm": {"old password"}}, nil)
+
+	//then
+	if rr.Code != http.StatusBadRequest {
+		log.Println("old password accepted:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandlePasswordReset, PasswordResetPath, url.Values{"token": {token}, "new_password": {"new password"}, "new_password_confirm": {"new password"}}, nil)
+
+	//then
+	u, _ := repo.GetUserByEmail("user")
+	if rr.Code != http.StatusSeeOther || !u.PasswordMatches("new password") || len(u.PasswordHistory) != 1 || u.EmailVerified {
+		log.Println("expired password not reset:", rr.Code, u)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"user"}, "password": {"new password"}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusFound || !accepted {
+		log.Println("login not accepted with new password:", rr.Code)
+		t.Fail()
+	}
+}
+
+var (
+	emailCodePattern = regexp.MustCompile(`\n\s*\n(\d{6})\s*\n`)
+	emailLinkPattern = regexp.MustCompile(`https://idp\.example\.com/idp/login/email/verify\?token=([^&\s]+)&login_challenge=(\S+)`)
+)
+
+func TestEmailLoginWithCodeAndLink(t *testing.T) {
+	//given
+	t.Setenv("EMAIL_LOGIN_ENABLED", "true")
+	t.Setenv("EMAIL_LOGIN_RATE_LIMIT", "2")
+	t.Setenv("IDP_PUBLIC_URL", "https://idp.example.com")
+	fakeHydra := hydratest.NewServer()
+	defer fakeHydra.Close()
+
+	repo := user.NewEmptyUserInMemoryRepo()
+	if err := repo.AddUser(&user.User{Email: "partner@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "app"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "app", theme.ConfigFile), []byte(`{"title": "App Theme"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewHandler(fakeHydra.Backend(flow.APIVersionV1), repo)
+	handler.Themes = theme.Must(theme.Load(dir, handler.Views))
+	var mails bytes.Buffer
+	handler.Mailer = mail.NewWriterMailer(&mails, "idp@example.com")
+	loginChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+
+	//when
+	rr := postForm(handler.HandleLogin, "/idp/login", url.Values{"login_challenge": {loginChallenge}, "username": {"partner@example.com"}, "password": {""}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusUnauthorized || accepted {
+		log.Println("user without password accepted with empty password:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLoginEmail, LoginEmailPath, url.Values{"login_challenge": {loginChallenge}, "email": {"partner@example.com"}}, nil)
+
+	//then
+	code := emailCodePattern.FindStringSubmatch(mails.String())
+	ticket := ticketPattern.FindStringSubmatch(rr.Body.String())
+	if rr.Code != http.StatusOK || code == nil || ticket == nil {
+		log.Println("email login code not sent:", rr.Code, mails.String())
+		t.FailNow()
+	}
+
+	//when
+	wrong := "000000"
+	if code[1] == wrong {
+		wrong = "111111"
+	}
+	rr = postForm(handler.HandleLoginEmailVerify, LoginEmailVerifyPath, url.Values{"ticket": {ticket[1]}, "code": {wrong}}, nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(loginChallenge); rr.Code != http.StatusUnauthorized || accepted {
+		log.Println("login accepted with wrong code:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rr = postForm(handler.HandleLoginEmailVerify, LoginEmailVerifyPath, url.Values{"ticket": {ticket[1]}, "code": {code[1]}}, nil)
+
+	//then
+	accepted, found := fakeHydra.AcceptedLogin(loginChallenge)
+	if u, _ := repo.GetUserByEmail("partner@example.com"); rr.Code != http.StatusFound || !found || *accepted.Subject != "partner@example.com" || !u.EmailVerified {
+		log.Println("login not accepted with code or email not verified:", rr.Code)
+		t.FailNow()
+	}
+
+	//given
+	mails.Reset()
+	linkChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+	postForm(handler.HandleLoginEmail, LoginEmailPath, url.Values{"login_challenge": {linkChallenge}, "email": {"partner@example.com"}}, nil)
+	link := emailLinkPattern.FindStringSubmatch(mails.String())
+	if link == nil {
+		log.Println("magic link not sent:", mails.String())
+		t.FailNow()
+	}
+	token, _ := url.QueryUnescape(link[1])
+
+	//when
+	rr = getWithCookies(handler.HandleLoginEmailVerify, LoginEmailVerifyPath+"?token="+url.QueryEscape(token+"x")+"&login_challenge="+link[2], nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(linkChallenge); rr.Code != http.StatusBadRequest || accepted || !strings.Contains(rr.Body.String(), "App Theme") {
+		log.Println("invalid link accepted or without theme of client:", rr.Code, rr.Body.String())
+		t.FailNow()
+	}
+
+	//when
+	rr = getWithCookies(handler.HandleLoginEmailVerify, LoginEmailVerifyPath+"?token="+url.QueryEscape(token), nil)
+
+	//then
+	if _, accepted := fakeHydra.AcceptedLogin(linkChallenge); rr.Code != http.StatusFound || !accepted {
+		log.Println("login not accepted with link:", rr.Code)
+		t.FailNow()
+	}
+
+	//when
+	rateChallenge := fakeHydra.NewLoginRequest(hydratest.LoginOptions{ClientID: "app"})
+	rr = postForm(handler.HandleLoginEmail, LoginEmailPath, url.Values{"login_challenge": {rateChallenge}, "email": {"Partner@example.com"}}, nil)
+
+	//then
+	if rr.Code != http.StatusTooManyRequests {
+		log.Println("email login not rate limited:", rr.Code)
+		t.Fail()
+	}
+}
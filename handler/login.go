@@ -2,172 +2,345 @@ package handler
 
 import (
 	"context"
-	"html/template"
-	"log"
 	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/i18n"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/user"
+	"slices"
 	"strings"
-
-	"github.com/ory/hydra-client-go/client/admin"
-	"github.com/ory/hydra-client-go/models"
 )
 
-func (h *Handler) showErrorPage(w http.ResponseWriter, errorTitle string, errorContent string) {
-	tmpl := template.Must(template.ParseFiles("view/error.html"))
-	w.WriteHeader(http.StatusBadRequest)
-	err := tmpl.Execute(w, map[string]interface{}{
-		"ErrorTitle":   errorTitle,
-		"ErrorContent": errorContent,
+// showErrorPage renders the error page with the messages of the given
+// catalog keys.
+func (h *Handler) showErrorPage(w http.ResponseWriter, r *http.Request, errorTitleKey string, errorContentKey string) {
+	l := h.localizer(r)
+	h.renderPage(w, r, http.StatusBadRequest, "", "error.html", map[string]interface{}{
+		"ErrorTitle":   l.T(errorTitleKey),
+		"ErrorContent": l.T(errorContentKey),
 	})
-
-	if err != nil {
-		log.Println("error during templating: ", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err := w.Write([]byte("An expected error occured")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
-	}
 }
 func (h *Handler) loginGet(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "loginGet")
+	defer span.End()
+
 	login_chalenge := r.URL.Query().Get("login_challenge")
-	log.Print("GET login ")
+	r = r.WithContext(logging.WithChallenge(r.Context(), login_chalenge))
+	logger := logging.FromContext(r.Context())
+	logger.Debug("GET login")
 
 	if login_chalenge == "" {
-		h.showErrorPage(w, "login_chalenge missed", "Login Chalenge muss als Query Parameter gesetzt werden")
+		h.showErrorPage(w, r, "error.login_challenge_missing.title", "error.login_challenge_missing.content")
 		return
 	}
 
-	tmpl := template.Must(template.ParseFiles("view/login.html"))
-
-	loginGetParam := admin.NewGetLoginRequestParamsWithHTTPClient(h.httpClient)
-	loginGetParam.WithContext(r.Context())
-	loginGetParam.SetLoginChallenge(login_chalenge)
-
-	respLoginGet, err := h.HydraClient.Admin.GetLoginRequest(loginGetParam)
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), login_chalenge)
 	if err != nil {
-		log.Println("GetLoginRequest failed", err.Error())
-		h.showErrorPage(w, "Fehler beim Starten von Code Flow ", "Bitte wiederholen Sie den Vorgang")
+		logger.Error("GetLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
 
-	skip := false
-	if respLoginGet.GetPayload() != nil && respLoginGet.GetPayload().Skip != nil {
-		skip = *respLoginGet.GetPayload().Skip
+	r = h.withLocale(r, loginRequest.OIDCContext)
+	r, _, ok := h.requestRealm(w, r, loginRequest.Client)
+	if !ok {
+		return
 	}
 
-	if skip {
-		log.Print("skip login")
+	if loginRequest.Skip {
+		logger.Info("skip login")
+
+		event := audit.Event{
+			Type:     audit.EventLoginSkipped,
+			Outcome:  audit.OutcomeSuccess,
+			Subject:  loginRequest.Subject,
+			ClientID: clientID(loginRequest.Client),
+		}
 
-		respLoginAccept, err := h.acceptLoginRequest(r.Context(), respLoginGet.GetPayload().Subject, login_chalenge, true)
+		if h.loginAccessDenied(w, r, event, loginRequest) {
+			return
+		}
 
-		if err != nil {
-			log.Println("AcceptLoginRequest failed", err.Error())
-			h.showErrorPage(w, "Fehler beim Starten von Code Flow ", "Bitte wiederholen Sie den Vorgang")
+		remembered := h.loadRememberedLogin(r, loginRequest)
+		if reason, notice := h.reauthentication(loginRequest, remembered); reason != "" {
+			if loginRequest.HasPrompt(flow.PromptNone) {
+				h.rejectLoginWithoutPrompt(w, r, event, loginRequest, reason)
+				return
+			}
+			// the remembered login is too old or too weak for the client,
+			// the same user has to sign in again
+			logger.Info("credentials required", "reason", reason)
+			_, email := h.subjectRealm(loginRequest.Subject)
+			h.showLogin(w, r, http.StatusOK, loginRequest, map[string]interface{}{
+				"Notice":         h.localizer(r).T(notice),
+				"Username":       email,
+				"UsernameLocked": true,
+			})
 			return
 		}
 
-		redirectUrl := *respLoginAccept.GetPayload().RedirectTo
-		if len(strings.TrimSpace(h.alt_redirect_hydra_url)) > 0 {
-			redirectUrl = strings.Replace(redirectUrl, h.hydra_public_url, h.alt_redirect_hydra_url, 1)
+		if loginRequest.HasPrompt(flow.PromptSelectAccount) && r.URL.Query().Get("account") != "continue" {
+			h.showSelectAccount(w, r, loginRequest)
+			return
+		}
+
+		var amr []string
+		if remembered != nil {
+			amr = remembered.AMR
+		}
+		redirectTo, err := h.acceptLoginRequest(r.Context(), loginRequest, loginRequest.Subject, true, amr)
+
+		if err != nil {
+			logger.Error("AcceptLoginRequest failed", "error", err)
+			event.Outcome, event.Reason = audit.OutcomeFailure, "accept login request failed"
+			h.Audit.Emit(r, event)
+			h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+			return
 		}
-		log.Println("redirect to consent: ", redirectUrl)
+		h.Audit.Emit(r, event)
+
+		redirectUrl := h.rewriteRedirect(r, redirectTo)
+		logger.Debug("redirect to consent", "redirect_to", redirectUrl)
 		http.Redirect(w, r, redirectUrl, http.StatusFound)
+		return
 	}
 
-	err = tmpl.Execute(w, map[string]interface{}{
-		"LoginChallenge": login_chalenge,
-	})
-	if err != nil {
-		log.Println("error during templating: ", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		if _, err := w.Write([]byte("An expected error occured")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+	if loginRequest.HasPrompt(flow.PromptNone) {
+		event := audit.Event{Type: audit.EventLogin, ClientID: clientID(loginRequest.Client)}
+		h.rejectLoginWithoutPrompt(w, r, event, loginRequest, "no remembered login")
+		return
+	}
+
+	var data map[string]interface{}
+	if hint := loginHint(loginRequest); hint != "" {
+		data = map[string]interface{}{"Username": hint, "UsernameLocked": true}
 	}
+	h.showLogin(w, r, http.StatusOK, loginRequest, data)
+}
+
+// loginHint returns the login_hint of the client, which names the user
+// expected to sign in.
+func loginHint(loginRequest *flow.LoginRequest) string {
+	if loginRequest.OIDCContext == nil {
+		return ""
+	}
+	return strings.TrimSpace(loginRequest.OIDCContext.LoginHint)
+}
+
+// showLogin renders the login form for the login request. data adds to or
+// overrides the values of the form.
+func (h *Handler) showLogin(w http.ResponseWriter, r *http.Request, status int, loginRequest *flow.LoginRequest, data map[string]interface{}) {
+	page := map[string]interface{}{
+		"LoginChallenge": loginRequest.Challenge,
+		"Locale":         h.localizer(r).Locale(),
+		"PasswordReset":  h.passwordResetEnabled(),
+		"Registration":   h.registrationEnabled(loginRequest.Client),
+		"EmailLogin":     h.emailLoginEnabled(),
+	}
+	for key, value := range data {
+		page[key] = value
+	}
+	h.renderPage(w, r, status, clientID(loginRequest.Client), "login.html", page)
 }
 
 func (h *Handler) loginPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "loginPOST")
+	defer span.End()
 
 	formData := struct {
 		LoginChallenge string `validate:"required"`
 		Email          string `validate:"required"`
 		Password       string `validate:"required"`
 		Remember       string `validate:"required"`
+		// only used to keep the language, registration link and locked
+		// username when the form is shown again
+		Locale         string
+		Registration   string
+		UsernameLocked string
 	}{
 		LoginChallenge: r.FormValue("login_challenge"),
 		Email:          r.FormValue("username"),
 		Password:       r.FormValue("password"),
 		Remember:       r.FormValue("remember"),
+		Locale:         r.FormValue("locale"),
+		Registration:   r.FormValue("registration"),
+		UsernameLocked: r.FormValue("username_locked"),
+	}
+	if h.Messages.Supports(formData.Locale) {
+		r = r.WithContext(i18n.WithLocale(r.Context(), formData.Locale))
 	}
+	r = r.WithContext(logging.WithChallenge(r.Context(), formData.LoginChallenge))
+	logger := logging.FromContext(r.Context())
+
+	if formData.LoginChallenge == "" {
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+	// loaded once for the realm, the theme and the acceptance of the login
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), formData.LoginChallenge)
+	if err != nil {
+		logger.Error("GetLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+	r, rl, ok := h.requestRealm(w, r, loginRequest.Client)
+	if !ok {
+		return
+	}
+
+	event := audit.Event{
+		Type:    audit.EventLogin,
+		Outcome: audit.OutcomeSuccess,
+		Subject: rl.Subject(formData.Email),
+	}
+
+	// the theme is taken from the client of the login request, a posted
+	// client_id could be forged
+	clientID := clientID(loginRequest.Client)
 
 	//TODO VZ implemenent loginReject Call
-	if !h.isUserValid(formData.Email, formData.Password) {
-		w.WriteHeader(http.StatusUnauthorized)
-		tmpl := template.Must(template.ParseFiles("view/login.html"))
-		err := tmpl.Execute(w, map[string]interface{}{
+	u, valid := h.validUser(r.Context(), event.Subject, formData.Password)
+	if !valid {
+		logger.Info("invalid credentials", "username", formData.Email)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid credentials"
+		h.Audit.Emit(r, event)
+		// a username given by login_hint or a remembered login stays locked
+		username := ""
+		if formData.UsernameLocked == "on" {
+			username = formData.Email
+		}
+		h.renderPage(w, r, http.StatusUnauthorized, clientID, "login.html", map[string]interface{}{
 			"LoginChallenge": formData.LoginChallenge,
-			"ErrorTitle":     "Benutzername/Password falsch",
-			"ErrorContent":   "Korrigieren Sie Ihre Angaben",
+			"Locale":         h.localizer(r).Locale(),
+			"ErrorTitle":     h.localizer(r).T("login.invalid_credentials.title"),
+			"ErrorContent":   h.localizer(r).T("login.invalid_credentials.content"),
+			"PasswordReset":  h.passwordResetEnabled(),
+			"Registration":   formData.Registration == "on",
+			"EmailLogin":     h.emailLoginEnabled(),
+			"Username":       username,
+			"UsernameLocked": formData.UsernameLocked == "on",
 		})
+		return
+	}
 
-		if err != nil {
-			log.Println("error during templating: ", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			if _, err := w.Write([]byte("An expected error occured")); err != nil {
-				panic("unexpected error:" + err.Error())
-			}
-		}
-
+	if u.HasSecondFactor() {
+		logger.Info("second factor required", "username", formData.Email)
+		h.showLoginMFA(w, r, http.StatusOK, u, &mfaTicket{
+			Subject:   event.Subject,
+			Challenge: formData.LoginChallenge,
+			Remember:  formData.Remember == "on",
+			ClientID:  clientID,
+			Locale:    h.localizer(r).Locale(),
+		}, "")
 		return
 	}
 
-	loginParams := admin.NewGetLoginRequestParamsWithHTTPClient(h.httpClient).WithContext(r.Context())
-	loginParams.SetLoginChallenge(formData.LoginChallenge)
+	h.completeLoginRequest(w, r, event, loginRequest, formData.Remember == "on", []string{"pwd"})
+}
 
-	_, err := h.HydraClient.Admin.GetLoginRequest(loginParams)
+// completeLogin accepts the login request after all factors are verified.
+// The login request is loaded again, it may have been answered meanwhile.
+func (h *Handler) completeLogin(w http.ResponseWriter, r *http.Request, event audit.Event, challenge string, remember bool, amr []string) {
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), challenge)
 	if err != nil {
-		log.Println("error GetLoginRequest", err.Error())
-		h.showErrorPage(w, "Fehler beim Starten von Code Flow ", "Bitte wiederholen Sie den Vorgang")
+		logging.FromContext(r.Context()).Error("GetLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
+	h.completeLoginRequest(w, r, event, loginRequest, remember, amr)
+}
 
-	respLoginAccept, err := h.acceptLoginRequest(r.Context(), &formData.Email, formData.LoginChallenge, formData.Remember == "on")
+// completeLoginRequest accepts the loaded login request after all factors
+// are verified.
+func (h *Handler) completeLoginRequest(w http.ResponseWriter, r *http.Request, event audit.Event, loginRequest *flow.LoginRequest, remember bool, amr []string) {
+	logger := logging.FromContext(r.Context())
+	event.ClientID = clientID(loginRequest.Client)
+
+	if h.loginOfOtherUser(w, r, event, loginRequest) {
+		return
+	}
+
+	if h.loginAccessDenied(w, r, event, loginRequest) {
+		return
+	}
+
+	if h.loginACRUnmet(w, r, event, loginRequest, amr) {
+		return
+	}
+
+	if slices.Contains(amr, "pwd") && h.passwordExpired(w, r, event, loginRequest.Challenge) {
+		return
+	}
+
+	redirectTo, err := h.acceptLoginRequest(r.Context(), loginRequest, event.Subject, remember, amr)
 	if err != nil {
 		// if error, redirects to ...
-		log.Println("error AcceptLoginRequest", err.Error())
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		if _, err := w.Write([]byte("AcceptLoginRequest failed")); err != nil {
-			panic("unexpected error:" + err.Error())
-		}
+		logger.Error("AcceptLoginRequest failed", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "accept login request failed"
+		h.Audit.Emit(r, event)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
 		return
 	}
-	redirectUrl := *respLoginAccept.GetPayload().RedirectTo
-	if len(strings.TrimSpace(h.alt_redirect_hydra_url)) > 0 {
-		log.Println("use alt redirect url ", h.alt_redirect_hydra_url)
-		matchUrl := h.hydra_public_url
-		if len(strings.TrimSpace(h.issuerUri)) > 0 {
-			matchUrl = h.issuerUri
-		}
-		redirectUrl = strings.Replace(redirectUrl, matchUrl, h.alt_redirect_hydra_url, 1)
+	if remember {
+		h.rememberLogin(w, r, loginRequest, event.Subject, amr)
 	}
-	log.Println("after login redirect to consent: ", redirectUrl)
+	redirectUrl := h.rewriteRedirect(r, redirectTo)
+	h.Audit.Emit(r, event)
+	logger.Info("login accepted", "redirect_to", redirectUrl)
 	// then show the consent form
 	http.Redirect(w, r, redirectUrl, http.StatusFound)
 }
 
-func (h *Handler) acceptLoginRequest(ctx context.Context, subject *string, login_chalenge string, remember bool) (response *admin.AcceptLoginRequestOK, err error) {
-	loginAcceptParams := admin.NewAcceptLoginRequestParamsWithContext(ctx).WithHTTPClient(h.httpClient)
-	loginAcceptParams.SetLoginChallenge(login_chalenge)
-	loginAcceptParams.SetBody(&models.AcceptLoginRequest{
-		Subject:  subject,
-		Remember: remember,
+// loginOfOtherUser shows the login form again if the user signed in as
+// someone else than the remembered user or the user named by login_hint,
+// whose username is locked in the form. It reports whether the login was
+// refused.
+func (h *Handler) loginOfOtherUser(w http.ResponseWriter, r *http.Request, event audit.Event, loginRequest *flow.LoginRequest) bool {
+	expected := ""
+	if loginRequest.Skip {
+		expected = loginRequest.Subject
+	} else if hint := loginHint(loginRequest); hint != "" {
+		rl, _ := h.subjectRealm(event.Subject)
+		expected = rl.Subject(hint)
+	}
+	if expected == "" || expected == event.Subject {
+		return false
+	}
+
+	logging.FromContext(r.Context()).Info("login of another user", "expected", expected, "subject", event.Subject)
+	event.Outcome, event.Reason = audit.OutcomeFailure, "other user than expected"
+	h.Audit.Emit(r, event)
+
+	l := h.localizer(r)
+	_, username := h.subjectRealm(expected)
+	h.showLogin(w, r, http.StatusUnauthorized, loginRequest, map[string]interface{}{
+		"ErrorTitle":     l.T("login.other_user.title"),
+		"ErrorContent":   l.T("login.other_user.content"),
+		"Username":       username,
+		"UsernameLocked": true,
 	})
+	return true
+}
 
-	return h.HydraClient.Admin.AcceptLoginRequest(loginAcceptParams)
+// acceptLoginRequest accepts the login for the subject. amr lists the
+// authentication methods used, e.g. pwd and otp, and determine the acr.
+func (h *Handler) acceptLoginRequest(ctx context.Context, loginRequest *flow.LoginRequest, subject string, remember bool, amr []string) (redirectTo string, err error) {
+	return h.Flow.AcceptLoginRequest(ctx, loginRequest.Challenge, flow.AcceptLogin{
+		Subject:     subject,
+		Remember:    remember,
+		RememberFor: h.Remember.Login(loginRequest.Client),
+		Acr:         h.ACR.Achieved(amr),
+		AMR:         amr,
+	})
 }
 
-func (h *Handler) isUserValid(email string, password string) bool {
-	if user, err := h.UserRepo.GetUserByEmail(email); err == nil {
-		return user.Password == password
+// validUser returns the user if the password matches. Users without a
+// password can only sign in by email, registered users only once the email
+// is verified.
+func (h *Handler) validUser(ctx context.Context, subject string, password string) (*user.User, bool) {
+	if user, err := h.getUser(ctx, subject); err == nil && password != "" && user.PasswordMatches(password) && !user.PendingVerification() {
+		return user, true
 	}
-	return false
+	return nil, false
 }
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/logging"
+)
+
+func (h *Handler) logoutGet(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "logoutGet")
+	defer span.End()
+
+	logout_challenge := r.URL.Query().Get("logout_challenge")
+	r = r.WithContext(logging.WithChallenge(r.Context(), logout_challenge))
+	logger := logging.FromContext(r.Context())
+	logger.Debug("GET logout")
+
+	if logout_challenge == "" {
+		h.showErrorPage(w, r, "error.logout_challenge_missing.title", "error.logout_challenge_missing.content")
+		return
+	}
+
+	logoutRequest, err := h.Flow.GetLogoutRequest(r.Context(), logout_challenge)
+	if err != nil {
+		logger.Error("GetLogoutRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.logout.title", "error.retry")
+		return
+	}
+
+	event := audit.Event{
+		Type:     audit.EventLogout,
+		Outcome:  audit.OutcomeSuccess,
+		Subject:  logoutRequest.Subject,
+		ClientID: clientID(logoutRequest.Client),
+	}
+
+	redirectTo, err := h.Flow.AcceptLogoutRequest(r.Context(), logout_challenge)
+	if err != nil {
+		logger.Error("AcceptLogoutRequest failed", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "accept logout request failed"
+		h.Audit.Emit(r, event)
+		h.showErrorPage(w, r, "error.logout.title", "error.retry")
+		return
+	}
+
+	redirectUrl := h.rewriteRedirect(r, redirectTo)
+
+	h.Audit.Emit(r, event)
+	logger.Info("logout accepted", "redirect_to", redirectUrl)
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
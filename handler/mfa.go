@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/i18n"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/mfa"
+	"simple-login-endpoint/user"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	LoginMFAPath        = "/idp/login/mfa"
+	AccountLoginMFAPath = "/idp/account/login/mfa"
+	// mfaTicketTTL limits the time between the password and the second
+	// factor.
+	mfaTicketTTL = 5 * time.Minute
+	// MFAMaxAttempts limits the second factors tried per user within
+	// mfaTicketTTL.
+	MFAMaxAttempts = 5
+)
+
+const (
+	purposeLoginMFA        = "login_mfa"
+	purposeAccountLoginMFA = "account_login_mfa"
+)
+
+// mfaTicket carries the state of a login whose password has been verified
+// to the second factor step. It is sealed into the form, so the step does not
+// need server side state.
+type mfaTicket struct {
+	Subject string `json:"sub"`
+	// Challenge is the login challenge of an OAuth login, Next the account
+	// page to return to after an account login.
+	Challenge string        `json:"challenge,omitempty"`
+	Remember  bool          `json:"remember,omitempty"`
+	ClientID  string        `json:"client_id,omitempty"`
+	Locale    string        `json:"locale,omitempty"`
+	Next      string        `json:"next,omitempty"`
+	Ceremony  *mfa.Ceremony `json:"ceremony,omitempty"`
+	// AMR are the methods of the first factor, pwd if empty.
+	AMR []string `json:"amr,omitempty"`
+	// Expires is set when the ticket is first sealed and kept when the page
+	// is shown again, so failed attempts do not extend it.
+	Expires time.Time `json:"exp,omitempty"`
+}
+
+func (h *Handler) HandleLoginMFA(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.loginMFAPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleAccountLoginMFA(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.accountLoginMFAPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// showLoginMFA asks for the TOTP code or a passkey of the user. A new
+// passkey ceremony is started every time the page is shown. errorKey is the
+// catalog key of the error shown above the form, if any.
+func (h *Handler) showLoginMFA(w http.ResponseWriter, r *http.Request, status int, u *user.User, ticket *mfaTicket, errorKey string) {
+	logger := logging.FromContext(r.Context())
+	l := h.localizer(r)
+
+	action, purpose := LoginMFAPath, purposeLoginMFA
+	if ticket.Challenge == "" {
+		action, purpose = AccountLoginMFAPath, purposeAccountLoginMFA
+	}
+
+	data := map[string]interface{}{
+		"Action": action,
+		"TOTP":   u.TOTPSecret != "",
+	}
+
+	ticket.Ceremony = nil
+	if len(u.Passkeys) > 0 && h.Passkeys.Enabled() {
+		options, ceremony, err := h.Passkeys.BeginLogin(u)
+		if err != nil {
+			logger.Error("could not begin passkey login", "error", err)
+		} else {
+			ticket.Ceremony = ceremony
+			data["PasskeyOptions"] = string(options)
+			data["Scripts"] = []string{"passkey.js"}
+		}
+	}
+
+	if ticket.Expires.IsZero() {
+		ticket.Expires = time.Now().UTC().Add(mfaTicketTTL)
+	}
+	ttl := time.Until(ticket.Expires)
+	if ttl <= 0 {
+		h.showErrorPage(w, r, "login.mfa.expired.title", "login.mfa.expired.content")
+		return
+	}
+
+	sealed, err := h.Sessions.Seal(purpose, ticket, ttl)
+	if err != nil {
+		logger.Error("could not seal mfa ticket", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+	data["Ticket"] = sealed
+
+	if errorKey != "" {
+		data["ErrorTitle"] = l.T(errorKey + ".title")
+		data["ErrorContent"] = l.T(errorKey + ".content")
+	}
+
+	h.renderPage(w, r, status, ticket.ClientID, "login_mfa.html", data)
+}
+
+// verifySecondFactor checks the passkey assertion or the TOTP code of the
+// submitted form and returns the authentication methods used, including mfa.
+func (h *Handler) verifySecondFactor(r *http.Request, u *user.User, ticket *mfaTicket) (amr []string, ok bool) {
+	logger := logging.FromContext(r.Context())
+
+	first := ticket.AMR
+	if len(first) == 0 {
+		first = []string{"pwd"}
+	}
+	withFactor := func(factor string) []string {
+		amr := slices.Clone(first)
+		if !slices.Contains(amr, factor) {
+			amr = append(amr, factor)
+		}
+		return append(amr, "mfa")
+	}
+
+	if credential := r.FormValue("credential"); credential != "" {
+		if ticket.Ceremony == nil || !h.Passkeys.Enabled() {
+			return nil, false
+		}
+
+		passkeys, err := h.Passkeys.FinishLogin(u, *ticket.Ceremony, credential)
+		if err != nil {
+			logger.Info("invalid passkey", "error", err)
+			return nil, false
+		}
+
+		_, err = h.modifyUser(ticket.Subject, func(stored *user.User) error {
+			stored.Passkeys = updatedPasskeys(stored.Passkeys, passkeys)
+			return nil
+		})
+		if err != nil {
+			logger.Error("could not update passkey counter", "error", err)
+		}
+		return withFactor("hwk"), true
+	}
+
+	if u.TOTPSecret == "" {
+		return nil, false
+	}
+	step, valid := mfa.MatchTOTP(u.TOTPSecret, r.FormValue("code"), time.Now())
+	if !valid {
+		return nil, false
+	}
+
+	// the step is compared with the stored one while it is updated, so a
+	// code submitted twice at the same time is accepted only once
+	_, err := h.modifyUser(ticket.Subject, func(stored *user.User) error {
+		if stored.TOTPSecret != u.TOTPSecret || step <= stored.TOTPLastStep {
+			return errTOTPCodeUsed
+		}
+		stored.TOTPLastStep = step
+		return nil
+	})
+	if errors.Is(err, errTOTPCodeUsed) {
+		logger.Info("totp code used before", "subject", ticket.Subject)
+		return nil, false
+	}
+	if err != nil {
+		logger.Error("could not store the used totp step", "error", err)
+		return nil, false
+	}
+	return withFactor("otp"), true
+}
+
+// errTOTPCodeUsed rejects a TOTP code whose time step was used before.
+var errTOTPCodeUsed = errors.New("totp code used before")
+
+// updatedPasskeys replaces the stored passkeys by their updated version with
+// the same ID. Passkeys added or removed meanwhile are kept as stored.
+func updatedPasskeys(stored []user.Passkey, updated []user.Passkey) []user.Passkey {
+	passkeys := slices.Clone(stored)
+	for i, passkey := range passkeys {
+		if at := slices.IndexFunc(updated, func(p user.Passkey) bool { return p.ID == passkey.ID }); at >= 0 {
+			passkeys[i] = updated[at]
+		}
+	}
+	return passkeys
+}
+
+// mfaAttemptAllowed counts an attempt of the second factor and reports
+// whether the user has attempts left. The rejection is shown on the page.
+func (h *Handler) mfaAttemptAllowed(w http.ResponseWriter, r *http.Request, event audit.Event, u *user.User, ticket *mfaTicket) bool {
+	if h.mfaAttempts.Allow(strings.ToLower(ticket.Subject), time.Now()) {
+		return true
+	}
+
+	logging.FromContext(r.Context()).Warn("too many second factor attempts", "username", ticket.Subject)
+	event.Outcome, event.Reason = audit.OutcomeFailure, "rate limited"
+	h.Audit.Emit(r, event)
+	h.showLoginMFA(w, r, http.StatusTooManyRequests, u, ticket, "login.mfa.rate_limited")
+	return false
+}
+
+func (h *Handler) loginMFAPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "loginMFAPOST")
+	defer span.End()
+
+	var ticket mfaTicket
+	if err := h.Sessions.Open(purposeLoginMFA, r.FormValue("ticket"), &ticket); err != nil {
+		logging.FromContext(r.Context()).Info("invalid mfa ticket", "error", err)
+		h.showErrorPage(w, r, "login.mfa.expired.title", "login.mfa.expired.content")
+		return
+	}
+	if h.Messages.Supports(ticket.Locale) {
+		r = r.WithContext(i18n.WithLocale(r.Context(), ticket.Locale))
+	}
+	r = r.WithContext(logging.WithChallenge(r.Context(), ticket.Challenge))
+	logger := logging.FromContext(r.Context())
+
+	event := audit.Event{
+		Type:    audit.EventLogin,
+		Outcome: audit.OutcomeSuccess,
+		Subject: ticket.Subject,
+	}
+
+	u, err := h.getUser(r.Context(), ticket.Subject)
+	if err != nil {
+		logger.Error("user of mfa ticket not found", "error", err)
+		h.showErrorPage(w, r, "login.mfa.expired.title", "login.mfa.expired.content")
+		return
+	}
+
+	if !h.mfaAttemptAllowed(w, r, event, u, &ticket) {
+		return
+	}
+	amr, ok := h.verifySecondFactor(r, u, &ticket)
+	if !ok {
+		logger.Info("invalid second factor", "username", ticket.Subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid second factor"
+		h.Audit.Emit(r, event)
+		h.showLoginMFA(w, r, http.StatusUnauthorized, u, &ticket, "login.mfa.invalid")
+		return
+	}
+	h.mfaAttempts.Reset(strings.ToLower(ticket.Subject))
+
+	h.completeLogin(w, r, event, ticket.Challenge, ticket.Remember, amr)
+}
+
+func (h *Handler) accountLoginMFAPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "accountLoginMFAPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	logger := logging.FromContext(r.Context())
+
+	var ticket mfaTicket
+	if err := h.Sessions.Open(purposeAccountLoginMFA, r.FormValue("ticket"), &ticket); err != nil {
+		logger.Info("invalid mfa ticket", "error", err)
+		h.showErrorPage(w, r, "login.mfa.expired.title", "login.mfa.expired.content")
+		return
+	}
+
+	event := audit.Event{
+		Type:    audit.EventAccountLogin,
+		Outcome: audit.OutcomeSuccess,
+		Subject: ticket.Subject,
+	}
+
+	u, err := h.getUser(r.Context(), ticket.Subject)
+	if err != nil {
+		logger.Error("user of mfa ticket not found", "error", err)
+		h.showErrorPage(w, r, "login.mfa.expired.title", "login.mfa.expired.content")
+		return
+	}
+
+	if !h.mfaAttemptAllowed(w, r, event, u, &ticket) {
+		return
+	}
+	if _, ok := h.verifySecondFactor(r, u, &ticket); !ok {
+		logger.Info("invalid second factor for account", "username", ticket.Subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid second factor"
+		h.Audit.Emit(r, event)
+		h.showLoginMFA(w, r, http.StatusUnauthorized, u, &ticket, "login.mfa.invalid")
+		return
+	}
+	h.mfaAttempts.Reset(strings.ToLower(ticket.Subject))
+
+	h.startAccountSession(w, r, event, accountNext(ticket.Next))
+}
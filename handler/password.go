@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/mail"
+	"simple-login-endpoint/user"
+	"strings"
+	"time"
+)
+
+const (
+	PasswordForgotPath = "/idp/password/forgot"
+	PasswordResetPath  = "/idp/password/reset"
+
+	purposePasswordReset = "password_reset"
+)
+
+// resetToken is sent by mail. The fingerprint of the current password makes
+// the token single-use: it becomes invalid once the password is changed.
+type resetToken struct {
+	Subject     string `json:"sub"`
+	Fingerprint string `json:"fp"`
+	// Challenge is the login challenge the user returns to after the reset.
+	Challenge string `json:"challenge,omitempty"`
+	// Expired is set when the token was not sent by mail but issued at the
+	// login because the password is older than the maximum age.
+	Expired bool `json:"expired,omitempty"`
+}
+
+func (h *Handler) HandlePasswordForgot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.passwordForgotGet(w, r)
+	case http.MethodPost:
+		h.passwordForgotPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.passwordResetGet(w, r)
+	case http.MethodPost:
+		h.passwordResetPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// passwordResetEnabled reports whether reset links can be sent, which needs a
+// mail transport and the public URL. The link must not be built from the
+// Host header of the request, otherwise an attacker could point the link to
+// a server they control.
+func (h *Handler) passwordResetEnabled() bool {
+	return h.publicURL != "" && h.Mailer != nil
+}
+
+func (h *Handler) passwordForgotGet(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordResetEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	r = h.withAccountLocale(r)
+	h.renderPage(w, r, http.StatusOK, "", "password_forgot.html", map[string]interface{}{
+		"LoginChallenge": r.URL.Query().Get("login_challenge"),
+	})
+}
+
+// passwordForgotPOST shows the same page whether the user exists or not, so
+// the form can not be used to find out registered emails.
+func (h *Handler) passwordForgotPOST(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordResetEnabled() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	r, span := h.startSpan(r, "passwordForgotPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	email := strings.TrimSpace(r.FormValue("email"))
+	challenge := r.FormValue("login_challenge")
+	r, rl, ok := h.loginRealm(w, r, challenge)
+	if !ok {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+
+	event := audit.Event{
+		Type:    audit.EventPasswordResetRequested,
+		Outcome: audit.OutcomeSuccess,
+		Subject: rl.Subject(email),
+	}
+
+	if !h.mailSends.Allow(strings.ToLower(email), time.Now()) {
+		logger.Warn("password reset rate limited", "username", email)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "rate limited"
+		h.Audit.Emit(r, event)
+		l := h.localizer(r)
+		h.renderPage(w, r, http.StatusTooManyRequests, "", "password_forgot.html", map[string]interface{}{
+			"LoginChallenge": challenge,
+			"ErrorTitle":     l.T("mail.rate_limited.title"),
+			"ErrorContent":   l.T("mail.rate_limited.content"),
+		})
+		return
+	}
+
+	if u, err := h.getUser(r.Context(), event.Subject); err != nil {
+		logger.Info("password reset for unknown user", "username", event.Subject)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "unknown user"
+	} else if err := h.sendResetLink(r, event.Subject, u, challenge); err != nil {
+		logger.Error("could not send password reset link", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "mail delivery failed"
+	}
+	h.Audit.Emit(r, event)
+
+	h.renderPage(w, r, http.StatusOK, "", "password_forgot.html", map[string]interface{}{
+		"LoginChallenge": challenge,
+		"Sent":           true,
+	})
+}
+
+func (h *Handler) sendResetLink(r *http.Request, subject string, u *user.User, challenge string) error {
+	token, err := h.Sessions.Seal(purposePasswordReset, &resetToken{
+		Subject:     subject,
+		Fingerprint: h.Sessions.Fingerprint(u.Password),
+		Challenge:   challenge,
+	}, h.passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	l := h.localizer(r)
+	link := h.publicURL + PasswordResetPath + "?token=" + url.QueryEscape(token)
+	return h.Mailer.Send(r.Context(), mail.Message{
+		To:      u.Email,
+		Subject: l.T("mail.password_reset.subject"),
+		Body:    l.T("mail.password_reset.body", link, int(h.passwordResetTTL/time.Minute)),
+	})
+}
+
+// openResetToken returns the user of a valid token. The error page is
+// rendered otherwise.
+func (h *Handler) openResetToken(w http.ResponseWriter, r *http.Request, token string) (*resetToken, *user.User, bool) {
+	logger := logging.FromContext(r.Context())
+
+	var reset resetToken
+	if err := h.Sessions.Open(purposePasswordReset, token, &reset); err != nil {
+		logger.Info("invalid password reset token", "error", err)
+		h.showErrorPage(w, r, "password_reset.invalid.title", "password_reset.invalid.content")
+		return nil, nil, false
+	}
+
+	u, err := h.getUser(r.Context(), reset.Subject)
+	if err != nil || h.Sessions.Fingerprint(u.Password) != reset.Fingerprint {
+		logger.Info("password reset token already used", "subject", reset.Subject)
+		h.showErrorPage(w, r, "password_reset.invalid.title", "password_reset.invalid.content")
+		return nil, nil, false
+	}
+	return &reset, u, true
+}
+
+func (h *Handler) passwordResetGet(w http.ResponseWriter, r *http.Request) {
+	r = h.withAccountLocale(r)
+	token := r.URL.Query().Get("token")
+	reset, _, ok := h.openResetToken(w, r, token)
+	if !ok {
+		return
+	}
+	r = h.withSubjectRealm(r, reset.Subject)
+
+	h.renderPage(w, r, http.StatusOK, "", "password_reset.html", map[string]interface{}{
+		"Token":   token,
+		"Expired": reset.Expired,
+	})
+}
+
+func (h *Handler) passwordResetPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "passwordResetPOST")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	logger := logging.FromContext(r.Context())
+	token := r.FormValue("token")
+
+	reset, u, ok := h.openResetToken(w, r, token)
+	if !ok {
+		return
+	}
+	r = h.withSubjectRealm(r, reset.Subject)
+
+	event := audit.Event{
+		Type:    audit.EventPasswordReset,
+		Outcome: audit.OutcomeSuccess,
+		Subject: reset.Subject,
+	}
+
+	l := h.localizer(r)
+	newPassword := r.FormValue("new_password")
+	updated := *u
+	// keeping the password would keep the token valid as well
+	errorContent := ""
+	if newPassword == "" || newPassword != r.FormValue("new_password_confirm") {
+		errorContent = l.T("account.password.mismatch")
+	} else if u.PasswordMatches(newPassword) {
+		errorContent = l.T("password_reset.unchanged")
+	} else if err := h.passwordPolicy(reset.Subject).Set(&updated, newPassword, time.Now()); err != nil {
+		errorContent = passwordViolation(l, err)
+	}
+	if errorContent != "" {
+		h.renderPage(w, r, http.StatusBadRequest, "", "password_reset.html", map[string]interface{}{
+			"Token":        token,
+			"Expired":      reset.Expired,
+			"ErrorTitle":   l.T("account.password.error.title"),
+			"ErrorContent": errorContent,
+		})
+		return
+	}
+
+	setPassword := unchangedPassword(u, &updated)
+	_, err := h.modifyUser(reset.Subject, func(stored *user.User) error {
+		if !reset.Expired {
+			// the link was received, so the user owns the email
+			stored.EmailVerified = true
+		}
+		return setPassword(stored)
+	})
+	if err != nil {
+		logger.Error("could not reset password", "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "update user failed"
+		h.Audit.Emit(r, event)
+		h.showErrorPage(w, r, "account.password.error.title", "error.retry")
+		return
+	}
+	h.Audit.Emit(r, event)
+	logger.Info("password reset", "subject", reset.Subject)
+
+	// continue the OAuth login the user started before the reset
+	if reset.Challenge != "" {
+		http.Redirect(w, r, "/idp/login?login_challenge="+url.QueryEscape(reset.Challenge), http.StatusSeeOther)
+		return
+	}
+
+	h.renderPage(w, r, http.StatusOK, "", "password_reset.html", map[string]interface{}{
+		"Done": true,
+	})
+}
+
+// passwordExpired sends a user whose password is older than the maximum age
+// to the reset page instead of completing the login. The login continues
+// with the new password.
+func (h *Handler) passwordExpired(w http.ResponseWriter, r *http.Request, event audit.Event, challenge string) bool {
+	u, err := h.getUser(r.Context(), event.Subject)
+	if err != nil || !h.passwordPolicy(event.Subject).Expired(u, time.Now()) {
+		return false
+	}
+	logger := logging.FromContext(r.Context())
+
+	token, err := h.Sessions.Seal(purposePasswordReset, &resetToken{
+		Subject:     event.Subject,
+		Fingerprint: h.Sessions.Fingerprint(u.Password),
+		Challenge:   challenge,
+		Expired:     true,
+	}, h.passwordResetTTL)
+	if err != nil {
+		logger.Error("could not seal password reset token", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return true
+	}
+
+	event.Outcome, event.Reason = audit.OutcomeFailure, "password expired"
+	h.Audit.Emit(r, event)
+	logger.Info("password expired", "subject", event.Subject)
+	http.Redirect(w, r, PasswordResetPath+"?token="+url.QueryEscape(token), http.StatusSeeOther)
+	return true
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/logging"
+)
+
+// loginRequired and consentRequired are sent to a client that requested
+// prompt=none when the user would have to sign in or consent.
+var (
+	loginRequired = flow.Rejection{
+		Error:            "login_required",
+		ErrorDescription: "The user has to sign in, but the client requested prompt=none",
+		StatusCode:       http.StatusUnauthorized,
+	}
+	consentRequired = flow.Rejection{
+		Error:            "consent_required",
+		ErrorDescription: "The user has to consent, but the client requested prompt=none",
+		StatusCode:       http.StatusForbidden,
+	}
+)
+
+// rejectLoginWithoutPrompt rejects the login request with login_required and
+// sends the browser back to the client, since no page may be shown.
+func (h *Handler) rejectLoginWithoutPrompt(w http.ResponseWriter, r *http.Request, event audit.Event, loginRequest *flow.LoginRequest, reason string) {
+	redirectTo, err := h.Flow.RejectLoginRequest(r.Context(), loginRequest.Challenge, loginRequired)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("RejectLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+	h.redirectWithoutPrompt(w, r, event, reason, redirectTo)
+}
+
+// rejectConsentWithoutPrompt rejects the consent request with
+// consent_required and sends the browser back to the client.
+func (h *Handler) rejectConsentWithoutPrompt(w http.ResponseWriter, r *http.Request, consentChallenge string, consentRequest *flow.ConsentRequest) {
+	redirectTo, err := h.Flow.RejectConsentRequest(r.Context(), consentChallenge, consentRequired)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("RejectConsentRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return
+	}
+	h.redirectWithoutPrompt(w, r, consentEvent(consentRequest, audit.EventConsentRejected), "consent required", redirectTo)
+}
+
+func (h *Handler) redirectWithoutPrompt(w http.ResponseWriter, r *http.Request, event audit.Event, reason string, redirectTo string) {
+	event.Outcome, event.Reason = audit.OutcomeFailure, "prompt=none: "+reason
+	h.Audit.Emit(r, event)
+
+	redirectUrl := h.rewriteRedirect(r, redirectTo)
+	logging.FromContext(r.Context()).Info("interaction required but prompt=none", "reason", reason, "redirect_to", redirectUrl)
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+// showSelectAccount lets the user continue with the remembered account or
+// start a new login with another account.
+func (h *Handler) showSelectAccount(w http.ResponseWriter, r *http.Request, loginRequest *flow.LoginRequest) {
+	_, email := h.subjectRealm(loginRequest.Subject)
+	h.renderPage(w, r, http.StatusOK, clientID(loginRequest.Client), "login_select_account.html", map[string]interface{}{
+		"LoginChallenge": loginRequest.Challenge,
+		"Username":       email,
+		"SwitchURL":      h.rewriteRedirect(r, loginRequest.SwitchAccountURL()),
+	})
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/realm"
+	"simple-login-endpoint/user"
+)
+
+// realm returns the realm of the name. The default realm "" consists of the
+// users, groups and password policy of the handler.
+func (h *Handler) realm(name string) (*realm.Realm, bool) {
+	if name == "" {
+		return &realm.Realm{Users: h.UserRepo, Groups: h.GroupRepo, Passwords: h.Passwords}, true
+	}
+	return h.Realms.Get(name)
+}
+
+// subjectRealm returns the realm and the email of a subject.
+func (h *Handler) subjectRealm(subject string) (*realm.Realm, string) {
+	name, email := h.Realms.Split(subject)
+	rl, _ := h.realm(name)
+	return rl, email
+}
+
+// selectRealm returns the realm for a login of the client on the host of the
+// request. It fails if the client metadata names an unknown realm.
+func (h *Handler) selectRealm(r *http.Request, client *flow.Client) (*realm.Realm, bool) {
+	return h.realm(h.Realms.Select(client, r.Host))
+}
+
+// requestRealm selects the realm for the client and remembers it for the
+// theme of the pages. The error page is rendered if there is no such realm.
+func (h *Handler) requestRealm(w http.ResponseWriter, r *http.Request, client *flow.Client) (*http.Request, *realm.Realm, bool) {
+	rl, ok := h.selectRealm(r, client)
+	if !ok {
+		logging.FromContext(r.Context()).Error("unknown realm of client", "client_id", clientID(client))
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return r, nil, false
+	}
+	return r.WithContext(realm.WithName(r.Context(), rl.Name)), rl, true
+}
+
+// loginRealm returns the realm of the client of the login challenge, or of
+// the host without a challenge. The login request is only loaded if there
+// are realms besides the default one.
+func (h *Handler) loginRealm(w http.ResponseWriter, r *http.Request, challenge string) (*http.Request, *realm.Realm, bool) {
+	if h.Realms.Empty() {
+		rl, _ := h.realm("")
+		return r, rl, true
+	}
+	if challenge == "" {
+		return h.requestRealm(w, r, nil)
+	}
+
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), challenge)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("GetLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return r, nil, false
+	}
+	return h.requestRealm(w, r, loginRequest.Client)
+}
+
+// withSubjectRealm uses the theme of the realm of the subject for the pages
+// reached by a link from a mail, which are not bound to a client.
+func (h *Handler) withSubjectRealm(r *http.Request, subject string) *http.Request {
+	name, _ := h.Realms.Split(subject)
+	return r.WithContext(realm.WithName(r.Context(), name))
+}
+
+// realmTheme returns the theme name of the realm selected for the request,
+// or of the realm of the host if none was selected.
+func (h *Handler) realmTheme(r *http.Request) string {
+	name, found := realm.NameFromContext(r.Context())
+	if !found {
+		name = h.Realms.Select(nil, r.Host)
+	}
+	if rl, ok := h.realm(name); ok {
+		return rl.Theme
+	}
+	return ""
+}
+
+// modifyUser changes the user of the subject with modify, which gets a copy
+// of the stored user. Changes of other requests are not overwritten.
+func (h *Handler) modifyUser(subject string, modify func(u *user.User) error) (*user.User, error) {
+	rl, email := h.subjectRealm(subject)
+	return rl.Users.ModifyUser(email, modify)
+}
+
+// errUserChanged is returned by a modification that found the user changed
+// since it was loaded.
+var errUserChanged = errors.New("user changed by another request")
+
+// unchangedPassword returns a modification that sets the password of
+// updated, unless the password was changed since u was loaded.
+func unchangedPassword(u *user.User, updated *user.User) func(stored *user.User) error {
+	return func(stored *user.User) error {
+		if stored.Password != u.Password {
+			return errUserChanged
+		}
+		stored.Password = updated.Password
+		stored.PasswordHistory = updated.PasswordHistory
+		stored.PasswordChangedAt = updated.PasswordChangedAt
+		return nil
+	}
+}
+
+func (h *Handler) passwordPolicy(subject string) *password.Policy {
+	rl, _ := h.subjectRealm(subject)
+	return rl.Passwords
+}
+
+// realmDenied returns why the subject may not log in to the client because
+// of its realm, or an empty string.
+func (h *Handler) realmDenied(r *http.Request, client *flow.Client, subject string) string {
+	rl, _ := h.subjectRealm(subject)
+	if selected, ok := h.selectRealm(r, client); !ok || selected.Name != rl.Name {
+		return "subject of another realm"
+	}
+	if !rl.AllowsClient(clientID(client)) {
+		return "client not allowed in realm"
+	}
+	return ""
+}
@@ -0,0 +1,310 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/i18n"
+	"simple-login-endpoint/logging"
+	idpmail "simple-login-endpoint/mail"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/user"
+	"strings"
+	"time"
+)
+
+const (
+	RegisterPath       = "/idp/register"
+	RegisterVerifyPath = "/idp/register/verify"
+
+	purposeEmailVerification = "email_verification"
+	// emailVerificationTTL is the validity of the link sent after the
+	// registration.
+	emailVerificationTTL = 24 * time.Hour
+)
+
+// verificationToken is sent by mail to confirm the email of a new user.
+type verificationToken struct {
+	Subject string `json:"sub"`
+	// Challenge is the login challenge the user returns to after the
+	// confirmation.
+	Challenge string `json:"challenge,omitempty"`
+	// Fingerprint of the password the link was sent for, so the link does
+	// not verify an account registered again with another password.
+	Fingerprint string `json:"fp"`
+}
+
+func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.registerGet(w, r)
+	case http.MethodPost:
+		h.registerPOST(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) HandleRegisterVerify(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.registerVerifyGet(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// registrationEnabled reports whether users may register for the client. Like
+// password reset links, the verification link needs the public URL.
+func (h *Handler) registrationEnabled(client *flow.Client) bool {
+	return h.publicURL != "" && h.Mailer != nil && h.Registration.Allowed(client)
+}
+
+// challengeClient returns the client of the login challenge, whose settings
+// and theme apply to the pages next to the login form. Without a challenge
+// the client is nil and the global settings apply. The error page is rendered
+// if the login request can not be loaded.
+func (h *Handler) challengeClient(w http.ResponseWriter, r *http.Request, challenge string) (*http.Request, *flow.Client, bool) {
+	if challenge == "" {
+		return h.withAccountLocale(r), nil, true
+	}
+
+	r = r.WithContext(logging.WithChallenge(r.Context(), challenge))
+	loginRequest, err := h.Flow.GetLoginRequest(r.Context(), challenge)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("GetLoginRequest failed", "error", err)
+		h.showErrorPage(w, r, "error.flow_start.title", "error.retry")
+		return r, nil, false
+	}
+	return h.withLocale(r, loginRequest.OIDCContext), loginRequest.Client, true
+}
+
+func (h *Handler) registerGet(w http.ResponseWriter, r *http.Request) {
+	challenge := r.URL.Query().Get("login_challenge")
+	r, client, ok := h.challengeClient(w, r, challenge)
+	if !ok {
+		return
+	}
+	if !h.registrationEnabled(client) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	h.renderPage(w, r, http.StatusOK, clientID(client), "register.html", map[string]interface{}{
+		"LoginChallenge": challenge,
+	})
+}
+
+// registerPOST shows the same page whether the email is already registered or
+// not, so the form can not be used to find out registered emails. The owner
+// of an existing account gets a mail instead.
+func (h *Handler) registerPOST(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "registerPOST")
+	defer span.End()
+
+	challenge := r.FormValue("login_challenge")
+	r, client, ok := h.challengeClient(w, r, challenge)
+	if !ok {
+		return
+	}
+	if !h.registrationEnabled(client) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r, rl, ok := h.requestRealm(w, r, client)
+	if !ok {
+		return
+	}
+	logger := logging.FromContext(r.Context())
+	l := h.localizer(r)
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	newPassword := r.FormValue("password")
+	subject := rl.Subject(email)
+
+	event := audit.Event{
+		Type:     audit.EventRegistered,
+		Outcome:  audit.OutcomeSuccess,
+		Subject:  subject,
+		ClientID: clientID(client),
+	}
+
+	newUser := &user.User{Email: email, Locale: l.Locale(), Registered: true}
+	errorContent := ""
+	if !validEmail(email) {
+		errorContent = l.T("register.invalid_email")
+	} else if !h.Registration.DomainAllowed(client, email) {
+		errorContent = l.T("register.domain_not_allowed")
+	} else if newPassword != r.FormValue("password_confirm") {
+		errorContent = l.T("account.password.mismatch")
+	} else if err := rl.Passwords.Set(newUser, newPassword, time.Now()); err != nil {
+		errorContent = passwordViolation(l, err)
+	}
+	if errorContent != "" {
+		logger.Info("registration rejected", "username", email, "reason", errorContent)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "invalid registration"
+		h.Audit.Emit(r, event)
+		h.renderPage(w, r, http.StatusBadRequest, clientID(client), "register.html", map[string]interface{}{
+			"LoginChallenge": challenge,
+			"Email":          email,
+			"ErrorTitle":     l.T("register.error.title"),
+			"ErrorContent":   errorContent,
+		})
+		return
+	}
+
+	if !h.mailSends.Allow(strings.ToLower(email), time.Now()) {
+		logger.Warn("registration rate limited", "username", email)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "rate limited"
+		h.Audit.Emit(r, event)
+		h.renderPage(w, r, http.StatusTooManyRequests, clientID(client), "register.html", map[string]interface{}{
+			"LoginChallenge": challenge,
+			"Email":          email,
+			"ErrorTitle":     l.T("mail.rate_limited.title"),
+			"ErrorContent":   l.T("mail.rate_limited.content"),
+		})
+		return
+	}
+
+	if err := rl.Users.AddUser(newUser); err != nil {
+		logger.Info("registration of existing user", "username", subject, "error", err)
+		event.Outcome, event.Reason = audit.OutcomeFailure, "user exists"
+		if err := h.notifyExistingUser(r, subject, challenge); err != nil {
+			logger.Error("could not notify existing user", "error", err)
+		}
+	} else if err := h.sendVerificationLink(r, subject, newUser, challenge); err != nil {
+		logger.Error("could not send verification link", "error", err)
+	}
+	h.Audit.Emit(r, event)
+
+	h.renderPage(w, r, http.StatusOK, clientID(client), "register.html", map[string]interface{}{
+		"LoginChallenge": challenge,
+		"Sent":           true,
+	})
+}
+
+// notifyExistingUser tells the owner of the email that the account already
+// exists. A registration that was not verified yet may have been made by
+// someone else: its password is removed, so earlier verification links
+// become invalid, and the owner gets a reset link to choose the password.
+func (h *Handler) notifyExistingUser(r *http.Request, subject string, challenge string) error {
+	u, err := h.getUser(r.Context(), subject)
+	if err != nil {
+		return err
+	}
+	if u.PendingVerification() {
+		updated, err := h.modifyUser(subject, func(stored *user.User) error {
+			stored.Password = ""
+			stored.PasswordHistory = nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return h.sendResetLink(r, subject, updated, challenge)
+	}
+
+	l := h.localizer(r)
+	return h.Mailer.Send(r.Context(), idpmail.Message{
+		To:      u.Email,
+		Subject: l.T("mail.register_exists.subject"),
+		Body:    l.T("mail.register_exists.body", h.publicURL+PasswordForgotPath),
+	})
+}
+
+func (h *Handler) sendVerificationLink(r *http.Request, subject string, u *user.User, challenge string) error {
+	token, err := h.Sessions.Seal(purposeEmailVerification, &verificationToken{
+		Subject:     subject,
+		Challenge:   challenge,
+		Fingerprint: h.Sessions.Fingerprint(u.Password),
+	}, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	l := h.localizer(r)
+	link := h.publicURL + RegisterVerifyPath + "?token=" + url.QueryEscape(token)
+	return h.Mailer.Send(r.Context(), idpmail.Message{
+		To:      u.Email,
+		Subject: l.T("mail.verify_email.subject"),
+		Body:    l.T("mail.verify_email.body", link, int(emailVerificationTTL/time.Hour)),
+	})
+}
+
+func (h *Handler) registerVerifyGet(w http.ResponseWriter, r *http.Request) {
+	r, span := h.startSpan(r, "registerVerifyGet")
+	defer span.End()
+
+	r = h.withAccountLocale(r)
+	logger := logging.FromContext(r.Context())
+
+	var verification verificationToken
+	if err := h.Sessions.Open(purposeEmailVerification, r.URL.Query().Get("token"), &verification); err != nil {
+		logger.Info("invalid verification token", "error", err)
+		h.showErrorPage(w, r, "register.verify_invalid.title", "register.verify_invalid.content")
+		return
+	}
+	r = h.withSubjectRealm(r, verification.Subject)
+
+	event := audit.Event{
+		Type:    audit.EventEmailVerified,
+		Outcome: audit.OutcomeSuccess,
+		Subject: verification.Subject,
+	}
+
+	u, err := h.getUser(r.Context(), verification.Subject)
+	if err != nil || h.Sessions.Fingerprint(u.Password) != verification.Fingerprint {
+		logger.Info("user of verification token not found or registered again", "subject", verification.Subject)
+		h.showErrorPage(w, r, "register.verify_invalid.title", "register.verify_invalid.content")
+		return
+	}
+
+	if !u.EmailVerified {
+		_, err := h.modifyUser(verification.Subject, func(stored *user.User) error {
+			if stored.Password != u.Password {
+				return errUserChanged
+			}
+			stored.EmailVerified = true
+			return nil
+		})
+		if err != nil {
+			logger.Error("could not verify email", "error", err)
+			event.Outcome, event.Reason = audit.OutcomeFailure, "update user failed"
+			h.Audit.Emit(r, event)
+			h.showErrorPage(w, r, "register.verify_invalid.title", "error.retry")
+			return
+		}
+		h.Audit.Emit(r, event)
+		logger.Info("email verified", "subject", verification.Subject)
+	}
+
+	// continue the OAuth login the user started before the registration
+	if verification.Challenge != "" {
+		http.Redirect(w, r, "/idp/login?login_challenge="+url.QueryEscape(verification.Challenge), http.StatusSeeOther)
+		return
+	}
+
+	h.renderPage(w, r, http.StatusOK, "", "register.html", map[string]interface{}{
+		"Verified": true,
+	})
+}
+
+// validEmail accepts a plain address like user@example.com, without display
+// name or comments.
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
+// passwordViolation returns the message of a password rejected by the
+// password policy.
+func passwordViolation(l *i18n.Localizer, err error) string {
+	var violation *password.Violation
+	if errors.As(err, &violation) {
+		return l.T(violation.Key, violation.Args...)
+	}
+	return l.T("error.retry")
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"net/http"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/logging"
+	"time"
+)
+
+const (
+	// LoginACRCookie remembers the authentication methods of a remembered
+	// login, since Hydra does not tell them when it skips the login.
+	LoginACRCookie     = "idp_login_acr"
+	LoginACRCookiePath = "/idp/login"
+	// rememberedLoginTTL is the validity of the cookie if Hydra remembers the
+	// login for the browser session.
+	rememberedLoginTTL = 24 * time.Hour
+)
+
+const purposeRememberedLogin = "remembered_login"
+
+// unmetAuthentication is sent to the client when the login did not reach the
+// level requested with acr_values.
+var unmetAuthentication = flow.Rejection{
+	Error:            "unmet_authentication_requirements",
+	ErrorDescription: "The login did not reach the requested authentication level",
+	StatusCode:       http.StatusForbidden,
+}
+
+type rememberedLogin struct {
+	Subject   string    `json:"sub"`
+	SessionID string    `json:"sid,omitempty"`
+	AMR       []string  `json:"amr"`
+	AuthTime  time.Time `json:"auth_time"`
+}
+
+// requiredACR returns the level the client requested with acr_values, or an
+// empty string.
+func (h *Handler) requiredACR(loginRequest *flow.LoginRequest) string {
+	if loginRequest.OIDCContext == nil {
+		return ""
+	}
+	return h.ACR.Required(loginRequest.OIDCContext.AcrValues)
+}
+
+// rememberLogin stores the authentication methods of a login Hydra
+// remembers, so a later skipped login can be checked against the requested
+// level.
+func (h *Handler) rememberLogin(w http.ResponseWriter, r *http.Request, loginRequest *flow.LoginRequest, subject string, amr []string) {
+	ttl := time.Duration(h.Remember.Login(loginRequest.Client)) * time.Second
+	if ttl == 0 {
+		ttl = rememberedLoginTTL
+	}
+
+	remembered := rememberedLogin{Subject: subject, SessionID: loginRequest.SessionID, AMR: amr, AuthTime: time.Now().UTC()}
+	if err := h.Sessions.SealCookie(w, LoginACRCookie, LoginACRCookiePath, purposeRememberedLogin, remembered, ttl); err != nil {
+		logging.FromContext(r.Context()).Error("could not remember login", "error", err)
+	}
+}
+
+// loadRememberedLogin returns the remembered login of the request, or nil if
+// it is unknown.
+func (h *Handler) loadRememberedLogin(r *http.Request, loginRequest *flow.LoginRequest) *rememberedLogin {
+	var remembered rememberedLogin
+	if err := h.Sessions.OpenCookie(r, LoginACRCookie, purposeRememberedLogin, &remembered); err != nil {
+		return nil
+	}
+	if remembered.Subject != loginRequest.Subject || remembered.SessionID != loginRequest.SessionID {
+		return nil
+	}
+	return &remembered
+}
+
+// reauthentication returns why the user has to enter the credentials again
+// although Hydra remembers the login, or an empty reason. notice is the
+// catalog key of the hint shown above the login form.
+func (h *Handler) reauthentication(loginRequest *flow.LoginRequest, remembered *rememberedLogin) (reason string, notice string) {
+	if loginRequest.HasPrompt(flow.PromptLogin) {
+		return "prompt=login", "login.reauthenticate"
+	}
+	if maxAge, found := loginRequest.RequestedMaxAge(); found && (remembered == nil || time.Since(remembered.AuthTime) > maxAge) {
+		return "max_age exceeded", "login.reauthenticate"
+	}
+
+	var amr []string
+	if remembered != nil {
+		amr = remembered.AMR
+	}
+	if required := h.requiredACR(loginRequest); !h.ACR.Satisfied(required, amr) {
+		return "acr " + required + " not reached", "login.step_up"
+	}
+	return "", ""
+}
+
+// loginACRUnmet rejects the login request if the authentication methods do
+// not reach the level the client requested. It reports whether the request
+// was rejected.
+func (h *Handler) loginACRUnmet(w http.ResponseWriter, r *http.Request, event audit.Event, loginRequest *flow.LoginRequest, amr []string) bool {
+	logger := logging.FromContext(r.Context())
+
+	required := h.requiredACR(loginRequest)
+	if h.ACR.Satisfied(required, amr) {
+		return false
+	}
+
+	redirectTo, err := h.Flow.RejectLoginRequest(r.Context(), loginRequest.Challenge, unmetAuthentication)
+	if err != nil {
+		logger.Error("RejectLoginRequest failed", "error", err)
+	}
+
+	event.Outcome, event.Reason = audit.OutcomeFailure, "acr "+required+" not reached"
+	h.Audit.Emit(r, event)
+	logger.Info("authentication level not reached", "acr", required, "amr", amr)
+
+	continueURL := ""
+	if redirectTo != "" {
+		continueURL = h.rewriteRedirect(r, redirectTo)
+	}
+
+	l := h.localizer(r)
+	h.renderPage(w, r, http.StatusForbidden, clientID(loginRequest.Client), "error.html", map[string]interface{}{
+		"ErrorTitle":   l.T("error.acr_unmet.title"),
+		"ErrorContent": l.T("error.acr_unmet.content"),
+		"ContinueURL":  continueURL,
+	})
+	return true
+}
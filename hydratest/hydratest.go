@@ -0,0 +1,625 @@
+// Package hydratest provides an in-process fake of the Hydra admin API for
+// tests. Login, consent and logout requests are scripted by the test, the
+// handlers accept or reject them through the admin API of Hydra 1.x or 2.x
+// and the test inspects what has been sent to Hydra.
+package hydratest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"simple-login-endpoint/flow"
+	"sync"
+	"time"
+
+	hydra "github.com/ory/hydra-client-go/client"
+	"github.com/ory/hydra-client-go/models"
+)
+
+// Server is a fake Hydra admin (and health) endpoint.
+type Server struct {
+	*httptest.Server
+
+	mu              sync.Mutex
+	sequence        int
+	loginRequests   map[string]*models.LoginRequest
+	consentRequests map[string]*models.ConsentRequest
+	logoutRequests  map[string]*models.LogoutRequest
+	clients         map[string]*models.OAuth2Client
+
+	// results of the handled requests by challenge
+	acceptedLogins   map[string]*models.AcceptLoginRequest
+	acceptedAMR      map[string][]string
+	acceptedConsents map[string]*models.AcceptConsentRequest
+	acceptedLogouts  map[string]bool
+	rejected         map[string]*models.RejectRequest
+	handledAt        map[string]time.Time
+	revoked          map[string]bool
+}
+
+func NewServer() *Server {
+	s := &Server{
+		loginRequests:    make(map[string]*models.LoginRequest),
+		consentRequests:  make(map[string]*models.ConsentRequest),
+		logoutRequests:   make(map[string]*models.LogoutRequest),
+		clients:          make(map[string]*models.OAuth2Client),
+		acceptedLogins:   make(map[string]*models.AcceptLoginRequest),
+		acceptedAMR:      make(map[string][]string),
+		acceptedConsents: make(map[string]*models.AcceptConsentRequest),
+		acceptedLogouts:  make(map[string]bool),
+		rejected:         make(map[string]*models.RejectRequest),
+		handledAt:        make(map[string]time.Time),
+		revoked:          make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health/ready", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+
+	// Hydra 1.x serves the admin API at the root, Hydra 2.x below /admin
+	for _, prefix := range []string{"", "/admin"} {
+		mux.HandleFunc("GET "+prefix+"/oauth2/auth/requests/login", s.getLogin)
+		mux.HandleFunc("PUT "+prefix+"/oauth2/auth/requests/login/accept", s.acceptLogin)
+		mux.HandleFunc("PUT "+prefix+"/oauth2/auth/requests/login/reject", s.reject("login_challenge"))
+
+		mux.HandleFunc("GET "+prefix+"/oauth2/auth/requests/consent", s.getConsent)
+		mux.HandleFunc("PUT "+prefix+"/oauth2/auth/requests/consent/accept", s.acceptConsent)
+		mux.HandleFunc("PUT "+prefix+"/oauth2/auth/requests/consent/reject", s.reject("consent_challenge"))
+
+		mux.HandleFunc("GET "+prefix+"/oauth2/auth/requests/logout", s.getLogout)
+		mux.HandleFunc("PUT "+prefix+"/oauth2/auth/requests/logout/accept", s.acceptLogout)
+		mux.HandleFunc("PUT "+prefix+"/oauth2/auth/requests/logout/reject", s.rejectLogout)
+
+		mux.HandleFunc("GET "+prefix+"/oauth2/auth/sessions/consent", s.listConsentSessions)
+		mux.HandleFunc("DELETE "+prefix+"/oauth2/auth/sessions/consent", s.revokeConsentSessions)
+
+		mux.HandleFunc("GET "+prefix+"/clients", s.listClients)
+		mux.HandleFunc("POST "+prefix+"/clients", s.createClient)
+		mux.HandleFunc("GET "+prefix+"/clients/{id}", s.getClient)
+		mux.HandleFunc("PUT "+prefix+"/clients/{id}", s.updateClient)
+		mux.HandleFunc("DELETE "+prefix+"/clients/{id}", s.deleteClient)
+	}
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns an SDK client talking to the fake.
+func (s *Server) Client() *hydra.OryHydra {
+	serverURL, _ := url.Parse(s.URL)
+	return hydra.NewHTTPClientWithConfig(nil, &hydra.TransportConfig{
+		Schemes: []string{serverURL.Scheme},
+		Host:    serverURL.Host,
+	})
+}
+
+// Backend returns the flow backend of the given Hydra API version talking to
+// the fake.
+func (s *Server) Backend(apiVersion string) flow.FlowBackend {
+	return flow.Must(flow.New(apiVersion, s.URL, flow.NewHTTPClient()))
+}
+
+func (s *Server) nextChallenge(prefix string) string {
+	s.sequence++
+	return fmt.Sprintf("%s-%d", prefix, s.sequence)
+}
+
+// AddClient registers a client which is then returned by the clients API and
+// can be referenced by login and consent requests.
+func (s *Server) AddClient(client *models.OAuth2Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clients[client.ClientID] = client
+}
+
+// ClientByID returns a registered client.
+func (s *Server) ClientByID(clientID string) (*models.OAuth2Client, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, found := s.clients[clientID]
+	return client, found
+}
+
+func (s *Server) clientOrDefault(clientID string) *models.OAuth2Client {
+	if client, found := s.clients[clientID]; found {
+		return client
+	}
+	return &models.OAuth2Client{ClientID: clientID, ClientName: clientID}
+}
+
+// LoginOptions describe a login request as Hydra would create it for an
+// authorization request of the client.
+type LoginOptions struct {
+	ClientID    string
+	Scopes      []string
+	Skip        bool
+	Subject     string
+	OidcContext *models.OpenIDConnectContext
+	// Params are added to the authorization URL, e.g. prompt or max_age.
+	Params url.Values
+}
+
+// NewLoginRequest creates a pending login request and returns its challenge.
+func (s *Server) NewLoginRequest(opts LoginOptions) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := s.nextChallenge("login")
+	requestURL := s.URL + "/oauth2/auth?client_id=" + url.QueryEscape(opts.ClientID)
+	if len(opts.Params) > 0 {
+		requestURL += "&" + opts.Params.Encode()
+	}
+	subject := opts.Subject
+	skip := opts.Skip
+
+	s.loginRequests[challenge] = &models.LoginRequest{
+		Challenge:      &challenge,
+		Client:         s.clientOrDefault(opts.ClientID),
+		OidcContext:    opts.OidcContext,
+		RequestURL:     &requestURL,
+		RequestedScope: opts.Scopes,
+		Skip:           &skip,
+		Subject:        &subject,
+	}
+
+	return challenge
+}
+
+// ConsentOptions describe a consent request. Subject and client are taken
+// from the accepted login request if LoginChallenge is set.
+type ConsentOptions struct {
+	LoginChallenge string
+	ClientID       string
+	Subject        string
+	Scopes         []string
+	Skip           bool
+	OidcContext    *models.OpenIDConnectContext
+}
+
+// NewConsentRequest creates a pending consent request and returns its
+// challenge.
+func (s *Server) NewConsentRequest(opts ConsentOptions) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := s.nextChallenge("consent")
+	consent := &models.ConsentRequest{
+		Challenge:      &challenge,
+		Client:         s.clientOrDefault(opts.ClientID),
+		LoginChallenge: opts.LoginChallenge,
+		OidcContext:    opts.OidcContext,
+		RequestedScope: opts.Scopes,
+		Skip:           opts.Skip,
+		Subject:        opts.Subject,
+	}
+
+	if login, found := s.loginRequests[opts.LoginChallenge]; found {
+		consent.Client = login.Client
+		consent.RequestURL = *login.RequestURL
+		if consent.RequestedScope == nil {
+			consent.RequestedScope = login.RequestedScope
+		}
+		if consent.OidcContext == nil {
+			consent.OidcContext = login.OidcContext
+		}
+		if accepted, found := s.acceptedLogins[opts.LoginChallenge]; found && consent.Subject == "" {
+			consent.Subject = *accepted.Subject
+		}
+	}
+
+	s.consentRequests[challenge] = consent
+	return challenge
+}
+
+// NewLogoutRequest creates a pending logout request and returns its challenge.
+func (s *Server) NewLogoutRequest(subject string, clientID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := s.nextChallenge("logout")
+	s.logoutRequests[challenge] = &models.LogoutRequest{
+		Challenge: challenge,
+		Client:    s.clientOrDefault(clientID),
+		Subject:   subject,
+	}
+	return challenge
+}
+
+// AddConsentSession creates a consent request and accepts it with the given
+// scopes, as if the subject had granted the consent earlier. It returns the
+// consent challenge.
+func (s *Server) AddConsentSession(subject string, clientID string, scopes ...string) string {
+	challenge := s.NewConsentRequest(ConsentOptions{ClientID: clientID, Subject: subject, Scopes: scopes})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.acceptedConsents[challenge] = &models.AcceptConsentRequest{GrantScope: scopes, Remember: true}
+	s.handledAt[challenge] = time.Now().UTC()
+	return challenge
+}
+
+// ConsentRevoked reports whether the remembered consent has been revoked.
+func (s *Server) ConsentRevoked(challenge string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.revoked[challenge]
+}
+
+// AcceptedLogin returns the body the login request was accepted with.
+func (s *Server) AcceptedLogin(challenge string) (*models.AcceptLoginRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accepted, found := s.acceptedLogins[challenge]
+	return accepted, found
+}
+
+// AcceptedAMR returns the amr the login request was accepted with.
+func (s *Server) AcceptedAMR(challenge string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.acceptedAMR[challenge]
+}
+
+// AcceptedConsent returns the body the consent request was accepted with.
+func (s *Server) AcceptedConsent(challenge string) (*models.AcceptConsentRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	accepted, found := s.acceptedConsents[challenge]
+	return accepted, found
+}
+
+// AcceptedLogout reports whether the logout request was accepted.
+func (s *Server) AcceptedLogout(challenge string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.acceptedLogouts[challenge]
+}
+
+// Rejected returns the body the login or consent request was rejected with.
+// Rejected logout requests have an empty body.
+func (s *Server) Rejected(challenge string) (*models.RejectRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rejected, found := s.rejected[challenge]
+	return rejected, found
+}
+
+// RedirectURL is the URL the fake returns as redirect_to after a request
+// has been handled.
+func (s *Server) RedirectURL(challenge string) string {
+	return s.URL + "/oauth2/auth?verifier=" + url.QueryEscape(challenge)
+}
+
+func (s *Server) handled(challenge string) bool {
+	_, accepted := s.acceptedLogins[challenge]
+	_, consented := s.acceptedConsents[challenge]
+	_, rejected := s.rejected[challenge]
+	return accepted || consented || rejected || s.acceptedLogouts[challenge]
+}
+
+func (s *Server) redirect(w http.ResponseWriter, challenge string) {
+	redirectTo := s.RedirectURL(challenge)
+	writeJSON(w, http.StatusOK, &models.CompletedRequest{RedirectTo: &redirectTo})
+}
+
+func (s *Server) getLogin(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("login_challenge")
+	login, found := s.loginRequests[challenge]
+	if !found {
+		writeError(w, http.StatusNotFound, "login request not found")
+		return
+	}
+	if s.handled(challenge) {
+		s.gone(w, challenge)
+		return
+	}
+	writeJSON(w, http.StatusOK, login)
+}
+
+func (s *Server) acceptLogin(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("login_challenge")
+	if _, found := s.loginRequests[challenge]; !found {
+		writeError(w, http.StatusNotFound, "login request not found")
+		return
+	}
+
+	// the model of hydra-client-go has no amr
+	var body struct {
+		models.AcceptLoginRequest
+		AMR []string `json:"amr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Subject == nil {
+		writeError(w, http.StatusBadRequest, "invalid accept login request")
+		return
+	}
+
+	s.acceptedLogins[challenge] = &body.AcceptLoginRequest
+	s.acceptedAMR[challenge] = body.AMR
+	s.redirect(w, challenge)
+}
+
+func (s *Server) getConsent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("consent_challenge")
+	consent, found := s.consentRequests[challenge]
+	if !found {
+		writeError(w, http.StatusNotFound, "consent request not found")
+		return
+	}
+	if s.handled(challenge) {
+		s.gone(w, challenge)
+		return
+	}
+	writeJSON(w, http.StatusOK, consent)
+}
+
+func (s *Server) acceptConsent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("consent_challenge")
+	if _, found := s.consentRequests[challenge]; !found {
+		writeError(w, http.StatusNotFound, "consent request not found")
+		return
+	}
+
+	var body models.AcceptConsentRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid accept consent request")
+		return
+	}
+
+	s.acceptedConsents[challenge] = &body
+	s.handledAt[challenge] = time.Now().UTC()
+	s.redirect(w, challenge)
+}
+
+func (s *Server) getLogout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("logout_challenge")
+	logout, found := s.logoutRequests[challenge]
+	if !found {
+		writeError(w, http.StatusNotFound, "logout request not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, logout)
+}
+
+func (s *Server) acceptLogout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("logout_challenge")
+	if _, found := s.logoutRequests[challenge]; !found {
+		writeError(w, http.StatusNotFound, "logout request not found")
+		return
+	}
+
+	s.acceptedLogouts[challenge] = true
+	s.redirect(w, challenge)
+}
+
+func (s *Server) reject(challengeParam string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		challenge := r.URL.Query().Get(challengeParam)
+		_, login := s.loginRequests[challenge]
+		_, consent := s.consentRequests[challenge]
+		if !login && !consent {
+			writeError(w, http.StatusNotFound, "request not found")
+			return
+		}
+
+		var body models.RejectRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			body = models.RejectRequest{}
+		}
+
+		s.rejected[challenge] = &body
+		s.redirect(w, challenge)
+	}
+}
+
+func (s *Server) rejectLogout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	challenge := r.URL.Query().Get("logout_challenge")
+	if _, found := s.logoutRequests[challenge]; !found {
+		writeError(w, http.StatusNotFound, "logout request not found")
+		return
+	}
+
+	s.rejected[challenge] = &models.RejectRequest{}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) gone(w http.ResponseWriter, challenge string) {
+	redirectTo := s.RedirectURL(challenge)
+	writeJSON(w, http.StatusGone, &models.RequestWasHandledResponse{RedirectTo: &redirectTo})
+}
+
+// consentSession is the PreviousConsentSession of Hydra. It is encoded here
+// since the handled_at of the SDK model can not be created without strfmt.
+type consentSession struct {
+	ConsentRequest *models.ConsentRequest `json:"consent_request"`
+	GrantScope     []string               `json:"grant_scope"`
+	HandledAt      time.Time              `json:"handled_at"`
+	Remember       bool                   `json:"remember"`
+	RememberFor    int64                  `json:"remember_for"`
+}
+
+// rememberedConsents returns the challenges of the remembered and not yet
+// revoked consents of the subject.
+func (s *Server) rememberedConsents(subject string) []string {
+	challenges := make([]string, 0)
+	for challenge, accepted := range s.acceptedConsents {
+		if accepted.Remember && !s.revoked[challenge] && s.consentRequests[challenge].Subject == subject {
+			challenges = append(challenges, challenge)
+		}
+	}
+	return challenges
+}
+
+func (s *Server) listConsentSessions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subject := r.URL.Query().Get("subject")
+	if subject == "" {
+		writeError(w, http.StatusBadRequest, "subject is missing")
+		return
+	}
+
+	sessions := make([]*consentSession, 0)
+	for _, challenge := range s.rememberedConsents(subject) {
+		accepted := s.acceptedConsents[challenge]
+		sessions = append(sessions, &consentSession{
+			ConsentRequest: s.consentRequests[challenge],
+			GrantScope:     accepted.GrantScope,
+			HandledAt:      s.handledAt[challenge],
+			Remember:       accepted.Remember,
+			RememberFor:    accepted.RememberFor,
+		})
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (s *Server) revokeConsentSessions(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subject := r.URL.Query().Get("subject")
+	clientID := r.URL.Query().Get("client")
+	all := r.URL.Query().Get("all") == "true"
+	if subject == "" || (clientID == "" && !all) {
+		writeError(w, http.StatusBadRequest, "subject and client or all are required")
+		return
+	}
+
+	for _, challenge := range s.rememberedConsents(subject) {
+		if all || s.consentRequests[challenge].Client.ClientID == clientID {
+			s.revoked[challenge] = true
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listClients(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := make([]*models.OAuth2Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	writeJSON(w, http.StatusOK, clients)
+}
+
+func (s *Server) createClient(w http.ResponseWriter, r *http.Request) {
+	var client models.OAuth2Client
+	if err := json.NewDecoder(r.Body).Decode(&client); err != nil || client.ClientID == "" {
+		writeError(w, http.StatusBadRequest, "invalid client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.clients[client.ClientID]; found {
+		writeError(w, http.StatusConflict, "client already exists")
+		return
+	}
+
+	s.clients[client.ClientID] = &client
+	writeJSON(w, http.StatusCreated, &client)
+}
+
+func (s *Server) getClient(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, found := s.clients[r.PathValue("id")]
+	if !found {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, client)
+}
+
+func (s *Server) updateClient(w http.ResponseWriter, r *http.Request) {
+	var client models.OAuth2Client
+	if err := json.NewDecoder(r.Body).Decode(&client); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid client")
+		return
+	}
+	client.ClientID = r.PathValue("id")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.clients[client.ClientID]; !found {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+
+	s.clients[client.ClientID] = &client
+	writeJSON(w, http.StatusOK, &client)
+}
+
+func (s *Server) deleteClient(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.clients[r.PathValue("id")]; !found {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+
+	delete(s.clients, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		panic("unexpected error:" + err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, description string) {
+	writeJSON(w, status, &models.GenericError{
+		Error:            stringPtr(http.StatusText(status)),
+		ErrorDescription: description,
+		StatusCode:       int64(status),
+	})
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,73 @@
+package hydratest
+
+import (
+	"context"
+	"log"
+	"testing"
+
+	"github.com/ory/hydra-client-go/client/admin"
+	"github.com/ory/hydra-client-go/models"
+)
+
+func TestClientsCRUD(t *testing.T) {
+	//given
+	server := NewServer()
+	defer server.Close()
+	api := server.Client().Admin
+	ctx := context.Background()
+
+	//when
+	_, err := api.CreateOAuth2Client(admin.NewCreateOAuth2ClientParamsWithContext(ctx).
+		WithBody(&models.OAuth2Client{ClientID: "app", ClientName: "My App"}))
+
+	//then
+	if err != nil {
+		log.Println("could not create client:", err)
+		t.FailNow()
+	}
+
+	resp, err := api.GetOAuth2Client(admin.NewGetOAuth2ClientParamsWithContext(ctx).WithID("app"))
+	if err != nil || resp.Payload.ClientName != "My App" {
+		log.Println("could not get client:", err)
+		t.FailNow()
+	}
+
+	//when
+	_, err = api.DeleteOAuth2Client(admin.NewDeleteOAuth2ClientParamsWithContext(ctx).WithID("app"))
+
+	//then
+	if err != nil {
+		log.Println("could not delete client:", err)
+		t.FailNow()
+	}
+	if _, found := server.ClientByID("app"); found {
+		log.Println("client not deleted")
+		t.FailNow()
+	}
+}
+
+func TestHandledLoginRequestIsGone(t *testing.T) {
+	//given
+	server := NewServer()
+	defer server.Close()
+	api := server.Client().Admin
+	ctx := context.Background()
+	challenge := server.NewLoginRequest(LoginOptions{ClientID: "app", Scopes: []string{"openid"}})
+	subject := "user"
+
+	//when
+	accepted, err := api.AcceptLoginRequest(admin.NewAcceptLoginRequestParamsWithContext(ctx).
+		WithLoginChallenge(challenge).
+		WithBody(&models.AcceptLoginRequest{Subject: &subject}))
+
+	//then
+	if err != nil || *accepted.Payload.RedirectTo != server.RedirectURL(challenge) {
+		log.Println("unexpected accept response:", err)
+		t.FailNow()
+	}
+
+	if _, err := api.GetLoginRequest(admin.NewGetLoginRequestParamsWithContext(ctx).WithLoginChallenge(challenge)); err == nil {
+		log.Println("handled login request must be gone")
+		t.FailNow()
+	}
+}
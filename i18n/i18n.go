@@ -0,0 +1,198 @@
+package i18n
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed locales/*.json
+var catalogs embed.FS
+
+const FallbackLocale = "de"
+
+type contextKey struct{}
+
+// Bundle holds the message catalogs, one per locale, loaded from
+// locales/<locale>.json.
+type Bundle struct {
+	defaultLocale string
+	messages      map[string]map[string]string
+	matcher       language.Matcher
+	// tagLocales maps the index of a matched tag to the catalog name
+	tagLocales []string
+}
+
+// Load reads the embedded catalogs. DEFAULT_LOCALE selects the locale used
+// when neither ui_locales nor Accept-Language match a catalog.
+func Load() (bundle *Bundle, err error) {
+	defaultLocale, found := os.LookupEnv("DEFAULT_LOCALE")
+	if !found {
+		defaultLocale = FallbackLocale
+	}
+	return New(catalogs, defaultLocale)
+}
+
+func New(fsys fs.FS, defaultLocale string) (bundle *Bundle, err error) {
+	files, err := fs.Glob(fsys, "locales/*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	bundle = &Bundle{
+		defaultLocale: defaultLocale,
+		messages:      make(map[string]map[string]string),
+	}
+
+	// the default locale goes first, the matcher falls back to the first tag
+	tags := []language.Tag{language.Make(defaultLocale)}
+	bundle.tagLocales = []string{defaultLocale}
+	for _, file := range files {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		messages := make(map[string]string)
+		if err := json.Unmarshal(content, &messages); err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", file, err)
+		}
+
+		locale := strings.TrimSuffix(path.Base(file), ".json")
+		bundle.messages[locale] = messages
+		if locale != defaultLocale {
+			tags = append(tags, language.Make(locale))
+			bundle.tagLocales = append(bundle.tagLocales, locale)
+		}
+	}
+
+	if _, found := bundle.messages[defaultLocale]; !found {
+		return nil, fmt.Errorf("no catalog for default locale %s", defaultLocale)
+	}
+
+	bundle.matcher = language.NewMatcher(tags)
+	return bundle, nil
+}
+
+func Must(bundle *Bundle, err error) *Bundle {
+	if err != nil {
+		panic("could not load message catalogs: " + err.Error())
+	}
+	return bundle
+}
+
+// Resolve picks the locale from the OIDC ui_locales first, then from the
+// Accept-Language header and finally falls back to the default locale.
+func (b *Bundle) Resolve(uiLocales []string, acceptLanguage string) string {
+	for _, uiLocale := range uiLocales {
+		for _, candidate := range strings.Fields(uiLocale) {
+			if locale, ok := b.match(candidate); ok {
+				return locale
+			}
+		}
+	}
+
+	if acceptLanguage != "" {
+		if tags, _, err := language.ParseAcceptLanguage(acceptLanguage); err == nil {
+			for _, tag := range tags {
+				if locale, ok := b.match(tag.String()); ok {
+					return locale
+				}
+			}
+		}
+	}
+
+	return b.defaultLocale
+}
+
+func (b *Bundle) match(candidate string) (locale string, ok bool) {
+	tag, err := language.Parse(candidate)
+	if err != nil {
+		return "", false
+	}
+
+	_, index, confidence := b.matcher.Match(tag)
+	if confidence == language.No {
+		return "", false
+	}
+
+	return b.tagLocales[index], true
+}
+
+// Supports reports whether a catalog exists for the locale.
+func (b *Bundle) Supports(locale string) bool {
+	_, found := b.messages[locale]
+	return found
+}
+
+// Locales returns the locales with a catalog, sorted.
+func (b *Bundle) Locales() []string {
+	locales := make([]string, 0, len(b.messages))
+	for locale := range b.messages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Localizer translates messages into one locale.
+func (b *Bundle) Localizer(locale string) *Localizer {
+	if !b.Supports(locale) {
+		locale = b.defaultLocale
+	}
+	return &Localizer{bundle: b, locale: locale}
+}
+
+type Localizer struct {
+	bundle *Bundle
+	locale string
+}
+
+func (l *Localizer) Locale() string {
+	return l.locale
+}
+
+// T returns the message for key, formatted with args. Missing messages fall
+// back to the default locale and finally to the key itself.
+func (l *Localizer) T(key string, args ...interface{}) string {
+	message, found := l.bundle.messages[l.locale][key]
+	if !found {
+		message, found = l.bundle.messages[l.bundle.defaultLocale][key]
+	}
+	if !found {
+		return key
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// Scope returns the description of an OAuth scope or the scope itself if
+// there is no description.
+func (l *Localizer) Scope(scope string) string {
+	key := "scope." + scope
+	if description := l.T(key); description != key {
+		return description
+	}
+	return scope
+}
+
+func WithLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, contextKey{}, locale)
+}
+
+// LocaleFromContext returns the locale set by WithLocale.
+func LocaleFromContext(ctx context.Context) (locale string, found bool) {
+	locale, found = ctx.Value(contextKey{}).(string)
+	return locale, found
+}
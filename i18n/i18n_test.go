@@ -0,0 +1,68 @@
+package i18n
+
+import (
+	"log"
+	"testing"
+)
+
+func TestResolveLocale(t *testing.T) {
+	//given
+	bundle, err := New(catalogs, "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		uiLocales      []string
+		acceptLanguage string
+		wanted         string
+	}{
+		{[]string{"en-US"}, "de-DE,de;q=0.9", "en"},
+		{[]string{"fr en"}, "", "en"},
+		{nil, "fr-FR,en-GB;q=0.8", "en"},
+		{[]string{"fr"}, "it", "de"},
+		{nil, "", "de"},
+	}
+
+	for _, c := range cases {
+		//when
+		locale := bundle.Resolve(c.uiLocales, c.acceptLanguage)
+
+		//then
+		if locale != c.wanted {
+			log.Printf("ui_locales %v, Accept-Language %q: got %s but wanted %s", c.uiLocales, c.acceptLanguage, locale, c.wanted)
+			t.Fail()
+		}
+	}
+}
+
+func TestCatalogsAreComplete(t *testing.T) {
+	//given
+	bundle, err := New(catalogs, "de")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	for locale, messages := range bundle.messages {
+		for other, otherMessages := range bundle.messages {
+			for key := range otherMessages {
+				if _, found := messages[key]; !found {
+					log.Printf("key %s of %s is missing in %s", key, other, locale)
+					t.Fail()
+				}
+			}
+		}
+	}
+}
+
+func TestScopeDescription(t *testing.T) {
+	//given
+	l := Must(New(catalogs, "de")).Localizer("en")
+
+	//then
+	if l.Scope("email") != "Your email address" || l.Scope("custom") != "custom" {
+		log.Println("unexpected scope descriptions:", l.Scope("email"), l.Scope("custom"))
+		t.Fail()
+	}
+}
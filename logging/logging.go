@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const Redacted = "[REDACTED]"
+
+type contextKey struct{}
+
+// sensitiveKeys are matched case-insensitively as substrings of attribute keys.
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie"}
+
+// Init configures the default slog logger from LOG_LEVEL (debug, info, warn,
+// error) and LOG_FORMAT (text, json). The standard log package is routed
+// through the same handler.
+func Init() {
+	slog.SetDefault(New(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")))
+}
+
+// New creates a logger writing to w which redacts sensitive attributes.
+func New(w io.Writer, level string, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       parseLevel(level),
+		ReplaceAttr: redact,
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	return slog.New(handler)
+}
+
+func parseLevel(level string) slog.Level {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return l
+}
+
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// IsSensitive reports whether values stored under the given key must not be logged.
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CorrelationID derives a stable identifier from a login or consent challenge.
+// The challenge itself is not logged since it grants access to the flow.
+func CorrelationID(challenge string) string {
+	if challenge == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(challenge))
+	return hex.EncodeToString(sum[:6])
+}
+
+// WithChallenge returns a context whose logger carries the correlation id of
+// the given challenge. A later call replaces the correlation id.
+func WithChallenge(ctx context.Context, challenge string) context.Context {
+	if challenge == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, CorrelationID(challenge))
+}
+
+// CorrelationIDFromContext returns the correlation id set by WithChallenge.
+func CorrelationIDFromContext(ctx context.Context) string {
+	correlationID, _ := ctx.Value(contextKey{}).(string)
+	return correlationID
+}
+
+// FromContext returns the default logger enriched with the correlation id
+// and the trace id of an active span, so logs can be matched with traces.
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if correlationID := CorrelationIDFromContext(ctx); correlationID != "" {
+		logger = logger.With("correlation_id", correlationID)
+	}
+
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		logger = logger.With("trace_id", spanContext.TraceID().String())
+	}
+
+	return logger
+}
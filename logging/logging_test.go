@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"simple-login-endpoint/user"
+	"strings"
+	"testing"
+)
+
+func TestSecretsAreRedacted(t *testing.T) {
+	//given
+	var buf bytes.Buffer
+	logger := New(&buf, "debug", "json")
+
+	//when
+	logger.Info("test",
+		"client_secret", "secret",
+		"access_token", "token",
+		"user", &user.User{Email: "user", Password: "user-password"},
+	)
+
+	//then
+	if strings.Contains(buf.String(), "user-password") || strings.Contains(buf.String(), `"secret"`) {
+		log.Println("secret logged:", buf.String())
+		t.FailNow()
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry["client_secret"] != Redacted || entry["access_token"] != Redacted {
+		log.Println("unexpected entry:", entry)
+		t.FailNow()
+	}
+}
+
+func TestCorrelationIDFromChallenge(t *testing.T) {
+	//given
+	ctx := WithChallenge(context.Background(), "login-challenge")
+
+	//when
+	id, _ := ctx.Value(contextKey{}).(string)
+
+	//then
+	if id == "" || id != CorrelationID("login-challenge") {
+		log.Println("unexpected correlation id:", id)
+		t.FailNow()
+	}
+
+	if strings.Contains(id, "login-challenge") {
+		log.Println("challenge leaked into correlation id")
+		t.FailNow()
+	}
+}
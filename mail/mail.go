@@ -0,0 +1,159 @@
+// Package mail sends the emails of the identity provider, e.g. password reset
+// links. The transport is chosen by MAIL_TRANSPORT.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// NewFromEnv creates the mailer selected by MAIL_TRANSPORT: smtp, file or
+// log. The log mailer writes the messages to stdout and is meant for
+// development only. Without MAIL_TRANSPORT the mailer is nil, so no mails,
+// which contain login codes and reset links, end up in the logs by accident.
+func NewFromEnv() (mailer Mailer, err error) {
+	from := os.Getenv("MAIL_FROM")
+
+	switch strings.TrimSpace(os.Getenv("MAIL_TRANSPORT")) {
+	case "":
+		return nil, nil
+	case "log":
+		return NewWriterMailer(os.Stdout, from), nil
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		return NewFileMailer(path, from)
+	case "smtp":
+		return NewSMTPMailer(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	default:
+		return nil, fmt.Errorf("unknown MAIL_TRANSPORT %q", os.Getenv("MAIL_TRANSPORT"))
+	}
+}
+
+func Must(mailer Mailer, err error) Mailer {
+	if err != nil {
+		panic("could not create mailer: " + err.Error())
+	}
+	return mailer
+}
+
+// format renders the message as RFC 5322 mail with a plain text body.
+func format(from string, message Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", message.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// validAddress rejects line breaks, which would allow to inject headers.
+func validAddress(address string) error {
+	if address == "" || strings.ContainsAny(address, "\r\n") {
+		return fmt.Errorf("invalid address %q", address)
+	}
+	return nil
+}
+
+// WriterMailer writes the formatted messages, separated by a blank line.
+type WriterMailer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func NewWriterMailer(w io.Writer, from string) (mailer *WriterMailer) {
+	return &WriterMailer{w: w, from: from}
+}
+
+// NewFileMailer appends the messages to the file at path.
+func NewFileMailer(path string, from string) (mailer *WriterMailer, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterMailer(file, from), nil
+}
+
+func (m *WriterMailer) Send(_ context.Context, message Message) error {
+	if err := validAddress(message.To); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.w.Write(append(format(m.from, message), '\r', '\n'))
+	return err
+}
+
+// SMTPMailer delivers the messages to an SMTP server. STARTTLS is used if the
+// server offers it, credentials are only sent over TLS.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(addr string, username string, password string, from string) (mailer *SMTPMailer, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %q: %w", addr, err)
+	}
+	if err := validAddress(from); err != nil {
+		return nil, fmt.Errorf("MAIL_FROM: %w", err)
+	}
+
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{addr: addr, auth: auth, from: from}, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, message Message) error {
+	if err := validAddress(message.To); err != nil {
+		return err
+	}
+
+	// smtp.SendMail does not take a context, the deadline still limits
+	// waiting for a hanging server
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, format(m.from, message))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,81 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriterMailerFormatsMessage(t *testing.T) {
+	//given
+	var buf bytes.Buffer
+	mailer := NewWriterMailer(&buf, "idp@example.com")
+
+	//when
+	err := mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "Passwort zurücksetzen", Body: "line 1\nline 2"})
+
+	//then
+	content := buf.String()
+	if err != nil || !strings.Contains(content, "To: user@example.com\r\n") || !strings.Contains(content, "Subject: =?utf-8?q?") ||
+		!strings.Contains(content, "\r\n\r\nline 1\r\nline 2\r\n") {
+		log.Println("unexpected mail:", content, err)
+		t.Fail()
+	}
+}
+
+func TestHeaderInjectionIsRejected(t *testing.T) {
+	//given
+	var buf bytes.Buffer
+	mailer := NewWriterMailer(&buf, "idp@example.com")
+
+	//when
+	err := mailer.Send(context.Background(), Message{To: "user@example.com\r\nBcc: evil@example.com", Subject: "x"})
+
+	//then
+	if err == nil || buf.Len() != 0 {
+		log.Println("header injection accepted")
+		t.Fail()
+	}
+}
+
+func TestNewFromEnv(t *testing.T) {
+	//given
+	path := filepath.Join(t.TempDir(), "mail.log")
+	t.Setenv("MAIL_TRANSPORT", "file")
+	t.Setenv("MAIL_FILE", path)
+
+	//when
+	mailer, err := NewFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mailer.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "body"})
+
+	//then
+	content, _ := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(content), "Subject: Hello") {
+		log.Println("mail not written to file:", string(content), err)
+		t.FailNow()
+	}
+
+	//when
+	t.Setenv("MAIL_TRANSPORT", "")
+	mailer, err = NewFromEnv()
+
+	//then
+	if mailer != nil || err != nil {
+		log.Println("mailer created without MAIL_TRANSPORT:", mailer, err)
+		t.FailNow()
+	}
+
+	//when
+	t.Setenv("MAIL_TRANSPORT", "pigeon")
+	if _, err := NewFromEnv(); err == nil {
+		log.Println("unknown transport accepted")
+		t.Fail()
+	}
+}
@@ -4,85 +4,310 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"simple-login-endpoint/audit"
+	"simple-login-endpoint/flow"
 	"simple-login-endpoint/handler"
+	"simple-login-endpoint/logging"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/realm"
+	"simple-login-endpoint/static"
+	"simple-login-endpoint/theme"
+	"simple-login-endpoint/tracing"
 	"simple-login-endpoint/user"
+	"strconv"
+	"syscall"
+	"time"
 
-	hydra "github.com/ory/hydra-client-go/client"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const ClientsJSONFile = "import/clients.json"
 const UsersJSONFile = "import/users.json"
-const ServerPort = ":3000"
+const GroupsJSONFile = "import/groups.json"
+const DefaultListenAddr = ":3000"
 
-func importUsers() (users map[string]*user.User) {
-	jsonContent, err := os.ReadFile(UsersJSONFile)
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, found := os.LookupEnv(key)
+	if !found {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("invalid duration, using default", "env", key, "value", value, "default", fallback.String())
+		return fallback
+	}
+	return duration
+}
+
+func envInt(key string, fallback int) int {
+	value, found := os.LookupEnv(key)
+	if !found {
+		return fallback
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("invalid number, using default", "env", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return number
+}
+
+func newServer(handler http.Handler) *http.Server {
+	addr, found := os.LookupEnv("LISTEN_ADDR")
+	if !found {
+		addr = DefaultListenAddr
+	}
+
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 10*time.Second),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      envDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       envDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    envInt("SERVER_MAX_HEADER_BYTES", 1<<16),
+	}
+}
+
+// importUsers reads the users and skips those whose password violates the
+// password policy. Plain text passwords are replaced by their bcrypt hash,
+// users without a password can only sign in by email.
+func importUsers(path string, passwords *password.Policy) (users map[string]*user.User) {
+	jsonContent, err := os.ReadFile(path)
 	if err != nil {
-		log.Println("Error on importing json file", err.Error())
+		slog.Error("Error on importing json file", "error", err)
 		return make(map[string]*user.User, 0)
 	}
-	log.Println("importing users...")
+	slog.Info("importing users", "file", path)
 	var imports []*user.User
 	err = json.Unmarshal(jsonContent, &imports)
 
 	if err != nil {
-		log.Println("error on parsinf json content", err.Error())
+		slog.Error("error on parsing json content", "error", err)
 		return make(map[string]*user.User, 0)
 	}
 
-	log.Printf("imported %d users", len(imports))
 	userMap := make(map[string]*user.User, len(imports))
+	importedAt := time.Now()
 
 	for _, u := range imports {
+		// set like the password of a new user, unless it is a bcrypt hash
+		if u.Password != "" && !user.HashedPassword(u.Password) {
+			imported := &user.User{Email: u.Email}
+			if err := passwords.Set(imported, u.Password, importedAt); err != nil {
+				slog.Error("user not imported", "user", u, "error", err)
+				continue
+			}
+			u.Password = imported.Password
+		}
+		if u.PasswordChangedAt.IsZero() {
+			u.PasswordChangedAt = importedAt
+		}
+		slog.Debug("imported user", "user", u)
 		userMap[u.Email] = u
 	}
+	slog.Info("imported users", "count", len(userMap), "skipped", len(imports)-len(userMap))
 
-	log.Println("users...", imports)
 	return userMap
 }
 
-func registerClients(h *handler.Handler) {
+// importGroups reads the optional groups file. Groups containing a cycle are
+// not imported at all.
+func importGroups(path string) *user.GroupInMemoryRepo {
+	jsonContent, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("no groups to import")
+		return user.NewEmptyGroupInMemoryRepo()
+	}
+	if err != nil {
+		slog.Error("Error on importing json file", "error", err)
+		return user.NewEmptyGroupInMemoryRepo()
+	}
+
+	var groups []*user.Group
+	if err := json.Unmarshal(jsonContent, &groups); err != nil {
+		slog.Error("error on parsing json content", "error", err)
+		return user.NewEmptyGroupInMemoryRepo()
+	}
+
+	repo, err := user.NewGroupInMemoryRepo(groups)
+	if err != nil {
+		slog.Error("groups not imported", "error", err)
+		return user.NewEmptyGroupInMemoryRepo()
+	}
+	slog.Info("imported groups", "count", len(groups))
+	return repo
+}
+
+// loadRealms builds the realms of the REALMS_FILE with their users and
+// groups. The realms replace the global password policy if they configure
+// their own.
+func loadRealms(passwords *password.Policy) (*realm.Registry, error) {
+	configs, err := realm.LoadConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	realms := make([]*realm.Realm, 0, len(configs))
+	for _, config := range configs {
+		policy, err := config.Password.Policy(passwords)
+		if err != nil {
+			return nil, fmt.Errorf("realm %s: %w", config.Name, err)
+		}
+		groups := user.NewEmptyGroupInMemoryRepo()
+		if config.GroupsFile != "" {
+			groups = importGroups(config.GroupsFile)
+		}
+
+		realms = append(realms, &realm.Realm{
+			Name:      config.Name,
+			Hosts:     config.Hosts,
+			Clients:   config.Clients,
+			Theme:     config.Theme,
+			Users:     user.NewUserInMemoryRepo(importUsers(config.UsersFile, policy)),
+			Groups:    groups,
+			Passwords: policy,
+		})
+	}
+
+	return realm.NewRegistry(realms...)
+}
+
+// staticFiles serves the embedded assets, or the static directory from disk
+// in development mode.
+func staticFiles() http.FileSystem {
+	if devMode, _ := strconv.ParseBool(os.Getenv("DEV_MODE")); devMode {
+		return http.Dir("static")
+	}
+	return http.FS(static.Files)
+}
+
+func registerClients(ctx context.Context, h *handler.Handler) {
 	if _, err := os.Stat(ClientsJSONFile); errors.Is(err, os.ErrNotExist) {
-		log.Println("no clients to import")
+		slog.Info("no clients to import")
 	} else {
 		jsonContent, err := os.ReadFile(ClientsJSONFile)
 		if err != nil {
-			log.Println("Error on importing json file", err.Error())
+			slog.Error("Error on importing json file", "error", err)
 		} else {
-			ctx := context.Background()
 			go h.RegisterClients(ctx, jsonContent)
 		}
 	}
 }
 func main() {
-	log.Println("starting identity provider on port...", ServerPort)
+	if len(os.Args) > 1 && os.Args[1] == BreachFilterCommand {
+		if err := buildBreachFilter(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	hydraAdminURL, found := os.LookupEnv("HYDRA_ADMIN_URL")
-	if !found {
-		log.Fatal("HYDRA_ADMIN_URL is not set")
+	logging.Init()
+
+	if err := run(); err != nil {
+		slog.Error("identity provider failed", "error", err)
+		os.Exit(1)
 	}
-	adminURL, _ := url.Parse(hydraAdminURL)
-	hydraClient := hydra.NewHTTPClientWithConfig(nil,
-		&hydra.TransportConfig{
-			Schemes:  []string{adminURL.Scheme},
-			Host:     adminURL.Host,
-			BasePath: adminURL.Path,
-		},
-	)
+}
 
-	repo := user.NewUserInMemoryRepo(importUsers())
-	handler := handler.NewHandler(hydraClient, repo)
-	registerClients(handler)
+// run serves until SIGINT or SIGTERM. Tracing and audit sinks are shut down
+// before it returns, also if the server could not be started.
+func run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	backend, err := flow.NewFromEnv()
+	if err != nil {
+		return fmt.Errorf("could not create Hydra backend: %w", err)
+	}
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		return fmt.Errorf("could not initialize tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Error("error on shutting down tracing", "error", err)
+		}
+	}()
+
+	auditor, err := audit.NewFromEnv()
+	if err != nil {
+		return fmt.Errorf("could not initialize audit sinks: %w", err)
+	}
+	defer auditor.Close()
+
+	passwords := password.Must(password.NewPolicyFromEnv())
+	realms, err := loadRealms(passwords)
+	if err != nil {
+		return fmt.Errorf("could not load realms: %w", err)
+	}
+
+	repo := user.NewUserInMemoryRepo(importUsers(UsersJSONFile, passwords))
+	handler := handler.NewHandler(backend, repo)
+	handler.GroupRepo = importGroups(GroupsJSONFile)
+	handler.Passwords = passwords
+	handler.Realms = realms
+	auditor.Add(handler.Activity)
+	handler.Audit = auditor
+	registerClients(ctx, handler)
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/idp/static/", http.StripPrefix("/idp/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/idp/static/", http.StripPrefix("/idp/static/", http.FileServer(staticFiles())))
+	mux.Handle(theme.AssetsPath, handler.Themes.AssetHandler())
 	mux.HandleFunc("/idp/health", handler.HandleHealth)
 	mux.HandleFunc("/idp/login", handler.HandleLogin)
+	mux.HandleFunc("/idp/login/mfa", handler.HandleLoginMFA)
+	mux.HandleFunc("/idp/login/email", handler.HandleLoginEmail)
+	mux.HandleFunc("/idp/login/email/verify", handler.HandleLoginEmailVerify)
+	mux.HandleFunc("/idp/password/forgot", handler.HandlePasswordForgot)
+	mux.HandleFunc("/idp/password/reset", handler.HandlePasswordReset)
+	mux.HandleFunc("/idp/register", handler.HandleRegister)
+	mux.HandleFunc("/idp/register/verify", handler.HandleRegisterVerify)
 	mux.HandleFunc("/idp/consent", handler.HandleConsent)
+	mux.HandleFunc("/idp/logout", handler.HandleLogout)
 	mux.HandleFunc("/idp/error", handler.HandleError)
-	log.Fatal(http.ListenAndServe(ServerPort, mux))
+	mux.HandleFunc("/idp/account", handler.HandleAccount)
+	mux.HandleFunc("/idp/account/login", handler.HandleAccountLogin)
+	mux.HandleFunc("/idp/account/login/mfa", handler.HandleAccountLoginMFA)
+	mux.HandleFunc("/idp/account/logout", handler.HandleAccountLogout)
+	mux.HandleFunc("/idp/account/profile", handler.HandleAccountProfile)
+	mux.HandleFunc("/idp/account/password", handler.HandleAccountPassword)
+	mux.HandleFunc("/idp/account/totp", handler.HandleAccountTOTP)
+	mux.HandleFunc("/idp/account/passkeys", handler.HandleAccountPasskeys)
+	mux.HandleFunc("/idp/account/consents", handler.HandleAccountConsents)
+
+	server := newServer(otelhttp.NewHandler(mux, "idp"))
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting identity provider", "addr", server.Addr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return fmt.Errorf("server stopped: %w", err)
+	case <-ctx.Done():
+		stop()
+	}
+
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
+	slog.Info("shutting down, draining in-flight requests", "timeout", shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error on shutting down server", "error", err)
+	}
+	slog.Info("identity provider stopped")
+	return nil
 }
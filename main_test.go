@@ -1,18 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"simple-login-endpoint/breach"
+	"simple-login-endpoint/flow"
 	"simple-login-endpoint/handler"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/tracing"
 	"simple-login-endpoint/user"
+	"strings"
 	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestHandlerResponseCodes(t *testing.T) {
 	//GIVEN
-	repo := user.NewUserInMemoryRepo(importUsers())
+	repo := user.NewUserInMemoryRepo(importUsers(UsersJSONFile, password.Must(password.NewPolicyFromEnv())))
 	handler := handler.NewHandler(nil, repo)
 
 	err := testMethodNotAllowed(handler, "PUT")
@@ -125,13 +139,17 @@ func testMethodNotAllowed(handler *handler.Handler, method string) (err error) {
 
 func TestImportUsers(t *testing.T) {
 	//when
-	users := importUsers()
+	users := importUsers(UsersJSONFile, password.Must(password.NewPolicy(password.DefaultMinLength, password.DefaultMinClasses, nil, 0, 0)))
 
 	//then
 	if len(users) != 2 {
 		log.Println("unexpected users amount:", len(users))
 		t.Fail()
 	}
+	if u := users["user"]; u == nil || !user.HashedPassword(u.Password) || !u.PasswordMatches("Correct-Horse-1") {
+		log.Println("password not imported as bcrypt hash")
+		t.Fail()
+	}
 
 	for _, u := range users {
 		if u.Email != "user" {
@@ -142,3 +160,191 @@ func TestImportUsers(t *testing.T) {
 		}
 	}
 }
+
+func TestImportUsersSkipsWeakPasswords(t *testing.T) {
+	//given
+	passwords := password.Must(password.NewPolicy(password.DefaultMinLength, password.DefaultMinClasses, []string{"horse"}, 0, 0))
+
+	//when
+	users := importUsers(UsersJSONFile, passwords)
+
+	//then
+	if _, found := users["user"]; found || len(users) != 1 || users["admin"].PasswordChangedAt.IsZero() {
+		log.Println("unexpected users:", len(users))
+		t.Fail()
+	}
+}
+
+func TestImportGroups(t *testing.T) {
+	//when
+	groups := importGroups(GroupsJSONFile)
+
+	//then
+	roles := user.EffectiveRoles(groups.AllGroups(), &user.User{Email: "admin", Roles: []string{"super-user"}})
+	if len(groups.AllGroups()) != 2 || strings.Join(roles, ",") != "super-user,admin,user" {
+		log.Println("unexpected groups:", len(groups.AllGroups()), roles)
+		t.Fail()
+	}
+}
+
+func TestLoadRealms(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	users := filepath.Join(dir, "shop-users.json")
+	if err := os.WriteFile(users, []byte(`[{"email": "anna@example.com", "password": "Short-1"}, {"email": "bob@example.com", "password": "Long-Enough-1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	realms := filepath.Join(dir, "realms.json")
+	content := `[{"name": "shop", "hosts": ["login.shop.example"], "users_file": "` + users + `", "password": {"min_length": 12}}]`
+	if err := os.WriteFile(realms, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REALMS_FILE", realms)
+
+	//when
+	registry, err := loadRealms(password.Must(password.NewPolicy(password.DefaultMinLength, password.DefaultMinClasses, nil, 0, 0)))
+
+	//then
+	if err != nil {
+		log.Println("realms not loaded:", err)
+		t.FailNow()
+	}
+	shop, found := registry.Get("shop")
+	if !found || shop.Passwords.MinLength != 12 || shop.Hosts[0] != "login.shop.example" {
+		log.Println("unexpected realm:", shop)
+		t.FailNow()
+	}
+	if _, err := shop.Users.GetUserByEmail("anna@example.com"); err == nil {
+		log.Println("password policy of realm not applied on import")
+		t.Fail()
+	}
+	if _, err := shop.Users.GetUserByEmail("bob@example.com"); err != nil {
+		log.Println("user of realm not imported")
+		t.Fail()
+	}
+}
+
+func TestLoginGetTracesHydraCall(t *testing.T) {
+	//given
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	var traceparent string
+	fakeHydra := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer fakeHydra.Close()
+
+	backend := flow.Must(flow.NewHydraV1(fakeHydra.URL, flow.NewHTTPClient()))
+	handler := handler.NewHandler(backend, user.NewEmptyUserInMemoryRepo())
+
+	req, _ := http.NewRequest(http.MethodGet, "/idp/login?login_challenge=challenge", nil)
+	rr := httptest.NewRecorder()
+
+	//when
+	handler.HandleLogin(rr, req)
+
+	//then
+	if traceparent == "" {
+		t.Fatal("trace context was not propagated to hydra")
+	}
+
+	spans := exporter.GetSpans()
+	var loginSpan, hydraSpan *tracetest.SpanStub
+	for i := range spans {
+		switch spans[i].Name {
+		case "loginGet":
+			loginSpan = &spans[i]
+		case "hydra GET /oauth2/auth/requests/login":
+			hydraSpan = &spans[i]
+		}
+	}
+
+	if loginSpan == nil || hydraSpan == nil {
+		t.Fatalf("expected loginGet and hydra spans, got %d spans", len(spans))
+	}
+
+	if hydraSpan.Parent.SpanID() != loginSpan.SpanContext.SpanID() {
+		t.Fatal("hydra span is not a child of loginGet")
+	}
+}
+
+func TestNewServerUsesConfiguredLimits(t *testing.T) {
+	//given
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:8080")
+	t.Setenv("SERVER_READ_HEADER_TIMEOUT", "2s")
+	t.Setenv("SERVER_MAX_HEADER_BYTES", "4096")
+	t.Setenv("SERVER_WRITE_TIMEOUT", "invalid")
+
+	//when
+	server := newServer(http.NewServeMux())
+
+	//then
+	if server.Addr != "127.0.0.1:8080" {
+		log.Println("unexpected addr:", server.Addr)
+		t.Fail()
+	}
+
+	if server.ReadHeaderTimeout != 2*time.Second || server.MaxHeaderBytes != 4096 {
+		log.Println("unexpected limits:", server.ReadHeaderTimeout, server.MaxHeaderBytes)
+		t.Fail()
+	}
+
+	if server.WriteTimeout != 30*time.Second {
+		log.Println("invalid value should fall back to default:", server.WriteTimeout)
+		t.Fail()
+	}
+}
+
+func TestBuildBreachFilter(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	wordlist := filepath.Join(dir, "wordlist.txt")
+	hashes := filepath.Join(dir, "hashes.txt")
+	out := filepath.Join(dir, "filter.bin")
+	if err := os.WriteFile(wordlist, []byte("123456\r\n\r\n letmein \r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	digest := breach.DigestOf("qwertz")
+	if err := os.WriteFile(hashes, []byte(strings.ToUpper(hex.EncodeToString(digest[:]))+":42\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	var output bytes.Buffer
+	err := buildBreachFilter([]string{"-out", out, wordlist}, &output)
+
+	//then
+	filter, loadErr := breach.LoadFilter(out)
+	if err != nil || loadErr != nil {
+		log.Println("filter not built:", err, loadErr)
+		t.FailNow()
+	}
+	for password, expected := range map[string]bool{"123456": true, " letmein ": true, "letmein": false, "qwertz": false} {
+		if breached, _ := filter.Breached(password); breached != expected {
+			log.Println("unexpected result for", password, breached)
+			t.Fail()
+		}
+	}
+
+	//when
+	err = buildBreachFilter([]string{"-out", out, "-format", "sha1", hashes}, &output)
+
+	//then
+	filter, loadErr = breach.LoadFilter(out)
+	if breached, _ := filter.Breached("qwertz"); err != nil || loadErr != nil || !breached {
+		log.Println("filter not built from hashes:", err, loadErr)
+		t.FailNow()
+	}
+
+	//when
+	err = buildBreachFilter([]string{"-out", out, "-format", "sha1", wordlist}, &output)
+
+	//then
+	if err == nil {
+		log.Println("wordlist accepted as hashes")
+		t.Fail()
+	}
+}
@@ -0,0 +1,115 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"simple-login-endpoint/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the test vectors in RFC 6238.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCodeMatchesRFCVectors(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, expected := range vectors {
+		//when
+		code, err := TOTPCode(rfcSecret, time.Unix(unix, 0))
+
+		//then
+		if err != nil || code != expected {
+			log.Println("unexpected code for", unix, code, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestVerifyTOTPAcceptsSmallClockDrift(t *testing.T) {
+	//given
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	previous, _ := TOTPCode(secret, now.Add(-TOTPPeriod))
+	outdated, _ := TOTPCode(secret, now.Add(-3*TOTPPeriod))
+
+	//then
+	if !VerifyTOTP(secret, previous, now) {
+		log.Println("code of previous period rejected")
+		t.Fail()
+	}
+	if VerifyTOTP(secret, outdated, now) || VerifyTOTP(secret, "", now) || VerifyTOTP("not base32!", previous, now) {
+		log.Println("invalid code accepted")
+		t.Fail()
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	//when
+	uri := TOTPURI("My IdP", "user@example.com", "ABC")
+
+	//then
+	if !strings.HasPrefix(uri, "otpauth://totp/My%20IdP:user@example.com?") || !strings.Contains(uri, "secret=ABC") {
+		log.Println("unexpected uri:", uri)
+		t.Fail()
+	}
+}
+
+func TestPasskeyRegistrationOptionsExcludeExistingPasskeys(t *testing.T) {
+	//given
+	passkeys, err := NewPasskeys("idp.example.com", "IdP", []string{"https://idp.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user.User{Email: "user@example.com", Passkeys: []user.Passkey{
+		{ID: "AQID", Name: "laptop", Credential: json.RawMessage(`{"id": "AQID", "publicKey": "AQID"}`)},
+	}}
+
+	//when
+	options, ceremony, err := passkeys.BeginRegistration(u)
+
+	//then
+	var creation struct {
+		PublicKey struct {
+			RP struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			ExcludeCredentials []struct {
+				ID string `json:"id"`
+			} `json:"excludeCredentials"`
+		} `json:"publicKey"`
+	}
+	if err != nil || json.Unmarshal(options, &creation) != nil || ceremony.Challenge == "" {
+		log.Println("could not begin registration:", string(options), err)
+		t.FailNow()
+	}
+	if creation.PublicKey.RP.ID != "idp.example.com" || len(creation.PublicKey.ExcludeCredentials) != 1 ||
+		creation.PublicKey.ExcludeCredentials[0].ID != "AQID" {
+		log.Println("unexpected options:", string(options))
+		t.Fail()
+	}
+}
+
+func TestPasskeysAreDisabledWithoutRelyingParty(t *testing.T) {
+	//given
+	t.Setenv("WEBAUTHN_RP_ID", "")
+
+	//when
+	passkeys, err := NewPasskeysFromEnv()
+
+	//then
+	if err != nil || passkeys.Enabled() {
+		log.Println("passkeys enabled without relying party:", err)
+		t.Fail()
+	}
+}
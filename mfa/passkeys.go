@@ -0,0 +1,227 @@
+package mfa
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"simple-login-endpoint/user"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Ceremony is the state kept between the options sent to the browser and the
+// response of the authenticator.
+type Ceremony = webauthn.SessionData
+
+type Passkeys struct {
+	webauthn *webauthn.WebAuthn
+}
+
+func NewPasskeys(rpID string, rpName string, origins []string) (passkeys *Passkeys, err error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Passkeys{webauthn: w}, nil
+}
+
+// NewPasskeysFromEnv enables passkeys for the relying party WEBAUTHN_RP_ID,
+// the domain the identity provider is served from. WEBAUTHN_RP_ORIGINS lists
+// the allowed origins (comma separated, default https://<rp id>) and
+// WEBAUTHN_RP_NAME is shown by the authenticator. Without WEBAUTHN_RP_ID
+// passkeys are disabled and nil is returned.
+func NewPasskeysFromEnv() (passkeys *Passkeys, err error) {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		return nil, nil
+	}
+
+	origins := []string{"https://" + rpID}
+	if value := os.Getenv("WEBAUTHN_RP_ORIGINS"); value != "" {
+		origins = origins[:0]
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, origin)
+			}
+		}
+	}
+
+	rpName := os.Getenv("WEBAUTHN_RP_NAME")
+	if rpName == "" {
+		rpName = rpID
+	}
+
+	return NewPasskeys(rpID, rpName, origins)
+}
+
+func Must(passkeys *Passkeys, err error) *Passkeys {
+	if err != nil {
+		panic("could not configure passkeys: " + err.Error())
+	}
+	return passkeys
+}
+
+// Enabled reports whether passkeys are configured.
+func (p *Passkeys) Enabled() bool {
+	return p != nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create.
+// Passkeys the user already has are excluded.
+func (p *Passkeys) BeginRegistration(u *user.User) (options json.RawMessage, ceremony *Ceremony, err error) {
+	account, err := newWebAuthnUser(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(account.credentials))
+	for _, credential := range account.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, ceremony, err := p.webauthn.BeginRegistration(account,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options, err = json.Marshal(creation)
+	return options, ceremony, err
+}
+
+// FinishRegistration verifies the response of navigator.credentials.create
+// and returns the new passkey.
+func (p *Passkeys) FinishRegistration(u *user.User, ceremony Ceremony, response string, name string) (*user.Passkey, error) {
+	account, err := newWebAuthnUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(response))
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := p.webauthn.CreateCredential(account, ceremony, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.Passkey{
+		ID:         base64.RawURLEncoding.EncodeToString(credential.ID),
+		Name:       name,
+		CreatedAt:  time.Now().UTC(),
+		Credential: content,
+	}, nil
+}
+
+// BeginLogin returns the options for navigator.credentials.get, limited to
+// the passkeys of the user.
+func (p *Passkeys) BeginLogin(u *user.User) (options json.RawMessage, ceremony *Ceremony, err error) {
+	account, err := newWebAuthnUser(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	assertion, ceremony, err := p.webauthn.BeginLogin(account)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options, err = json.Marshal(assertion)
+	return options, ceremony, err
+}
+
+// FinishLogin verifies the response of navigator.credentials.get and returns
+// the passkeys of the user with the updated signature counter.
+func (p *Passkeys) FinishLogin(u *user.User, ceremony Ceremony, response string) ([]user.Passkey, error) {
+	account, err := newWebAuthnUser(u)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(response))
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := p.webauthn.ValidateLogin(account, ceremony, parsed)
+	if err != nil {
+		return nil, err
+	}
+	// a counter going backwards indicates a cloned authenticator
+	if credential.Authenticator.CloneWarning {
+		return nil, errors.New("passkey may be cloned")
+	}
+
+	passkeys := make([]user.Passkey, len(u.Passkeys))
+	copy(passkeys, u.Passkeys)
+	id := base64.RawURLEncoding.EncodeToString(credential.ID)
+	for i := range passkeys {
+		if passkeys[i].ID == id {
+			if passkeys[i].Credential, err = json.Marshal(credential); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return passkeys, nil
+}
+
+// webAuthnUser adapts the user to the WebAuthn library. The user handle is
+// derived from the email, so it does not reveal the email to the
+// authenticator.
+type webAuthnUser struct {
+	user        *user.User
+	credentials []webauthn.Credential
+}
+
+func newWebAuthnUser(u *user.User) (*webAuthnUser, error) {
+	credentials := make([]webauthn.Credential, 0, len(u.Passkeys))
+	for _, passkey := range u.Passkeys {
+		var credential webauthn.Credential
+		if err := json.Unmarshal(passkey.Credential, &credential); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+	return &webAuthnUser{user: u, credentials: credentials}, nil
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	id := sha256.Sum256([]byte(u.user.Email))
+	return id[:]
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(u.user.GivenName + " " + u.user.FamilyName); name != "" {
+		return name
+	}
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
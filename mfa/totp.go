@@ -0,0 +1,110 @@
+// Package mfa implements the second factors of the login: time-based one-time
+// passwords (RFC 6238) and passkeys (WebAuthn).
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTPPeriod and TOTPDigits are the defaults of authenticator apps, other
+	// values are not offered.
+	TOTPPeriod = 30 * time.Second
+	TOTPDigits = 6
+	// totpSkew accepts the code of the previous and the next period, so
+	// clocks may drift a little.
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160 bit secret encoded as base32, the
+// form authenticator apps expect.
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPCode returns the code of the secret for the period containing t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(TOTPStep(t))), nil
+}
+
+// VerifyTOTP checks the code against the periods around t.
+func VerifyTOTP(secret string, code string, t time.Time) bool {
+	_, valid := MatchTOTP(secret, code, t)
+	return valid
+}
+
+// MatchTOTP checks the code against the periods around t and returns the
+// time step of the matching period, so a used code can be rejected later.
+func MatchTOTP(secret string, code string, t time.Time) (step int64, valid bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		at := t.Add(time.Duration(skew) * TOTPPeriod)
+		expected, err := TOTPCode(secret, at)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			step, valid = TOTPStep(at), true
+		}
+	}
+	return step, valid
+}
+
+// TOTPStep returns the number of the period containing t.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// TOTPURI returns the otpauth URI authenticator apps import, usually shown
+// as QR code.
+func TOTPURI(issuer string, account string, secret string) string {
+	query := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+		"period": {fmt.Sprint(int(TOTPPeriod / time.Second))},
+		"digits": {fmt.Sprint(TOTPDigits)},
+	}
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// hotp implements RFC 4226 with HMAC-SHA1.
+func hotp(key []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%modulo)
+}
@@ -0,0 +1,260 @@
+// Package password checks new passwords against the password policy of the
+// identity provider and keeps the history of previous passwords.
+package password
+
+import (
+	"fmt"
+	"os"
+	"simple-login-endpoint/breach"
+	"simple-login-endpoint/user"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Defaults used when the environment variables are not set.
+const (
+	DefaultMinLength  = 8
+	DefaultMinClasses = 1
+)
+
+// MaxLength is the maximal length of a password in bytes, bcrypt does not
+// hash longer passwords.
+const MaxLength = 72
+
+// minBannedLength is the length from which a banned word must not be
+// contained in the password. Shorter words, e.g. a username like "jo", only
+// must not be the whole password.
+const minBannedLength = 3
+
+// Violation is returned for a password the policy rejects. Key is the catalog
+// key of the message shown to the user, Args its arguments.
+type Violation struct {
+	Key  string
+	Args []interface{}
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprint("password policy violated: ", v.Key, v.Args)
+}
+
+type Policy struct {
+	MinLength int
+	// MinClasses is the number of character classes (lower case, upper case,
+	// digits, others) a password must contain.
+	MinClasses int
+	// BannedWords must not be contained in a password, regardless of case.
+	// The username is always banned.
+	BannedWords []string
+	// History is the number of passwords, including the current one, that can
+	// not be used again.
+	History int
+	// MaxAge requires a new password once the password is older, 0 disables
+	// the expiry.
+	MaxAge time.Duration
+	// Breaches rejects passwords of the breached password corpus, nil
+	// disables the check.
+	Breaches breach.Checker
+}
+
+func NewPolicy(minLength int, minClasses int, bannedWords []string, history int, maxAge time.Duration) (policy *Policy, err error) {
+	if minLength < 1 {
+		return nil, fmt.Errorf("minimum password length must be positive")
+	}
+	if minClasses < 0 || minClasses > 4 {
+		return nil, fmt.Errorf("character classes must be between 0 and 4")
+	}
+	if history < 0 || maxAge < 0 {
+		return nil, fmt.Errorf("password history and maximum age must not be negative")
+	}
+
+	policy = &Policy{MinLength: minLength, MinClasses: minClasses, History: history, MaxAge: maxAge}
+	for _, word := range bannedWords {
+		if word = strings.TrimSpace(word); word != "" {
+			policy.BannedWords = append(policy.BannedWords, word)
+		}
+	}
+	return policy, nil
+}
+
+// NewPolicyFromEnv reads PASSWORD_MIN_LENGTH, PASSWORD_MIN_CLASSES, the comma
+// separated PASSWORD_BANNED_WORDS, PASSWORD_HISTORY and PASSWORD_MAX_AGE. The
+// breached password corpus is configured as described in breach.NewFromEnv.
+func NewPolicyFromEnv() (policy *Policy, err error) {
+	minLength, err := envInt("PASSWORD_MIN_LENGTH", DefaultMinLength)
+	if err != nil {
+		return nil, err
+	}
+
+	minClasses, err := envInt("PASSWORD_MIN_CLASSES", DefaultMinClasses)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := envInt("PASSWORD_HISTORY", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var maxAge time.Duration
+	if value := strings.TrimSpace(os.Getenv("PASSWORD_MAX_AGE")); value != "" {
+		if maxAge, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("PASSWORD_MAX_AGE: %w", err)
+		}
+	}
+
+	policy, err = NewPolicy(minLength, minClasses, strings.Split(os.Getenv("PASSWORD_BANNED_WORDS"), ","), history, maxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.Breaches, err = breach.NewFromEnv(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func envInt(key string, fallback int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return number, nil
+}
+
+func Must(policy *Policy, err error) *Policy {
+	if err != nil {
+		panic("could not load password policy: " + err.Error())
+	}
+	return policy
+}
+
+// Check returns a *Violation if the password is not acceptable as new
+// password of the user.
+func (p *Policy) Check(password string, u *user.User) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return &Violation{Key: "password.policy.min_length", Args: []interface{}{p.MinLength}}
+	}
+	if len(password) > MaxLength {
+		return &Violation{Key: "password.policy.max_length", Args: []interface{}{MaxLength}}
+	}
+	if characterClasses(password) < p.MinClasses {
+		return &Violation{Key: "password.policy.character_classes", Args: []interface{}{p.MinClasses}}
+	}
+
+	for _, name := range usernames(u.Email) {
+		if contains(password, name) {
+			return &Violation{Key: "password.policy.username"}
+		}
+	}
+	for _, word := range p.BannedWords {
+		if contains(password, word) {
+			return &Violation{Key: "password.policy.banned_word", Args: []interface{}{word}}
+		}
+	}
+
+	if p.Breaches != nil {
+		breached, err := p.Breaches.Breached(password)
+		if err != nil {
+			return fmt.Errorf("could not check breached passwords: %w", err)
+		}
+		if breached {
+			return &Violation{Key: "password.policy.breached"}
+		}
+	}
+
+	if p.History > 0 && u.PasswordMatches(password) {
+		return &Violation{Key: "password.policy.history", Args: []interface{}{p.History}}
+	}
+	for _, hash := range u.PasswordHistory {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return &Violation{Key: "password.policy.history", Args: []interface{}{p.History}}
+		}
+	}
+	return nil
+}
+
+// Set checks the password and stores its bcrypt hash as new password of the
+// user. The previous password is added to the history, which keeps History-1
+// passwords besides the current one.
+func (p *Policy) Set(u *user.User, password string, now time.Time) error {
+	if err := p.Check(password, u); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	size := max(p.History-1, 0)
+	history := make([]string, 0, size)
+	if size > 0 && u.Password != "" {
+		previous := u.Password
+		if !user.HashedPassword(previous) {
+			hashed, err := bcrypt.GenerateFromPassword([]byte(previous), bcrypt.DefaultCost)
+			if err != nil {
+				return err
+			}
+			previous = string(hashed)
+		}
+		history = append(history, previous)
+	}
+	for _, previous := range u.PasswordHistory {
+		if len(history) < size {
+			history = append(history, previous)
+		}
+	}
+
+	u.Password = string(hash)
+	u.PasswordHistory = history
+	u.PasswordChangedAt = now
+	return nil
+}
+
+// Expired reports whether the password of the user is older than MaxAge.
+func (p *Policy) Expired(u *user.User, now time.Time) bool {
+	return p.MaxAge > 0 && !u.PasswordChangedAt.IsZero() && now.Sub(u.PasswordChangedAt) > p.MaxAge
+}
+
+// usernames returns the username and, for an email, its local part.
+func usernames(username string) []string {
+	if at := strings.LastIndex(username, "@"); at > 0 {
+		return []string{username, username[:at]}
+	}
+	return []string{username}
+}
+
+func contains(password string, word string) bool {
+	password, word = strings.ToLower(password), strings.ToLower(word)
+	if utf8.RuneCountInString(word) < minBannedLength {
+		return word != "" && password == word
+	}
+	return strings.Contains(password, word)
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
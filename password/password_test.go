@@ -0,0 +1,194 @@
+package password
+
+import (
+	"errors"
+	"log"
+	"simple-login-endpoint/breach"
+	"simple-login-endpoint/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+func violationKey(err error) string {
+	var violation *Violation
+	if errors.As(err, &violation) {
+		return violation.Key
+	}
+	return ""
+}
+
+func TestCheck(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(8, 3, []string{"secret", " "}, 0, 0))
+	u := &user.User{Email: "jane.doe@example.com"}
+
+	cases := []struct {
+		password string
+		key      string
+	}{
+		{"Correct horse 7", ""},
+		{"Sh0rt!", "password.policy.min_length"},
+		{"Kurz0ä!", "password.policy.min_length"},
+		{"correct horse", "password.policy.character_classes"},
+		{"Jane.Doe@example.com", "password.policy.username"},
+		{"my JANE.DOE 1", "password.policy.username"},
+		{"My Secret 123", "password.policy.banned_word"},
+		{strings.Repeat("Long 1", 12) + "!", "password.policy.max_length"},
+	}
+
+	for _, c := range cases {
+		//when
+		err := policy.Check(c.password, u)
+
+		//then
+		if violationKey(err) != c.key {
+			log.Println("unexpected result for", c.password, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestShortUsernameIsOnlyBannedAsWholePassword(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(2, 1, nil, 0, 0))
+	u := &user.User{Email: "jo"}
+
+	//when
+	contained := policy.Check("jolly good", u)
+	whole := policy.Check("JO", u)
+
+	//then
+	if contained != nil || violationKey(whole) != "password.policy.username" {
+		log.Println("unexpected username check:", contained, whole)
+		t.Fail()
+	}
+}
+
+func TestSetKeepsHistory(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(8, 1, nil, 2, 0))
+	u := &user.User{Email: "user@example.com", Password: "first password"}
+	now := time.Now()
+
+	//when
+	for _, password := range []string{"second password", "third password", "fourth password"} {
+		if err := policy.Set(u, password, now); err != nil {
+			log.Println("could not set password:", password, err)
+			t.FailNow()
+		}
+	}
+
+	//then
+	if !user.HashedPassword(u.Password) || !u.PasswordMatches("fourth password") || len(u.PasswordHistory) != 1 || !u.PasswordChangedAt.Equal(now) {
+		log.Println("unexpected user after password changes:", len(u.PasswordHistory))
+		t.FailNow()
+	}
+
+	for password, key := range map[string]string{
+		"fourth password": "password.policy.history",
+		"third password":  "password.policy.history",
+		"second password": "",
+		"first password":  "",
+	} {
+		//when
+		err := policy.Check(password, u)
+
+		//then
+		if violationKey(err) != key {
+			log.Println("unexpected history check for", password, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestExpired(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(8, 1, nil, 0, 24*time.Hour))
+	now := time.Now()
+
+	cases := []struct {
+		changedAt time.Time
+		expired   bool
+	}{
+		{now.Add(-25 * time.Hour), true},
+		{now.Add(-time.Hour), false},
+		{time.Time{}, false},
+	}
+
+	for _, c := range cases {
+		//when
+		expired := policy.Expired(&user.User{PasswordChangedAt: c.changedAt}, now)
+
+		//then
+		if expired != c.expired {
+			log.Println("unexpected expiry for", c.changedAt, expired)
+			t.Fail()
+		}
+	}
+
+	//given
+	policy.MaxAge = 0
+
+	//when
+	expired := policy.Expired(&user.User{PasswordChangedAt: now.Add(-1000 * time.Hour)}, now)
+
+	//then
+	if expired {
+		log.Println("password expired without maximum age")
+		t.Fail()
+	}
+}
+
+func TestNewPolicyFromEnv(t *testing.T) {
+	//given
+	for _, key := range []string{"PASSWORD_MIN_LENGTH", "PASSWORD_MIN_CLASSES", "PASSWORD_BANNED_WORDS", "PASSWORD_HISTORY", "PASSWORD_MAX_AGE"} {
+		t.Setenv(key, "")
+	}
+
+	//when
+	policy, err := NewPolicyFromEnv()
+
+	//then
+	if err != nil || policy.MinLength != DefaultMinLength || policy.MinClasses != DefaultMinClasses || policy.History != 0 || policy.MaxAge != 0 {
+		log.Println("unexpected default policy:", policy, err)
+		t.FailNow()
+	}
+
+	for key, value := range map[string]string{"PASSWORD_MIN_LENGTH": "0", "PASSWORD_MIN_CLASSES": "5", "PASSWORD_HISTORY": "x", "PASSWORD_MAX_AGE": "-1h"} {
+		//given
+		t.Setenv(key, value)
+
+		//when
+		_, err = NewPolicyFromEnv()
+
+		//then
+		if err == nil {
+			log.Println("invalid setting accepted:", key, value)
+			t.Fail()
+		}
+		t.Setenv(key, "")
+	}
+}
+
+func TestCheckRejectsBreachedPasswords(t *testing.T) {
+	//given
+	filter, err := breach.NewFilter(10, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter.Add(breach.DigestOf("Password123"))
+	policy := Must(NewPolicy(8, 1, nil, 0, 0))
+	policy.Breaches = filter
+	u := &user.User{Email: "user@example.com"}
+
+	//when
+	breached := policy.Check("Password123", u)
+	unique := policy.Check("correct horse battery", u)
+
+	//then
+	if violationKey(breached) != "password.policy.breached" || unique != nil {
+		log.Println("unexpected breach check:", breached, unique)
+		t.Fail()
+	}
+}
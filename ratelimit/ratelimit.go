@@ -0,0 +1,80 @@
+// Package ratelimit limits how often an action may be taken per key, e.g.
+// how many login codes are sent to one email address.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxKeys bounds the memory of a Limiter, the keys may come from any request.
+// Once reached, keys without events in the window are dropped first, then
+// the key with the oldest last event.
+const MaxKeys = 10000
+
+// Limiter allows Limit events per key within a sliding Window. The state is
+// held in memory and not shared between instances.
+type Limiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func NewLimiter(limit int, window time.Duration) (limiter *Limiter) {
+	return &Limiter{limit: limit, window: window, events: make(map[string][]time.Time)}
+}
+
+// Allow records an event for the key and reports whether it is within the
+// limit. Rejected events are not recorded.
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events, found := l.events[key]
+	events = l.recent(events, now)
+	if len(events) >= l.limit {
+		l.events[key] = events
+		return false
+	}
+
+	if !found && len(l.events) >= MaxKeys {
+		l.evict(now)
+	}
+	l.events[key] = append(events, now)
+	return true
+}
+
+// Reset forgets the events of the key, e.g. after a successful login.
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.events, key)
+}
+
+func (l *Limiter) recent(events []time.Time, now time.Time) []time.Time {
+	start := 0
+	for start < len(events) && now.Sub(events[start]) >= l.window {
+		start++
+	}
+	return events[start:]
+}
+
+func (l *Limiter) evict(now time.Time) {
+	oldestKey, oldest := "", now
+	for key, events := range l.events {
+		events = l.recent(events, now)
+		if len(events) == 0 {
+			delete(l.events, key)
+			continue
+		}
+		if last := events[len(events)-1]; !last.After(oldest) {
+			oldestKey, oldest = key, last
+		}
+	}
+
+	if len(l.events) >= MaxKeys {
+		delete(l.events, oldestKey)
+	}
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	//given
+	limiter := NewLimiter(2, time.Minute)
+	now := time.Now()
+
+	//when
+	first := limiter.Allow("user@example.com", now)
+	second := limiter.Allow("user@example.com", now.Add(10*time.Second))
+	third := limiter.Allow("user@example.com", now.Add(20*time.Second))
+	other := limiter.Allow("other@example.com", now.Add(20*time.Second))
+	later := limiter.Allow("user@example.com", now.Add(61*time.Second))
+
+	//then
+	if !first || !second || third || !other || !later {
+		log.Println("unexpected limits:", first, second, third, other, later)
+		t.Fail()
+	}
+
+	//when
+	limiter.Reset("user@example.com")
+
+	//then
+	if !limiter.Allow("user@example.com", now.Add(62*time.Second)) {
+		log.Println("limit not reset")
+		t.Fail()
+	}
+}
+
+func TestKeysAreBounded(t *testing.T) {
+	//given
+	limiter := NewLimiter(1, time.Hour)
+	now := time.Now()
+	limiter.Allow("first", now)
+
+	//when
+	for i := 1; i <= MaxKeys; i++ {
+		limiter.Allow(fmt.Sprint("key-", i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	//then
+	if len(limiter.events) != MaxKeys || !limiter.Allow("first", now.Add(time.Second)) {
+		log.Println("oldest key not dropped:", len(limiter.events))
+		t.Fail()
+	}
+}
@@ -0,0 +1,241 @@
+// Package realm separates the user bases of several products behind one
+// Hydra. Each realm has its own users, groups, password policy, theme and
+// clients. The subjects of a realm are prefixed with its name, so the same
+// email in two realms are two different subjects.
+package realm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/password"
+	"simple-login-endpoint/user"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MetadataRealm selects the realm of a client in the metadata of the Hydra
+// client.
+const MetadataRealm = "realm"
+
+// Separator separates the realm name from the email in a subject, e.g.
+// shop:anna@example.com.
+const Separator = ":"
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Realm is a separate user base. The default realm has no name and its
+// subjects are plain emails.
+type Realm struct {
+	Name string
+	// Hosts select the realm for requests sent to one of them.
+	Hosts []string
+	// Clients select the realm for their logins. Without clients, any client
+	// may use the realm.
+	Clients   []string
+	Theme     string
+	Users     user.UserRepository
+	Groups    user.GroupRepository
+	Passwords *password.Policy
+}
+
+// Subject returns the subject of the user with the email.
+func (rl *Realm) Subject(email string) string {
+	if rl.Name == "" {
+		return email
+	}
+	return rl.Name + Separator + email
+}
+
+// AllowsClient reports whether users of the realm may log in to the client.
+func (rl *Realm) AllowsClient(clientID string) bool {
+	return len(rl.Clients) == 0 || slices.Contains(rl.Clients, clientID)
+}
+
+// Registry holds the named realms.
+type Registry struct {
+	realms []*Realm
+	byName map[string]*Realm
+}
+
+// NewRegistry fails if a name is invalid or a name, host or client is used
+// by two realms.
+func NewRegistry(realms ...*Realm) (registry *Registry, err error) {
+	registry = &Registry{byName: make(map[string]*Realm)}
+	hosts := make(map[string]string)
+	clients := make(map[string]string)
+
+	for _, rl := range realms {
+		if !validName.MatchString(rl.Name) {
+			return nil, fmt.Errorf("invalid realm name %q", rl.Name)
+		}
+		if _, found := registry.byName[rl.Name]; found {
+			return nil, fmt.Errorf("duplicate realm %s", rl.Name)
+		}
+		for i, host := range rl.Hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if other, found := hosts[host]; found {
+				return nil, fmt.Errorf("host %s used by realms %s and %s", host, other, rl.Name)
+			}
+			hosts[host] = rl.Name
+			rl.Hosts[i] = host
+		}
+		for _, clientID := range rl.Clients {
+			if other, found := clients[clientID]; found {
+				return nil, fmt.Errorf("client %s used by realms %s and %s", clientID, other, rl.Name)
+			}
+			clients[clientID] = rl.Name
+		}
+
+		registry.realms = append(registry.realms, rl)
+		registry.byName[rl.Name] = rl
+	}
+
+	return registry, nil
+}
+
+func Must(registry *Registry, err error) *Registry {
+	if err != nil {
+		panic("could not load realms: " + err.Error())
+	}
+	return registry
+}
+
+// Empty reports whether there is only the default realm.
+func (r *Registry) Empty() bool {
+	return len(r.realms) == 0
+}
+
+func (r *Registry) Get(name string) (*Realm, bool) {
+	rl, found := r.byName[name]
+	return rl, found
+}
+
+// Select returns the name of the realm for a login of the client on the
+// host: the realm of the client metadata, the realm listing the client or
+// the realm of the host, in this order. The default realm is "". The name
+// of the metadata is returned even if there is no such realm.
+func (r *Registry) Select(client *flow.Client, host string) string {
+	if client != nil {
+		if name, ok := client.Metadata[MetadataRealm].(string); ok && name != "" {
+			return name
+		}
+		for _, rl := range r.realms {
+			if slices.Contains(rl.Clients, client.ClientID) {
+				return rl.Name
+			}
+		}
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	for _, rl := range r.realms {
+		if slices.Contains(rl.Hosts, host) {
+			return rl.Name
+		}
+	}
+	return ""
+}
+
+// Split returns the realm name and the email of a subject. Subjects without
+// the name of a known realm belong to the default realm.
+func (r *Registry) Split(subject string) (name string, email string) {
+	if name, email, found := strings.Cut(subject, Separator); found {
+		if _, known := r.byName[name]; known {
+			return name, email
+		}
+	}
+	return "", subject
+}
+
+type nameKey struct{}
+
+// WithName stores the name of the realm selected for the request, so the
+// pages use the theme of the realm.
+func WithName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, nameKey{}, name)
+}
+
+func NameFromContext(ctx context.Context) (name string, found bool) {
+	name, found = ctx.Value(nameKey{}).(string)
+	return name, found
+}
+
+// Config describes a realm in the REALMS_FILE. The users and groups files
+// have the format of import/users.json and import/groups.json.
+type Config struct {
+	Name       string          `json:"name"`
+	Hosts      []string        `json:"hosts,omitempty"`
+	Clients    []string        `json:"clients,omitempty"`
+	Theme      string          `json:"theme,omitempty"`
+	UsersFile  string          `json:"users_file"`
+	GroupsFile string          `json:"groups_file,omitempty"`
+	Password   *PasswordConfig `json:"password,omitempty"`
+}
+
+// PasswordConfig replaces the global password policy for a realm. Unset
+// lengths fall back to the defaults of the password package.
+type PasswordConfig struct {
+	MinLength   int      `json:"min_length,omitempty"`
+	MinClasses  int      `json:"min_classes,omitempty"`
+	BannedWords []string `json:"banned_words,omitempty"`
+	History     int      `json:"history,omitempty"`
+	MaxAge      string   `json:"max_age,omitempty"`
+}
+
+// LoadConfigs reads the JSON file REALMS_FILE. Without the file there is
+// only the default realm.
+func LoadConfigs() (configs []Config, err error) {
+	file := os.Getenv("REALMS_FILE")
+	if file == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &configs); err != nil {
+		return nil, fmt.Errorf("realms %s: %w", file, err)
+	}
+	return configs, nil
+}
+
+// Policy returns the password policy of the realm, which shares the breach
+// checker of the global policy. Without configuration the global policy
+// applies.
+func (c *PasswordConfig) Policy(global *password.Policy) (*password.Policy, error) {
+	if c == nil {
+		return global, nil
+	}
+
+	var maxAge time.Duration
+	if c.MaxAge != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(c.MaxAge); err != nil {
+			return nil, fmt.Errorf("max_age: %w", err)
+		}
+	}
+
+	minLength, minClasses := c.MinLength, c.MinClasses
+	if minLength == 0 {
+		minLength = password.DefaultMinLength
+	}
+	if minClasses == 0 {
+		minClasses = password.DefaultMinClasses
+	}
+
+	policy, err := password.NewPolicy(minLength, minClasses, c.BannedWords, c.History, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	policy.Breaches = global.Breaches
+	return policy, nil
+}
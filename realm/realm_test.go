@@ -0,0 +1,119 @@
+package realm
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"simple-login-endpoint/flow"
+	"simple-login-endpoint/password"
+	"testing"
+	"time"
+)
+
+func TestSelect(t *testing.T) {
+	//given
+	registry := Must(NewRegistry(
+		&Realm{Name: "shop", Hosts: []string{"Login.Shop.example"}, Clients: []string{"shop-web"}},
+		&Realm{Name: "partner", Hosts: []string{"partner.example"}},
+	))
+
+	cases := []struct {
+		client *flow.Client
+		host   string
+		realm  string
+	}{
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataRealm: "partner"}}, "login.shop.example", "partner"},
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataRealm: "unknown"}}, "", "unknown"},
+		{&flow.Client{ClientID: "shop-web"}, "partner.example", "shop"},
+		{&flow.Client{ClientID: "app"}, "login.shop.example:443", "shop"},
+		{nil, "partner.example", "partner"},
+		{&flow.Client{ClientID: "app"}, "idp.example", ""},
+	}
+
+	for _, c := range cases {
+		//when
+		name := registry.Select(c.client, c.host)
+
+		//then
+		if name != c.realm {
+			log.Println("unexpected realm for", c.client, c.host, name)
+			t.Fail()
+		}
+	}
+}
+
+func TestSubjects(t *testing.T) {
+	//given
+	registry := Must(NewRegistry(&Realm{Name: "shop"}))
+	shop, _ := registry.Get("shop")
+
+	//when
+	subject := shop.Subject("anna@example.com")
+	name, email := registry.Split(subject)
+
+	//then
+	if subject != "shop:anna@example.com" || name != "shop" || email != "anna@example.com" {
+		log.Println("unexpected subject:", subject, name, email)
+		t.Fail()
+	}
+
+	if name, email := registry.Split("other:anna@example.com"); name != "" || email != "other:anna@example.com" {
+		log.Println("unknown realm not in default realm:", name, email)
+		t.Fail()
+	}
+
+	if subject := (&Realm{}).Subject("anna@example.com"); subject != "anna@example.com" {
+		log.Println("subject of default realm must be the email:", subject)
+		t.Fail()
+	}
+}
+
+func TestNewRegistryRejectsConflicts(t *testing.T) {
+	for _, realms := range [][]*Realm{
+		{{Name: ""}},
+		{{Name: "Shop:1"}},
+		{{Name: "shop"}, {Name: "shop"}},
+		{{Name: "shop", Hosts: []string{"login.example"}}, {Name: "partner", Hosts: []string{"LOGIN.example"}}},
+		{{Name: "shop", Clients: []string{"app"}}, {Name: "partner", Clients: []string{"app"}}},
+	} {
+		//when
+		_, err := NewRegistry(realms...)
+
+		//then
+		if err == nil {
+			log.Println("conflicting realms accepted:", realms[0].Name)
+			t.Fail()
+		}
+	}
+}
+
+func TestLoadConfigs(t *testing.T) {
+	//given
+	file := filepath.Join(t.TempDir(), "realms.json")
+	content := `[{"name": "shop", "users_file": "shop.json", "password": {"min_length": 12, "max_age": "720h"}}]`
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REALMS_FILE", file)
+	global := password.Must(password.NewPolicy(password.DefaultMinLength, password.DefaultMinClasses, nil, 0, 0))
+
+	//when
+	configs, err := LoadConfigs()
+
+	//then
+	if err != nil || len(configs) != 1 || configs[0].UsersFile != "shop.json" {
+		log.Println("unexpected configs:", configs, err)
+		t.FailNow()
+	}
+
+	policy, err := configs[0].Password.Policy(global)
+	if err != nil || policy.MinLength != 12 || policy.MinClasses != password.DefaultMinClasses || policy.MaxAge != 720*time.Hour {
+		log.Println("unexpected password policy:", policy, err)
+		t.Fail()
+	}
+
+	if policy, _ := (*PasswordConfig)(nil).Policy(global); policy != global {
+		log.Println("global policy not used without configuration")
+		t.Fail()
+	}
+}
@@ -0,0 +1,153 @@
+package redirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Rule rewrites every URL starting with Match (scheme, host and path prefix)
+// to Replacement. A rule with a RequestHost only applies to requests which
+// reached the identity provider under that host.
+type Rule struct {
+	RequestHost string `json:"request_host,omitempty"`
+	Match       string `json:"match"`
+	Replacement string `json:"replacement"`
+
+	match       *url.URL
+	replacement *url.URL
+}
+
+func (r *Rule) compile() (err error) {
+	if r.match, err = url.Parse(strings.TrimSpace(r.Match)); err != nil {
+		return fmt.Errorf("invalid match %q: %w", r.Match, err)
+	}
+	if r.match.Host == "" {
+		return fmt.Errorf("match %q has no host", r.Match)
+	}
+
+	if r.replacement, err = url.Parse(strings.TrimSpace(r.Replacement)); err != nil {
+		return fmt.Errorf("invalid replacement %q: %w", r.Replacement, err)
+	}
+	if r.replacement.Host == "" {
+		return fmt.Errorf("replacement %q has no host", r.Replacement)
+	}
+
+	return nil
+}
+
+func (r *Rule) appliesTo(requestHost string) bool {
+	if r.RequestHost == "" {
+		return true
+	}
+	return strings.EqualFold(stripPort(r.RequestHost), stripPort(requestHost))
+}
+
+// rewrite returns the rewritten URL and whether the rule matched.
+func (r *Rule) rewrite(target *url.URL) (*url.URL, bool) {
+	if r.match.Scheme != "" && !strings.EqualFold(r.match.Scheme, target.Scheme) {
+		return nil, false
+	}
+	if !strings.EqualFold(r.match.Host, target.Host) {
+		return nil, false
+	}
+
+	prefix := strings.TrimSuffix(r.match.Path, "/")
+	if target.Path != prefix && !strings.HasPrefix(target.Path, prefix+"/") {
+		return nil, false
+	}
+
+	rewritten := *target
+	rewritten.Scheme = r.replacement.Scheme
+	rewritten.Host = r.replacement.Host
+	rewritten.Path = strings.TrimSuffix(r.replacement.Path, "/") + strings.TrimPrefix(target.Path, prefix)
+	rewritten.RawPath = ""
+
+	return &rewritten, true
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Rewriter applies the first matching rule to the redirect URLs returned by
+// Hydra. URLs without a matching rule are returned unchanged.
+type Rewriter struct {
+	rules []*Rule
+}
+
+func NewRewriter(rules ...Rule) (rewriter *Rewriter, err error) {
+	rewriter = &Rewriter{}
+
+	for i := range rules {
+		rule := rules[i]
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+		rewriter.rules = append(rewriter.rules, &rule)
+	}
+
+	return rewriter, nil
+}
+
+// NewRewriterFromEnv reads the rules from the JSON file REDIRECT_RULES_FILE.
+// For compatibility ALTERNATIVE_REDIRECT_HYDRA_URL adds rules replacing
+// ISSUER_URI and HYDRA_PUBLIC_URL, evaluated after the rules of the file.
+func NewRewriterFromEnv() (rewriter *Rewriter, err error) {
+	rules := make([]Rule, 0)
+
+	if file := os.Getenv("REDIRECT_RULES_FILE"); file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(content, &rules); err != nil {
+			return nil, fmt.Errorf("redirect rules %s: %w", file, err)
+		}
+	}
+
+	if replacement := strings.TrimSpace(os.Getenv("ALTERNATIVE_REDIRECT_HYDRA_URL")); replacement != "" {
+		for _, env := range []string{"ISSUER_URI", "HYDRA_PUBLIC_URL"} {
+			if match := strings.TrimSpace(os.Getenv(env)); match != "" {
+				rules = append(rules, Rule{Match: match, Replacement: replacement})
+			}
+		}
+	}
+
+	return NewRewriter(rules...)
+}
+
+func Must(rewriter *Rewriter, err error) *Rewriter {
+	if err != nil {
+		panic("could not load redirect rules: " + err.Error())
+	}
+	return rewriter
+}
+
+func (rw *Rewriter) Rewrite(requestHost string, target string) string {
+	if len(rw.rules) == 0 {
+		return target
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	for _, rule := range rw.rules {
+		if !rule.appliesTo(requestHost) {
+			continue
+		}
+		if rewritten, ok := rule.rewrite(parsed); ok {
+			return rewritten.String()
+		}
+	}
+
+	return target
+}
@@ -0,0 +1,78 @@
+package redirect
+
+import (
+	"log"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	//given
+	rewriter, err := NewRewriter(
+		Rule{RequestHost: "intranet.example.com", Match: "https://hydra:4444/", Replacement: "https://intranet.example.com/oauth"},
+		Rule{Match: "https://hydra:4444/", Replacement: "https://login.example.com"},
+		Rule{Match: "http://localhost:4444/oauth2", Replacement: "https://public.example.com/auth"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		requestHost string
+		target      string
+		wanted      string
+	}{
+		{"idp:3000", "https://hydra:4444/oauth2/auth?login_verifier=abc", "https://login.example.com/oauth2/auth?login_verifier=abc"},
+		{"intranet.example.com:443", "https://hydra:4444/oauth2/auth?consent_verifier=abc", "https://intranet.example.com/oauth/oauth2/auth?consent_verifier=abc"},
+		{"idp:3000", "http://localhost:4444/oauth2/auth?x=1", "https://public.example.com/auth/auth?x=1"},
+		// only whole path segments match
+		{"idp:3000", "http://localhost:4444/oauth2x/auth", "http://localhost:4444/oauth2x/auth"},
+		// the host is compared, not a substring of the URL
+		{"idp:3000", "https://client.example.com/callback?next=https://hydra:4444/", "https://client.example.com/callback?next=https://hydra:4444/"},
+		{"idp:3000", "http://hydra:4444/oauth2/auth", "http://hydra:4444/oauth2/auth"},
+	}
+
+	for _, c := range cases {
+		//when
+		rewritten := rewriter.Rewrite(c.requestHost, c.target)
+
+		//then
+		if rewritten != c.wanted {
+			log.Printf("%s from %s: got %s but wanted %s", c.target, c.requestHost, rewritten, c.wanted)
+			t.Fail()
+		}
+	}
+}
+
+func TestRewriterFromLegacyEnv(t *testing.T) {
+	//given
+	t.Setenv("REDIRECT_RULES_FILE", "")
+	t.Setenv("HYDRA_PUBLIC_URL", "https://hydra:4444")
+	t.Setenv("ISSUER_URI", "https://localhost:4444/")
+	t.Setenv("ALTERNATIVE_REDIRECT_HYDRA_URL", "https://login.example.com")
+
+	rewriter, err := NewRewriterFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	fromIssuer := rewriter.Rewrite("", "https://localhost:4444/oauth2/auth")
+	fromPublic := rewriter.Rewrite("", "https://hydra:4444/oauth2/auth")
+
+	//then
+	if fromIssuer != "https://login.example.com/oauth2/auth" || fromPublic != "https://login.example.com/oauth2/auth" {
+		log.Println("unexpected rewrites:", fromIssuer, fromPublic)
+		t.Fail()
+	}
+}
+
+func TestInvalidRule(t *testing.T) {
+	//when
+	_, err := NewRewriter(Rule{Match: "/oauth2", Replacement: "https://login.example.com"})
+
+	//then
+	if err == nil {
+		log.Println("rule without host accepted")
+		t.Fail()
+	}
+}
@@ -0,0 +1,115 @@
+// Package registration decides for which clients and email domains users may
+// register themselves.
+package registration
+
+import (
+	"os"
+	"simple-login-endpoint/flow"
+	"strconv"
+	"strings"
+)
+
+// Client metadata keys overriding the global settings for one client.
+// registration is a boolean, registration_domains a list of domains or a
+// comma separated string.
+const (
+	MetadataRegistration        = "registration"
+	MetadataRegistrationDomains = "registration_domains"
+)
+
+// Policy holds the global setting. Without allowed domains every domain may
+// register.
+type Policy struct {
+	Enabled bool
+	Domains []string
+}
+
+func NewPolicy(enabled bool, domains ...string) *Policy {
+	return &Policy{Enabled: enabled, Domains: normalizeDomains(domains)}
+}
+
+// NewPolicyFromEnv reads REGISTRATION_ENABLED and the comma separated
+// REGISTRATION_DOMAINS.
+func NewPolicyFromEnv() *Policy {
+	enabled, _ := strconv.ParseBool(os.Getenv("REGISTRATION_ENABLED"))
+	return NewPolicy(enabled, strings.Split(os.Getenv("REGISTRATION_DOMAINS"), ",")...)
+}
+
+// Allowed reports whether users may register when the client asks for the
+// login. A nil client stands for the account page of the identity provider.
+func (p *Policy) Allowed(client *flow.Client) bool {
+	if client != nil {
+		switch enabled := client.Metadata[MetadataRegistration].(type) {
+		case bool:
+			return enabled
+		case string:
+			return strings.EqualFold(enabled, "true")
+		}
+	}
+	return p.Enabled
+}
+
+// DomainAllowed reports whether the domain of the email may register for the
+// client. The domains of the client replace the global ones.
+func (p *Policy) DomainAllowed(client *flow.Client, email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domains := p.Domains
+	if client != nil {
+		if clientDomains := metadataDomains(client.Metadata[MetadataRegistrationDomains]); len(clientDomains) > 0 {
+			domains = clientDomains
+		}
+	}
+	if len(domains) == 0 {
+		return true
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// SignInAllowed reports whether a user who registered with the email may
+// sign in to the client. Only the domains of the client restrict the login,
+// a registration without login challenge or for another client does not get
+// around them.
+func (p *Policy) SignInAllowed(client *flow.Client, email string) bool {
+	if client == nil || len(metadataDomains(client.Metadata[MetadataRegistrationDomains])) == 0 {
+		return true
+	}
+	return p.DomainAllowed(client, email)
+}
+
+func metadataDomains(value interface{}) []string {
+	switch domains := value.(type) {
+	case string:
+		return normalizeDomains(strings.Split(domains, ","))
+	case []interface{}:
+		var values []string
+		for _, domain := range domains {
+			if domain, ok := domain.(string); ok {
+				values = append(values, domain)
+			}
+		}
+		return normalizeDomains(values)
+	default:
+		return nil
+	}
+}
+
+func normalizeDomains(domains []string) []string {
+	var normalized []string
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@")); domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
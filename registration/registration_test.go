@@ -0,0 +1,121 @@
+package registration
+
+import (
+	"log"
+	"simple-login-endpoint/flow"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	//given
+	policy := NewPolicy(false)
+
+	cases := []struct {
+		client  *flow.Client
+		allowed bool
+	}{
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataRegistration: true}}, true},
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataRegistration: "true"}}, true},
+		{&flow.Client{ClientID: "app"}, false},
+		{nil, false},
+	}
+
+	for _, c := range cases {
+		//when
+		allowed := policy.Allowed(c.client)
+
+		//then
+		if allowed != c.allowed {
+			log.Println("unexpected registration for", c.client, allowed)
+			t.Fail()
+		}
+	}
+
+	//given
+	policy = NewPolicy(true)
+
+	//when
+	allowed := policy.Allowed(&flow.Client{ClientID: "partner", Metadata: map[string]interface{}{MetadataRegistration: false}})
+
+	//then
+	if allowed {
+		log.Println("client could not disable registration")
+		t.Fail()
+	}
+}
+
+func TestDomainAllowed(t *testing.T) {
+	//given
+	policy := NewPolicy(true, " Example.com", "@example.org", "")
+	partner := &flow.Client{ClientID: "partner", Metadata: map[string]interface{}{
+		MetadataRegistrationDomains: []interface{}{"partner.com"},
+	}}
+
+	cases := []struct {
+		client  *flow.Client
+		email   string
+		allowed bool
+	}{
+		{nil, "user@example.com", true},
+		{nil, "user@EXAMPLE.org", true},
+		{nil, "user@example.net", false},
+		{nil, "user@sub.example.com", false},
+		{nil, "user", false},
+		{partner, "user@partner.com", true},
+		{partner, "user@example.com", false},
+		{&flow.Client{ClientID: "app"}, "user@example.com", true},
+	}
+
+	for _, c := range cases {
+		//when
+		allowed := policy.DomainAllowed(c.client, c.email)
+
+		//then
+		if allowed != c.allowed {
+			log.Println("unexpected domain check for", c.email, allowed)
+			t.Fail()
+		}
+	}
+
+	//given
+	policy = NewPolicy(true)
+
+	//when
+	allowed := policy.DomainAllowed(nil, "user@anything.com")
+
+	//then
+	if !allowed {
+		log.Println("domain rejected without allowlist")
+		t.Fail()
+	}
+}
+
+func TestSignInAllowed(t *testing.T) {
+	//given
+	policy := NewPolicy(true, "example.com")
+	partner := &flow.Client{ClientID: "partner", Metadata: map[string]interface{}{
+		MetadataRegistrationDomains: "partner.com",
+	}}
+
+	cases := []struct {
+		client  *flow.Client
+		email   string
+		allowed bool
+	}{
+		{partner, "user@partner.com", true},
+		{partner, "user@example.com", false},
+		{&flow.Client{ClientID: "app"}, "user@example.org", true},
+		{nil, "user@example.org", true},
+	}
+
+	for _, c := range cases {
+		//when
+		allowed := policy.SignInAllowed(c.client, c.email)
+
+		//then
+		if allowed != c.allowed {
+			log.Println("unexpected sign in for", c.email, allowed)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Package remember decides for how long Hydra remembers a login or consent.
+package remember
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"simple-login-endpoint/flow"
+	"strings"
+	"time"
+)
+
+// Client metadata keys overriding the global durations for one client. The
+// values are durations like "8h" or "720h".
+const (
+	MetadataLoginRememberFor   = "login_remember_for"
+	MetadataConsentRememberFor = "consent_remember_for"
+)
+
+// Policy holds the remember durations. A duration of 0 lets Hydra remember
+// the login for the lifespan of the browser session and the consent
+// indefinitely. A consent containing a sensitive scope is never remembered,
+// so the user is asked again on every authorization.
+type Policy struct {
+	LoginFor        time.Duration
+	ConsentFor      time.Duration
+	SensitiveScopes map[string]bool
+}
+
+func NewPolicy(loginFor time.Duration, consentFor time.Duration, sensitiveScopes ...string) (policy *Policy, err error) {
+	if loginFor < 0 || consentFor < 0 {
+		return nil, fmt.Errorf("remember durations must not be negative")
+	}
+
+	policy = &Policy{
+		LoginFor:        loginFor,
+		ConsentFor:      consentFor,
+		SensitiveScopes: make(map[string]bool),
+	}
+	for _, scope := range sensitiveScopes {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			policy.SensitiveScopes[scope] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// NewPolicyFromEnv reads LOGIN_REMEMBER_FOR, CONSENT_REMEMBER_FOR and the
+// comma separated SENSITIVE_SCOPES.
+func NewPolicyFromEnv() (policy *Policy, err error) {
+	loginFor, err := envDuration("LOGIN_REMEMBER_FOR")
+	if err != nil {
+		return nil, err
+	}
+
+	consentFor, err := envDuration("CONSENT_REMEMBER_FOR")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPolicy(loginFor, consentFor, strings.Split(os.Getenv("SENSITIVE_SCOPES"), ",")...)
+}
+
+func envDuration(key string) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return duration, nil
+}
+
+func Must(policy *Policy, err error) *Policy {
+	if err != nil {
+		panic("could not load remember policy: " + err.Error())
+	}
+	return policy
+}
+
+// Login returns the remember_for of a login in seconds.
+func (p *Policy) Login(client *flow.Client) (rememberFor int64) {
+	return seconds(clientDuration(client, MetadataLoginRememberFor, p.LoginFor))
+}
+
+// Consent returns whether the consent for the granted scopes is remembered
+// and the remember_for in seconds.
+func (p *Policy) Consent(client *flow.Client, grantedScopes []string) (remember bool, rememberFor int64) {
+	for _, scope := range grantedScopes {
+		if p.SensitiveScopes[scope] {
+			return false, 0
+		}
+	}
+	return true, seconds(clientDuration(client, MetadataConsentRememberFor, p.ConsentFor))
+}
+
+func clientDuration(client *flow.Client, key string, fallback time.Duration) time.Duration {
+	if client == nil {
+		return fallback
+	}
+
+	value, found := client.Metadata[key]
+	if !found {
+		return fallback
+	}
+
+	text, _ := value.(string)
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration < 0 {
+		slog.Warn("invalid remember duration in client metadata, using default", "client_id", client.ClientID, "key", key, "value", value)
+		return fallback
+	}
+	return duration
+}
+
+func seconds(duration time.Duration) int64 {
+	return int64(duration / time.Second)
+}
@@ -0,0 +1,87 @@
+package remember
+
+import (
+	"log"
+	"simple-login-endpoint/flow"
+	"testing"
+	"time"
+)
+
+func TestLoginUsesClientMetadata(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(8*time.Hour, 0))
+	client := &flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataLoginRememberFor: "30m"}}
+
+	//when
+	clientRememberFor := policy.Login(client)
+	defaultRememberFor := policy.Login(&flow.Client{ClientID: "other"})
+
+	//then
+	if clientRememberFor != 1800 || defaultRememberFor != 8*3600 {
+		log.Println("unexpected remember_for:", clientRememberFor, defaultRememberFor)
+		t.Fail()
+	}
+}
+
+func TestInvalidClientMetadataFallsBack(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(time.Hour, 0))
+	client := &flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataLoginRememberFor: 42}}
+
+	//when
+	rememberFor := policy.Login(client)
+
+	//then
+	if rememberFor != 3600 {
+		log.Println("unexpected remember_for:", rememberFor)
+		t.Fail()
+	}
+}
+
+func TestConsentWithSensitiveScopeIsNotRemembered(t *testing.T) {
+	//given
+	policy := Must(NewPolicy(0, 24*time.Hour, "offline_access", " admin "))
+
+	//when
+	remember, rememberFor := policy.Consent(nil, []string{"openid", "admin"})
+
+	//then
+	if remember || rememberFor != 0 {
+		log.Println("sensitive consent remembered")
+		t.Fail()
+	}
+
+	//when
+	remember, rememberFor = policy.Consent(nil, []string{"openid", "email"})
+
+	//then
+	if !remember || rememberFor != 24*3600 {
+		log.Println("unexpected consent remember:", remember, rememberFor)
+		t.Fail()
+	}
+}
+
+func TestNewPolicyFromEnv(t *testing.T) {
+	//given
+	t.Setenv("LOGIN_REMEMBER_FOR", "1h")
+	t.Setenv("CONSENT_REMEMBER_FOR", "720h")
+	t.Setenv("SENSITIVE_SCOPES", "offline_access,admin")
+
+	//when
+	policy, err := NewPolicyFromEnv()
+
+	//then
+	if err != nil || policy.LoginFor != time.Hour || policy.ConsentFor != 720*time.Hour || !policy.SensitiveScopes["admin"] {
+		log.Println("unexpected policy:", policy, err)
+		t.FailNow()
+	}
+
+	//given
+	t.Setenv("LOGIN_REMEMBER_FOR", "-1h")
+
+	//when
+	if _, err := NewPolicyFromEnv(); err == nil {
+		log.Println("negative duration accepted")
+		t.Fail()
+	}
+}
@@ -0,0 +1,162 @@
+package render
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+)
+
+const TemplatePattern = "*.html"
+
+// Renderer holds the parsed page templates. Templates are parsed once from
+// the base file system; files in the override directories replace base
+// templates with the same name, later directories win. In development mode
+// every render re-parses the templates so changes on disk are picked up
+// without a restart.
+type Renderer struct {
+	mu           sync.RWMutex
+	base         fs.FS
+	overrideDirs []string
+	devMode      bool
+	required     []string
+	templates    map[string]*template.Template
+}
+
+func New(base fs.FS, overrideDir string, devMode bool, required ...string) (renderer *Renderer, err error) {
+	renderer = &Renderer{
+		base:     base,
+		devMode:  devMode,
+		required: required,
+	}
+
+	if overrideDir != "" {
+		renderer.overrideDirs = []string{overrideDir}
+	}
+
+	if err := renderer.parse(); err != nil {
+		return nil, err
+	}
+
+	return renderer, nil
+}
+
+// NewFromEnv uses the embedded templates unless DEV_MODE is set, in which case
+// they are read from TEMPLATE_SOURCE_DIR (default "view"). TEMPLATE_DIR
+// points to an optional directory with custom templates.
+func NewFromEnv(embedded fs.FS, required ...string) (renderer *Renderer, err error) {
+	devMode, _ := strconv.ParseBool(os.Getenv("DEV_MODE"))
+
+	base := embedded
+	if devMode {
+		sourceDir, found := os.LookupEnv("TEMPLATE_SOURCE_DIR")
+		if !found {
+			sourceDir = "view"
+		}
+		slog.Info("development mode, templates are parsed from disk", "dir", sourceDir)
+		base = os.DirFS(sourceDir)
+	}
+
+	return New(base, os.Getenv("TEMPLATE_DIR"), devMode, required...)
+}
+
+func Must(renderer *Renderer, err error) *Renderer {
+	if err != nil {
+		panic("could not parse templates: " + err.Error())
+	}
+	return renderer
+}
+
+func (r *Renderer) parse() error {
+	templates := make(map[string]*template.Template)
+
+	if err := parseInto(templates, r.base); err != nil {
+		return err
+	}
+
+	for _, dir := range r.overrideDirs {
+		if err := parseInto(templates, os.DirFS(dir)); err != nil {
+			return fmt.Errorf("override templates in %s: %w", dir, err)
+		}
+	}
+
+	for _, name := range r.required {
+		if _, found := templates[name]; !found {
+			return fmt.Errorf("template %s is missing", name)
+		}
+	}
+
+	r.mu.Lock()
+	r.templates = templates
+	r.mu.Unlock()
+
+	return nil
+}
+
+func parseInto(templates map[string]*template.Template, fsys fs.FS) error {
+	names, err := fs.Glob(fsys, TemplatePattern)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		tmpl, err := template.New(path.Base(name)).Parse(string(content))
+		if err != nil {
+			return err
+		}
+		templates[name] = tmpl
+	}
+
+	return nil
+}
+
+// WithOverride returns a renderer which additionally uses the templates of
+// the given directory, e.g. the templates of a client theme.
+func (r *Renderer) WithOverride(dir string) (renderer *Renderer, err error) {
+	renderer = &Renderer{
+		base:         r.base,
+		overrideDirs: append(append([]string{}, r.overrideDirs...), dir),
+		devMode:      r.devMode,
+		required:     r.required,
+	}
+
+	if err := renderer.parse(); err != nil {
+		return nil, err
+	}
+
+	return renderer, nil
+}
+
+// HasTemplates reports whether the directory contains any page template.
+func HasTemplates(dir string) bool {
+	names, err := fs.Glob(os.DirFS(dir), TemplatePattern)
+	return err == nil && len(names) > 0
+}
+
+func (r *Renderer) Render(w io.Writer, name string, data interface{}) error {
+	if r.devMode {
+		if err := r.parse(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.RLock()
+	tmpl, found := r.templates[name]
+	r.mu.RUnlock()
+
+	if !found {
+		return fmt.Errorf("template %s not found", name)
+	}
+
+	return tmpl.Execute(w, data)
+}
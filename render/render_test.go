@@ -0,0 +1,86 @@
+package render
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOverrideDirReplacesTemplate(t *testing.T) {
+	//given
+	base := fstest.MapFS{
+		"login.html": {Data: []byte("base {{.Name}}")},
+		"error.html": {Data: []byte("error")},
+	}
+	overrideDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(overrideDir, "login.html"), []byte("custom {{.Name}}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	renderer, err := New(base, overrideDir, false, "login.html", "error.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	var buf bytes.Buffer
+	err = renderer.Render(&buf, "login.html", map[string]string{"Name": "<b>"})
+
+	//then
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "custom &lt;b&gt;" {
+		log.Println("unexpected output:", buf.String())
+		t.FailNow()
+	}
+}
+
+func TestMissingOrBrokenTemplatesFailFast(t *testing.T) {
+	//given
+	broken := fstest.MapFS{"login.html": {Data: []byte("{{if}}")}}
+	incomplete := fstest.MapFS{"login.html": {Data: []byte("ok")}}
+
+	//when
+	_, errBroken := New(broken, "", false)
+	_, errMissing := New(incomplete, "", false, "login.html", "consent.html")
+
+	//then
+	if errBroken == nil || errMissing == nil {
+		log.Println("expected errors, got:", errBroken, errMissing)
+		t.FailNow()
+	}
+}
+
+func TestDevModeReparsesTemplates(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	file := filepath.Join(dir, "login.html")
+	if err := os.WriteFile(file, []byte("v1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	renderer, err := New(os.DirFS(dir), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	if err := os.WriteFile(file, []byte("v2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := renderer.Render(&buf, "login.html", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	if buf.String() != "v2" {
+		log.Println("template not re-parsed:", buf.String())
+		t.FailNow()
+	}
+}
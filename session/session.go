@@ -0,0 +1,295 @@
+// Package session keeps the login of the account pages of the identity
+// provider. Hydra only knows sessions of OAuth clients, so the account pages
+// use their own session stored in a signed cookie.
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CookieName = "idp_account"
+	CookiePath = "/idp/account"
+	// MinSecretLength is the minimal length of ACCOUNT_SESSION_SECRET.
+	MinSecretLength = 32
+)
+
+type Session struct {
+	Subject   string    `json:"sub"`
+	CSRFToken string    `json:"csrf"`
+	AuthTime  time.Time `json:"auth_time"`
+	Expires   time.Time `json:"exp"`
+	// Password is the fingerprint of the password the session was started
+	// with, the session ends once the password changes.
+	Password string `json:"pwd,omitempty"`
+}
+
+// ValidCSRF compares the token of a submitted form with the token of the
+// session.
+func (s *Session) ValidCSRF(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
+
+// Manager signs the session cookie and the sealed tokens with separate keys
+// derived from the secret, so a token can not be used as session.
+type Manager struct {
+	sessionKey []byte
+	tokenKey   []byte
+	maxAge     time.Duration
+	secure     bool
+}
+
+func NewManager(key []byte, maxAge time.Duration, secure bool) *Manager {
+	return &Manager{
+		sessionKey: deriveKey(key, "account session"),
+		tokenKey:   deriveKey(key, "sealed token"),
+		maxAge:     maxAge,
+		secure:     secure,
+	}
+}
+
+// deriveKey returns the key for the purpose labeled by label.
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// NewManagerFromEnv signs the cookie with ACCOUNT_SESSION_SECRET. Without a
+// secret a random key is used, so sessions do not survive a restart and are
+// not shared between instances. ACCOUNT_SESSION_MAX_AGE limits the session
+// (default 1h), ACCOUNT_COOKIE_SECURE=false allows the cookie over http.
+func NewManagerFromEnv() (manager *Manager, err error) {
+	key := []byte(os.Getenv("ACCOUNT_SESSION_SECRET"))
+	if len(key) == 0 {
+		slog.Warn("ACCOUNT_SESSION_SECRET is not set, account sessions are lost on restart")
+		key = make([]byte, MinSecretLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	} else if len(key) < MinSecretLength {
+		return nil, fmt.Errorf("ACCOUNT_SESSION_SECRET must have at least %d characters", MinSecretLength)
+	}
+
+	maxAge := time.Hour
+	if value, found := os.LookupEnv("ACCOUNT_SESSION_MAX_AGE"); found {
+		if maxAge, err = time.ParseDuration(value); err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("invalid ACCOUNT_SESSION_MAX_AGE %q", value)
+		}
+	}
+
+	secure := true
+	if value, found := os.LookupEnv("ACCOUNT_COOKIE_SECURE"); found {
+		if secure, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid ACCOUNT_COOKIE_SECURE %q", value)
+		}
+	}
+
+	return NewManager(key, maxAge, secure), nil
+}
+
+func Must(manager *Manager, err error) *Manager {
+	if err != nil {
+		panic("could not create account sessions: " + err.Error())
+	}
+	return manager
+}
+
+// Start creates a session for the subject and sets the cookie. password is
+// the current password of the user, see ValidPassword.
+func (m *Manager) Start(w http.ResponseWriter, subject string, password string) (*Session, error) {
+	csrf := make([]byte, 32)
+	if _, err := rand.Read(csrf); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	session := &Session{
+		Subject:   subject,
+		CSRFToken: base64.RawURLEncoding.EncodeToString(csrf),
+		AuthTime:  now,
+		Expires:   now.Add(m.maxAge),
+		Password:  m.Fingerprint(password),
+	}
+
+	if err := m.Save(w, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Save writes the session into the cookie, e.g. after it has been changed.
+func (m *Manager) Save(w http.ResponseWriter, session *Session) error {
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    encoded + "." + sign(m.sessionKey, encoded),
+		Path:     CookiePath,
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   m.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Load returns the session of the request if the cookie is valid, not
+// expired and names a subject.
+func (m *Manager) Load(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, signature, found := strings.Cut(cookie.Value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(sign(m.sessionKey, encoded))) {
+		return nil, errors.New("invalid session signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(payload, &session); err != nil {
+		return nil, err
+	}
+
+	if session.Subject == "" {
+		return nil, errors.New("session without subject")
+	}
+	if time.Now().After(session.Expires) {
+		return nil, errors.New("session expired")
+	}
+	return &session, nil
+}
+
+// End removes the cookie.
+func (m *Manager) End(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     CookiePath,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type sealed struct {
+	Purpose string          `json:"purpose"`
+	Expires time.Time       `json:"exp"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// Seal signs value into a token that is valid for ttl, e.g. to carry the
+// state of a multi-step form in a hidden field. The purpose must be given to
+// Open again, so a token can not be used for another step.
+func (m *Manager) Seal(purpose string, value interface{}, ttl time.Duration) (string, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(sealed{Purpose: purpose, Expires: time.Now().UTC().Add(ttl), Value: content})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sign(m.tokenKey, encoded), nil
+}
+
+// Open verifies a token created by Seal and decodes its value.
+func (m *Manager) Open(purpose string, token string, value interface{}) error {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(sign(m.tokenKey, encoded))) {
+		return errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+
+	var content sealed
+	if err := json.Unmarshal(payload, &content); err != nil {
+		return err
+	}
+
+	if content.Purpose != purpose {
+		return fmt.Errorf("token is not valid for %s", purpose)
+	}
+	if time.Now().After(content.Expires) {
+		return errors.New("token expired")
+	}
+	return json.Unmarshal(content.Value, value)
+}
+
+// SealCookie seals value into the cookie name, which the browser only sends
+// to the path. The cookie expires together with the token.
+func (m *Manager) SealCookie(w http.ResponseWriter, name string, path string, purpose string, value interface{}, ttl time.Duration) error {
+	token, err := m.Seal(purpose, value, ttl)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     path,
+		Expires:  time.Now().Add(ttl),
+		HttpOnly: true,
+		Secure:   m.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// OpenCookie opens the cookie name set by SealCookie.
+func (m *Manager) OpenCookie(r *http.Request, name string, purpose string, value interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	return m.Open(purpose, cookie.Value, value)
+}
+
+// ValidPassword reports whether the session was started with the current
+// password of the user, so a changed password ends other sessions.
+func (m *Manager) ValidPassword(session *Session, password string) bool {
+	return hmac.Equal([]byte(session.Password), []byte(m.Fingerprint(password)))
+}
+
+// Fingerprint returns a keyed hash of value. Tokens can carry it to become
+// invalid once the value changes, e.g. the password, without revealing the
+// value itself.
+func (m *Manager) Fingerprint(value string) string {
+	return sign(m.tokenKey, "fingerprint:"+value)
+}
+
+func sign(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,163 @@
+package session
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func requestWithCookies(rr *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/idp/account", nil)
+	for _, cookie := range rr.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestStartAndLoad(t *testing.T) {
+	//given
+	manager := NewManager([]byte(strings.Repeat("k", MinSecretLength)), time.Hour, true)
+	rr := httptest.NewRecorder()
+
+	//when
+	started, err := manager.Start(rr, "user@example.com", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := manager.Load(requestWithCookies(rr))
+
+	//then
+	if err != nil || loaded.Subject != "user@example.com" || !loaded.ValidCSRF(started.CSRFToken) || loaded.ValidCSRF("") ||
+		!manager.ValidPassword(loaded, "secret") || manager.ValidPassword(loaded, "changed") {
+		log.Println("unexpected session:", loaded, err)
+		t.FailNow()
+	}
+
+	cookie := rr.Result().Cookies()[0]
+	if !cookie.HttpOnly || !cookie.Secure || cookie.Path != CookiePath {
+		log.Println("unexpected cookie attributes:", cookie)
+		t.Fail()
+	}
+}
+
+func TestTamperedOrExpiredSessionIsRejected(t *testing.T) {
+	//given
+	manager := NewManager([]byte(strings.Repeat("k", MinSecretLength)), time.Hour, true)
+	other := NewManager([]byte(strings.Repeat("x", MinSecretLength)), time.Hour, true)
+	expired := NewManager([]byte(strings.Repeat("k", MinSecretLength)), -time.Minute, true)
+
+	rr := httptest.NewRecorder()
+	if _, err := other.Start(rr, "admin", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	expiredRR := httptest.NewRecorder()
+	if _, err := expired.Start(expiredRR, "user", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	_, signatureErr := manager.Load(requestWithCookies(rr))
+	_, expiredErr := manager.Load(requestWithCookies(expiredRR))
+
+	//then
+	if signatureErr == nil || expiredErr == nil {
+		log.Println("invalid sessions accepted")
+		t.Fail()
+	}
+}
+
+func TestSealedTokenIsNoSession(t *testing.T) {
+	//given
+	manager := NewManager([]byte(strings.Repeat("k", MinSecretLength)), time.Hour, true)
+	token, err := manager.Seal("password_reset", map[string]string{"sub": "user"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/idp/account", nil)
+	req.AddCookie(&http.Cookie{Name: CookieName, Value: token})
+
+	rr := httptest.NewRecorder()
+	if err := manager.Save(rr, &Session{Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	_, tokenErr := manager.Load(req)
+	_, subjectErr := manager.Load(requestWithCookies(rr))
+
+	//then
+	if tokenErr == nil || subjectErr == nil {
+		log.Println("sealed token or session without subject accepted")
+		t.Fail()
+	}
+}
+
+func TestShortSecretIsRejected(t *testing.T) {
+	//given
+	t.Setenv("ACCOUNT_SESSION_SECRET", "short")
+
+	//when
+	_, err := NewManagerFromEnv()
+
+	//then
+	if err == nil {
+		log.Println("short secret accepted")
+		t.Fail()
+	}
+}
+
+func TestSealAndOpen(t *testing.T) {
+	//given
+	manager := NewManager([]byte(strings.Repeat("k", MinSecretLength)), time.Hour, true)
+	token, err := manager.Seal("login_mfa", map[string]string{"sub": "user"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := manager.Seal("login_mfa", map[string]string{"sub": "user"}, -time.Minute)
+
+	//when
+	var value map[string]string
+	err = manager.Open("login_mfa", token, &value)
+
+	//then
+	if err != nil || value["sub"] != "user" {
+		log.Println("unexpected sealed value:", value, err)
+		t.FailNow()
+	}
+	if manager.Open("totp_enroll", token, &value) == nil || manager.Open("login_mfa", expired, &value) == nil ||
+		manager.Open("login_mfa", token+"x", &value) == nil {
+		log.Println("invalid token accepted")
+		t.Fail()
+	}
+}
+
+func TestSealCookieAndOpenCookie(t *testing.T) {
+	//given
+	manager := NewManager([]byte(strings.Repeat("k", MinSecretLength)), time.Hour, true)
+	rr := httptest.NewRecorder()
+
+	//when
+	if err := manager.SealCookie(rr, "idp_login", "/idp/login", "login", map[string]string{"acr": "mfa"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var value map[string]string
+	err := manager.OpenCookie(requestWithCookies(rr), "idp_login", "login", &value)
+
+	//then
+	if err != nil || value["acr"] != "mfa" {
+		log.Println("unexpected cookie value:", value, err)
+		t.FailNow()
+	}
+	cookie := rr.Result().Cookies()[0]
+	if !cookie.HttpOnly || !cookie.Secure || cookie.Path != "/idp/login" {
+		log.Println("unexpected cookie attributes:", cookie)
+		t.Fail()
+	}
+	if manager.OpenCookie(requestWithCookies(rr), "idp_login", "other", &value) == nil {
+		log.Println("cookie opened for another purpose")
+		t.Fail()
+	}
+}
@@ -0,0 +1,74 @@
+// Runs the WebAuthn ceremony of forms marked with data-passkey ("create" to
+// register a passkey, "get" to sign in) and posts the response of the
+// authenticator as JSON in the credential field of the form.
+(function () {
+  function toBuffer(value) {
+    var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+    var binary = atob(base64 + '==='.slice((base64.length + 3) % 4));
+    return Uint8Array.from(binary, function (c) { return c.charCodeAt(0); });
+  }
+
+  function toBase64URL(buffer) {
+    var binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+  }
+
+  function decodeCredentials(credentials) {
+    (credentials || []).forEach(function (credential) {
+      credential.id = toBuffer(credential.id);
+    });
+  }
+
+  function encodeResponse(response) {
+    var encoded = { clientDataJSON: toBase64URL(response.clientDataJSON) };
+    if (response.attestationObject) {
+      encoded.attestationObject = toBase64URL(response.attestationObject);
+      if (response.getTransports) {
+        encoded.transports = response.getTransports();
+      }
+    } else {
+      encoded.authenticatorData = toBase64URL(response.authenticatorData);
+      encoded.signature = toBase64URL(response.signature);
+      if (response.userHandle) {
+        encoded.userHandle = toBase64URL(response.userHandle);
+      }
+    }
+    return encoded;
+  }
+
+  function ceremony(form) {
+    var options = JSON.parse(form.dataset.options).publicKey;
+    options.challenge = toBuffer(options.challenge);
+
+    if (form.dataset.passkey === 'create') {
+      options.user.id = toBuffer(options.user.id);
+      decodeCredentials(options.excludeCredentials);
+      return navigator.credentials.create({ publicKey: options });
+    }
+    decodeCredentials(options.allowCredentials);
+    return navigator.credentials.get({ publicKey: options });
+  }
+
+  document.querySelectorAll('form[data-passkey]').forEach(function (form) {
+    form.addEventListener('submit', function (event) {
+      event.preventDefault();
+      var failed = form.querySelector('.passkey-error');
+      if (!window.PublicKeyCredential) {
+        failed.hidden = false;
+        return;
+      }
+
+      ceremony(form).then(function (credential) {
+        form.elements.credential.value = JSON.stringify({
+          id: credential.id,
+          rawId: toBase64URL(credential.rawId),
+          type: credential.type,
+          response: encodeResponse(credential.response)
+        });
+        form.submit();
+      }).catch(function () {
+        failed.hidden = false;
+      });
+    });
+  });
+})();
@@ -0,0 +1,8 @@
+package static
+
+import "embed"
+
+// Files contains the assets served under /idp/static/.
+//
+//go:embed *.css *.js
+var Files embed.FS
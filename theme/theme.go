@@ -0,0 +1,226 @@
+package theme
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"simple-login-endpoint/render"
+	"strings"
+)
+
+const (
+	ConfigFile   = "theme.json"
+	ColorsFile   = "colors.css"
+	DefaultTheme = "default"
+	AssetsPath   = "/idp/themes/"
+	DefaultLogo  = "/idp/static/logo.png"
+)
+
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// assetExtensions limits what is served from a theme directory, so theme
+// configuration and templates are not exposed.
+var assetExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".ico": true, ".webp": true, ".css": true,
+}
+
+type Link struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+// Theme describes the branding of the login, consent and error pages for
+// one client. A theme lives in <THEME_DIR>/<client_id>/ and consists of a
+// theme.json, optional assets and optional template overrides.
+type Theme struct {
+	Name            string `json:"-"`
+	Title           string `json:"title"`
+	Logo            string `json:"logo"`
+	Stylesheet      string `json:"stylesheet"`
+	PrimaryColor    string `json:"primary_color"`
+	BackgroundColor string `json:"background_color"`
+	FooterLinks     []Link `json:"footer_links"`
+
+	views *render.Renderer
+}
+
+// ColorsURL returns the stylesheet generated from the configured colors or
+// an empty string if the theme does not define colors.
+func (t *Theme) ColorsURL() string {
+	if t.PrimaryColor == "" && t.BackgroundColor == "" {
+		return ""
+	}
+	return AssetsPath + t.Name + "/" + ColorsFile
+}
+
+func (t *Theme) colors() string {
+	var css strings.Builder
+	if t.BackgroundColor != "" {
+		fmt.Fprintf(&css, "body {\n  background-color: %s;\n}\n", t.BackgroundColor)
+	}
+	if t.PrimaryColor != "" {
+		fmt.Fprintf(&css, ".signin {\n  background-color: %s;\n}\n", t.PrimaryColor)
+		fmt.Fprintf(&css, ".signin:hover {\n  background: %s;\n  box-shadow: 0px 4px 35px -5px %s;\n}\n", t.PrimaryColor, t.PrimaryColor)
+	}
+	return css.String()
+}
+
+// Views returns the renderer with the template overrides of the theme or
+// nil if the theme does not override any template.
+func (t *Theme) Views() *render.Renderer {
+	return t.views
+}
+
+type Registry struct {
+	dir      string
+	themes   map[string]*Theme
+	fallback *Theme
+}
+
+// Load reads all themes found in dir. An empty dir results in a registry
+// which only knows the built-in default theme.
+func Load(dir string, views *render.Renderer) (registry *Registry, err error) {
+	registry = &Registry{
+		dir:      dir,
+		themes:   make(map[string]*Theme),
+		fallback: &Theme{Name: DefaultTheme, Logo: DefaultLogo},
+	}
+
+	if dir == "" {
+		return registry, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		theme, err := loadTheme(filepath.Join(dir, entry.Name()), entry.Name(), views)
+		if err != nil {
+			return nil, fmt.Errorf("theme %s: %w", entry.Name(), err)
+		}
+
+		if entry.Name() == DefaultTheme {
+			registry.fallback = theme
+		} else {
+			registry.themes[entry.Name()] = theme
+		}
+		slog.Info("loaded theme", "theme", entry.Name())
+	}
+
+	return registry, nil
+}
+
+func loadTheme(dir string, name string, views *render.Renderer) (theme *Theme, err error) {
+	theme = &Theme{Name: name}
+
+	content, err := os.ReadFile(filepath.Join(dir, ConfigFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, theme); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, color := range []string{theme.PrimaryColor, theme.BackgroundColor} {
+		if color != "" && !colorPattern.MatchString(color) {
+			return nil, fmt.Errorf("invalid color %q", color)
+		}
+	}
+
+	theme.Logo = assetURL(name, theme.Logo)
+	if theme.Logo == "" {
+		theme.Logo = DefaultLogo
+	}
+	if external(theme.Stylesheet) {
+		return nil, fmt.Errorf("stylesheet %q is not served by the identity provider, which the Content-Security-Policy forbids", theme.Stylesheet)
+	}
+	theme.Stylesheet = assetURL(name, theme.Stylesheet)
+
+	if views != nil && render.HasTemplates(dir) {
+		if theme.views, err = views.WithOverride(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return theme, nil
+}
+
+// assetURL resolves file names relative to the theme directory; absolute
+// paths and URLs are used as they are.
+func assetURL(name string, file string) string {
+	if file == "" || strings.HasPrefix(file, "/") || external(file) {
+		return file
+	}
+	return AssetsPath + name + "/" + file
+}
+
+// external reports whether the file is a URL of another host.
+func external(file string) bool {
+	return strings.Contains(file, "://") || strings.HasPrefix(file, "//")
+}
+
+func Must(registry *Registry, err error) *Registry {
+	if err != nil {
+		panic("could not load themes: " + err.Error())
+	}
+	return registry
+}
+
+// ForClient returns the theme of the client or the default theme.
+func (r *Registry) ForClient(clientID string) *Theme {
+	if theme, found := r.themes[clientID]; found {
+		return theme
+	}
+	return r.fallback
+}
+
+// Lookup returns the theme of the name, e.g. a client ID, if there is one.
+func (r *Registry) Lookup(name string) (theme *Theme, found bool) {
+	theme, found = r.themes[name]
+	return theme, found
+}
+
+func (r *Registry) byName(name string) *Theme {
+	if name == r.fallback.Name {
+		return r.fallback
+	}
+	return r.themes[name]
+}
+
+// AssetHandler serves the images and stylesheets of the themes below
+// AssetsPath as well as the stylesheet generated from the theme colors.
+func (r *Registry) AssetHandler() http.Handler {
+	files := http.FileServer(http.Dir(r.dir))
+
+	return http.StripPrefix(AssetsPath, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if name, file, found := strings.Cut(req.URL.Path, "/"); found && file == ColorsFile {
+			if theme := r.byName(name); theme != nil && theme.ColorsURL() != "" {
+				w.Header().Set("Content-Type", "text/css; charset=utf-8")
+				if _, err := w.Write([]byte(theme.colors())); err != nil {
+					slog.Error("error on writing theme colors", "error", err)
+				}
+				return
+			}
+		}
+
+		if r.dir == "" || !assetExtensions[strings.ToLower(path.Ext(req.URL.Path))] {
+			http.NotFound(w, req)
+			return
+		}
+		files.ServeHTTP(w, req)
+	}))
+}
@@ -0,0 +1,130 @@
+package theme
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"simple-login-endpoint/render"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestThemeForClient(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "myclient", ConfigFile), `{"title": "My App", "logo": "logo.svg", "primary_color": "#c0392b"}`)
+	writeFile(t, filepath.Join(dir, "myclient", "login.html"), `custom {{.Theme.Title}}`)
+	writeFile(t, filepath.Join(dir, "myclient", "logo.svg"), `<svg></svg>`)
+
+	views, err := render.New(fstest.MapFS{"login.html": {Data: []byte("base")}}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	registry, err := Load(dir, views)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theme := registry.ForClient("myclient")
+
+	//then
+	if theme.Title != "My App" || theme.Logo != AssetsPath+"myclient/logo.svg" {
+		log.Println("unexpected theme:", theme)
+		t.FailNow()
+	}
+
+	var buf bytes.Buffer
+	if err := theme.Views().Render(&buf, "login.html", map[string]interface{}{"Theme": theme}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "custom My App" {
+		log.Println("template override not used:", buf.String())
+		t.FailNow()
+	}
+
+	if registry.ForClient("other").Logo != DefaultLogo {
+		log.Println("unknown client should use the default theme")
+		t.FailNow()
+	}
+}
+
+func TestAssetHandler(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "myclient", ConfigFile), `{"primary_color": "#c0392b"}`)
+	writeFile(t, filepath.Join(dir, "myclient", "logo.svg"), `<svg></svg>`)
+
+	registry, err := Load(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := registry.AssetHandler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	//when
+	logo := get(AssetsPath + "myclient/logo.svg")
+	config := get(AssetsPath + "myclient/" + ConfigFile)
+	colors := get(AssetsPath + "myclient/" + ColorsFile)
+
+	//then
+	if logo.Code != http.StatusOK || config.Code != http.StatusNotFound {
+		log.Println("unexpected status codes:", logo.Code, config.Code)
+		t.FailNow()
+	}
+
+	if colors.Code != http.StatusOK || !strings.Contains(colors.Body.String(), "#c0392b") {
+		log.Println("unexpected colors:", colors.Code, colors.Body.String())
+		t.FailNow()
+	}
+}
+
+func TestInvalidColorIsRejected(t *testing.T) {
+	//given
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "myclient", ConfigFile), `{"primary_color": "red;} body {display:none"}`)
+
+	//when
+	_, err := Load(dir, nil)
+
+	//then
+	if err == nil {
+		log.Println("invalid color accepted")
+		t.FailNow()
+	}
+}
+
+func TestExternalStylesheetIsRejected(t *testing.T) {
+	for _, stylesheet := range []string{"https://cdn.example.com/theme.css", "//cdn.example.com/theme.css"} {
+		//given
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "myclient", ConfigFile), `{"stylesheet": "`+stylesheet+`"}`)
+
+		//when
+		_, err := Load(dir, nil)
+
+		//then
+		if err == nil {
+			log.Println("external stylesheet accepted:", stylesheet)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Package tracing sets up OpenTelemetry for the identity provider. Spans are
+// only exported if an OTLP endpoint is configured, otherwise the global no-op
+// tracer is kept and only the W3C trace context is passed on to Hydra.
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TracerName = "simple-login-endpoint"
+
+// Tracer returns the tracer used for all spans of the identity provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// NewProvider creates a tracer provider and registers it globally together
+// with the W3C trace context propagator.
+func NewProvider(opts ...sdktrace.TracerProviderOption) (provider *sdktrace.TracerProvider) {
+	provider = sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return provider
+}
+
+// Init sets up the OTLP exporter if OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set. The returned function flushes
+// and stops the exporter.
+func Init(ctx context.Context) (shutdown func(context.Context) error, err error) {
+	_, found := os.LookupEnv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	_, foundTraces := os.LookupEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+
+	if !found && !foundTraces {
+		slog.Info("tracing is disabled, OTEL_EXPORTER_OTLP_ENDPOINT is not set")
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := NewProvider(sdktrace.WithBatcher(exporter))
+	slog.Info("tracing is enabled")
+
+	return provider.Shutdown, nil
+}
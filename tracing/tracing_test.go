@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestInitChoosesExporterFromEnv(t *testing.T) {
+	cases := map[string]struct {
+		env     string
+		enabled bool
+	}{
+		"disabled":        {env: "", enabled: false},
+		"endpoint":        {env: "OTEL_EXPORTER_OTLP_ENDPOINT", enabled: true},
+		"traces endpoint": {env: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", enabled: true},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			//given
+			for _, key := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"} {
+				t.Setenv(key, "")
+				os.Unsetenv(key)
+			}
+			if c.env != "" {
+				t.Setenv(c.env, "http://localhost:4318")
+			}
+			otel.SetTracerProvider(noop.NewTracerProvider())
+			defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+			//when
+			shutdown, err := Init(context.Background())
+
+			//then
+			if err != nil {
+				log.Println("init failed:", err)
+				t.FailNow()
+			}
+			defer shutdown(context.Background())
+			_, enabled := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+			fields := otel.GetTextMapPropagator().Fields()
+			if enabled != c.enabled || !slices.Contains(fields, "traceparent") {
+				log.Println("unexpected tracer provider or propagator:", otel.GetTracerProvider(), fields)
+				t.Fail()
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Package trust decides which clients are first-party applications, for
+// which the consent screen is not shown.
+package trust
+
+import (
+	"os"
+	"simple-login-endpoint/flow"
+	"strings"
+)
+
+// MetadataFirstParty marks a client as trusted when set to true in the
+// metadata of the Hydra client.
+const MetadataFirstParty = "first_party"
+
+type Policy struct {
+	clients map[string]bool
+}
+
+func NewPolicy(clientIDs ...string) *Policy {
+	policy := &Policy{clients: make(map[string]bool)}
+	for _, clientID := range clientIDs {
+		if clientID = strings.TrimSpace(clientID); clientID != "" {
+			policy.clients[clientID] = true
+		}
+	}
+	return policy
+}
+
+// NewPolicyFromEnv trusts the clients of the comma separated
+// TRUSTED_CLIENTS in addition to clients with first_party metadata.
+func NewPolicyFromEnv() *Policy {
+	return NewPolicy(strings.Split(os.Getenv("TRUSTED_CLIENTS"), ",")...)
+}
+
+func (p *Policy) IsTrusted(client *flow.Client) bool {
+	if client == nil {
+		return false
+	}
+	if p.clients[client.ClientID] {
+		return true
+	}
+
+	switch firstParty := client.Metadata[MetadataFirstParty].(type) {
+	case bool:
+		return firstParty
+	case string:
+		return strings.EqualFold(firstParty, "true")
+	default:
+		return false
+	}
+}
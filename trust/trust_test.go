@@ -0,0 +1,36 @@
+package trust
+
+import (
+	"log"
+	"simple-login-endpoint/flow"
+	"testing"
+)
+
+func TestIsTrusted(t *testing.T) {
+	//given
+	policy := NewPolicy("intranet", " ")
+
+	cases := []struct {
+		client  *flow.Client
+		trusted bool
+	}{
+		{&flow.Client{ClientID: "intranet"}, true},
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataFirstParty: true}}, true},
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataFirstParty: "true"}}, true},
+		{&flow.Client{ClientID: "app", Metadata: map[string]interface{}{MetadataFirstParty: false}}, false},
+		{&flow.Client{ClientID: "partner"}, false},
+		{&flow.Client{ClientID: ""}, false},
+		{nil, false},
+	}
+
+	for _, c := range cases {
+		//when
+		trusted := policy.IsTrusted(c.client)
+
+		//then
+		if trusted != c.trusted {
+			log.Println("unexpected trust for", c.client, trusted)
+			t.Fail()
+		}
+	}
+}
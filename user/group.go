@@ -0,0 +1,239 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrGroupCycle is returned when a group contains itself through its nested
+// groups.
+var ErrGroupCycle = errors.New("group cycle")
+
+// Group assigns roles to its members. Members of a nested group are members
+// of the group as well, so they inherit the roles of all groups above.
+type Group struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles,omitempty"`
+	// Members are the emails of the users in the group.
+	Members []string `json:"members,omitempty"`
+	// Groups are the names of the nested groups. Unknown names are ignored.
+	Groups []string `json:"groups,omitempty"`
+}
+
+type GroupRepository interface {
+	AllGroups() []*Group
+	GetGroup(name string) (group *Group, err error)
+	// AddGroup and UpdateGroup fail with ErrGroupCycle if the nested groups
+	// would form a cycle.
+	AddGroup(group *Group) (err error)
+	UpdateGroup(group *Group) (err error)
+	DeleteGroup(name string) (err error)
+}
+
+// CheckGroups returns an error wrapping ErrGroupCycle for the first cycle
+// of nested groups found.
+func CheckGroups(groups []*Group) error {
+	byName := groupsByName(groups)
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(byName))
+	var path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			start := slices.Index(path, name)
+			return fmt.Errorf("%w: %s", ErrGroupCycle, strings.Join(append(path[start:], name), " > "))
+		case done:
+			return nil
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, nested := range byName[name].Groups {
+			if _, found := byName[nested]; !found {
+				continue
+			}
+			if err := visit(nested); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+
+	for _, name := range sortedNames(byName) {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Memberships returns the sorted names of the groups the user belongs to,
+// directly or through nested groups. Cycles are followed only once.
+func Memberships(groups []*Group, email string) []string {
+	parents := make(map[string][]string)
+	for _, group := range groups {
+		for _, nested := range group.Groups {
+			parents[nested] = append(parents[nested], group.Name)
+		}
+	}
+
+	found := make(map[string]bool)
+	var queue []string
+	for _, group := range groups {
+		if slices.Contains(group.Members, email) && !found[group.Name] {
+			found[group.Name] = true
+			queue = append(queue, group.Name)
+		}
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, parent := range parents[name] {
+			if !found[parent] {
+				found[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return sortedNames(found)
+}
+
+// EffectiveRoles returns the roles of the user followed by the roles of its
+// groups, without duplicates.
+func EffectiveRoles(groups []*Group, u *User) []string {
+	roles := make([]string, 0, len(u.Roles))
+	add := func(role string) {
+		if role != "" && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	for _, role := range u.Roles {
+		add(role)
+	}
+	byName := groupsByName(groups)
+	for _, name := range Memberships(groups, u.Email) {
+		for _, role := range byName[name].Roles {
+			add(role)
+		}
+	}
+	return roles
+}
+
+func groupsByName(groups []*Group) map[string]*Group {
+	byName := make(map[string]*Group, len(groups))
+	for _, group := range groups {
+		byName[group.Name] = group
+	}
+	return byName
+}
+
+func sortedNames[V any](names map[string]V) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+type GroupInMemoryRepo struct {
+	mu     sync.RWMutex
+	byName map[string]*Group
+}
+
+func NewEmptyGroupInMemoryRepo() (repo *GroupInMemoryRepo) {
+	return &GroupInMemoryRepo{
+		byName: make(map[string]*Group),
+	}
+}
+
+// NewGroupInMemoryRepo fails if the groups contain a cycle.
+func NewGroupInMemoryRepo(groups []*Group) (repo *GroupInMemoryRepo, err error) {
+	if err := CheckGroups(groups); err != nil {
+		return nil, err
+	}
+	return &GroupInMemoryRepo{byName: groupsByName(groups)}, nil
+}
+
+func (r *GroupInMemoryRepo) AllGroups() []*Group {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	groups := make([]*Group, 0, len(r.byName))
+	for _, name := range sortedNames(r.byName) {
+		groups = append(groups, r.byName[name])
+	}
+	return groups
+}
+
+func (r *GroupInMemoryRepo) GetGroup(name string) (group *Group, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	group, found := r.byName[name]
+	if !found {
+		return &Group{}, errors.New("group not found")
+	}
+	return group, nil
+}
+
+func (r *GroupInMemoryRepo) AddGroup(group *Group) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.byName[group.Name]; found {
+		return errors.New("group already exists")
+	}
+	return r.store(group)
+}
+
+func (r *GroupInMemoryRepo) UpdateGroup(group *Group) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.byName[group.Name]; !found {
+		return errors.New("group not found")
+	}
+	return r.store(group)
+}
+
+func (r *GroupInMemoryRepo) DeleteGroup(name string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, found := r.byName[name]; !found {
+		return errors.New("group not found")
+	}
+	delete(r.byName, name)
+	return nil
+}
+
+// store saves the group unless it closes a cycle. The caller holds the lock.
+func (r *GroupInMemoryRepo) store(group *Group) error {
+	groups := []*Group{group}
+	for name, stored := range r.byName {
+		if name != group.Name {
+			groups = append(groups, stored)
+		}
+	}
+	if err := CheckGroups(groups); err != nil {
+		return err
+	}
+
+	r.byName[group.Name] = group
+	return nil
+}
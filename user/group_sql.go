@@ -0,0 +1,207 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// GroupSchema creates the table of GroupSQLRepo. Roles, members and nested
+// groups are stored as JSON arrays.
+const GroupSchema = `CREATE TABLE idp_groups (
+	name VARCHAR(255) PRIMARY KEY,
+	roles TEXT NOT NULL,
+	members TEXT NOT NULL,
+	nested TEXT NOT NULL
+)`
+
+// Placeholder is the bind parameter syntax of the database driver.
+type Placeholder int
+
+const (
+	// PlaceholderQuestion is used by MySQL and SQLite: ?
+	PlaceholderQuestion Placeholder = iota
+	// PlaceholderDollar is used by PostgreSQL: $1, $2, ...
+	PlaceholderDollar
+)
+
+const groupColumns = "name, roles, members, nested"
+
+// GroupSQLRepo keeps the groups in the table created by GroupSchema. The
+// driver is registered by the program, this package does not import one.
+type GroupSQLRepo struct {
+	db          *sql.DB
+	placeholder Placeholder
+}
+
+func NewGroupSQLRepo(db *sql.DB, placeholder Placeholder) (repo *GroupSQLRepo) {
+	return &GroupSQLRepo{db: db, placeholder: placeholder}
+}
+
+// AllGroups returns the groups sorted by name. The interface has no error,
+// a failing query is logged and returns no groups.
+func (r *GroupSQLRepo) AllGroups() []*Group {
+	groups, err := r.queryGroups(context.Background(), r.db, "SELECT "+groupColumns+" FROM idp_groups ORDER BY name")
+	if err != nil {
+		slog.Error("could not load groups", "error", err)
+		return []*Group{}
+	}
+	return groups
+}
+
+func (r *GroupSQLRepo) GetGroup(name string) (group *Group, err error) {
+	groups, err := r.queryGroups(context.Background(), r.db, "SELECT "+groupColumns+" FROM idp_groups WHERE name = ?", name)
+	if err != nil {
+		return &Group{}, err
+	}
+	if len(groups) == 0 {
+		return &Group{}, errors.New("group not found")
+	}
+	return groups[0], nil
+}
+
+func (r *GroupSQLRepo) AddGroup(group *Group) (err error) {
+	return r.store(group, false)
+}
+
+func (r *GroupSQLRepo) UpdateGroup(group *Group) (err error) {
+	return r.store(group, true)
+}
+
+func (r *GroupSQLRepo) DeleteGroup(name string) (err error) {
+	result, err := r.db.Exec(r.bind("DELETE FROM idp_groups WHERE name = ?"), name)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return errors.New("group not found")
+	}
+	return nil
+}
+
+// store adds or updates the group in a transaction, unless it closes a cycle.
+func (r *GroupSQLRepo) store(group *Group, update bool) error {
+	ctx := context.Background()
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := r.queryGroups(ctx, tx, "SELECT "+groupColumns+" FROM idp_groups")
+	if err != nil {
+		return err
+	}
+
+	groups := []*Group{group}
+	found := false
+	for _, other := range stored {
+		if other.Name == group.Name {
+			found = true
+		} else {
+			groups = append(groups, other)
+		}
+	}
+	switch {
+	case update && !found:
+		return errors.New("group not found")
+	case !update && found:
+		return errors.New("group already exists")
+	}
+	if err := CheckGroups(groups); err != nil {
+		return err
+	}
+
+	roles, members, nested, err := encodeGroup(group)
+	if err != nil {
+		return err
+	}
+	if update {
+		_, err = tx.ExecContext(ctx, r.bind("UPDATE idp_groups SET roles = ?, members = ?, nested = ? WHERE name = ?"), roles, members, nested, group.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, r.bind("INSERT INTO idp_groups ("+groupColumns+") VALUES (?, ?, ?, ?)"), group.Name, roles, members, nested)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func (r *GroupSQLRepo) queryGroups(ctx context.Context, q queryer, query string, args ...any) ([]*Group, error) {
+	rows, err := q.QueryContext(ctx, r.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]*Group, 0)
+	for rows.Next() {
+		var group Group
+		var roles, members, nested string
+		if err := rows.Scan(&group.Name, &roles, &members, &nested); err != nil {
+			return nil, err
+		}
+		if err := decodeGroup(&group, roles, members, nested); err != nil {
+			return nil, fmt.Errorf("group %s: %w", group.Name, err)
+		}
+		groups = append(groups, &group)
+	}
+	return groups, rows.Err()
+}
+
+// bind replaces the ? of the query with the placeholders of the driver.
+func (r *GroupSQLRepo) bind(query string) string {
+	if r.placeholder != PlaceholderDollar {
+		return query
+	}
+
+	var bound strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&bound, "$%d", n)
+			continue
+		}
+		bound.WriteRune(c)
+	}
+	return bound.String()
+}
+
+func encodeGroup(group *Group) (roles string, members string, nested string, err error) {
+	encoded := make([]string, 0, 3)
+	for _, list := range [][]string{group.Roles, group.Members, group.Groups} {
+		if list == nil {
+			list = []string{}
+		}
+		content, err := json.Marshal(list)
+		if err != nil {
+			return "", "", "", err
+		}
+		encoded = append(encoded, string(content))
+	}
+	return encoded[0], encoded[1], encoded[2], nil
+}
+
+func decodeGroup(group *Group, roles string, members string, nested string) error {
+	for _, column := range []struct {
+		content string
+		list    *[]string
+	}{{roles, &group.Roles}, {members, &group.Members}, {nested, &group.Groups}} {
+		if err := json.Unmarshal([]byte(column.content), column.list); err != nil {
+			return err
+		}
+		if len(*column.list) == 0 {
+			*column.list = nil
+		}
+	}
+	return nil
+}
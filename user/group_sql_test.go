@@ -0,0 +1,196 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubDatabase answers the queries of GroupSQLRepo from a map, so the
+// repository can be tested without a database driver.
+type stubDatabase struct {
+	mu      sync.Mutex
+	rows    map[string][]driver.Value
+	queries []string
+}
+
+var stubPlaceholder = regexp.MustCompile(`\$\d+`)
+
+func (d *stubDatabase) Connect(context.Context) (driver.Conn, error) { return &stubConn{d}, nil }
+func (d *stubDatabase) Driver() driver.Driver                        { return nil }
+
+type stubConn struct{ db *stubDatabase }
+
+func (c *stubConn) Prepare(query string) (driver.Stmt, error) { return &stubStmt{c.db, query}, nil }
+func (c *stubConn) Close() error                              { return nil }
+func (c *stubConn) Begin() (driver.Tx, error)                 { return c, nil }
+func (c *stubConn) Commit() error                             { return nil }
+func (c *stubConn) Rollback() error                           { return nil }
+
+type stubStmt struct {
+	db    *stubDatabase
+	query string
+}
+
+func (s *stubStmt) Close() error  { return nil }
+func (s *stubStmt) NumInput() int { return -1 }
+
+func (s *stubStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.queries = append(s.db.queries, s.query)
+
+	query := stubPlaceholder.ReplaceAllString(s.query, "?")
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO idp_groups"):
+		s.db.rows[args[0].(string)] = args
+	case strings.HasPrefix(query, "UPDATE idp_groups"):
+		s.db.rows[args[3].(string)] = []driver.Value{args[3], args[0], args[1], args[2]}
+	case strings.HasPrefix(query, "DELETE FROM idp_groups"):
+		if _, found := s.db.rows[args[0].(string)]; !found {
+			return driver.RowsAffected(0), nil
+		}
+		delete(s.db.rows, args[0].(string))
+	default:
+		return nil, errors.New("unexpected statement: " + s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *stubStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.queries = append(s.db.queries, s.query)
+
+	query := stubPlaceholder.ReplaceAllString(s.query, "?")
+	if !strings.HasPrefix(query, "SELECT name, roles, members, nested FROM idp_groups") {
+		return nil, errors.New("unexpected query: " + s.query)
+	}
+
+	names := make([]string, 0, len(s.db.rows))
+	for name := range s.db.rows {
+		if !strings.Contains(query, "WHERE name = ?") || name == args[0] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	rows := &stubRows{}
+	for _, name := range names {
+		rows.values = append(rows.values, s.db.rows[name])
+	}
+	return rows, nil
+}
+
+type stubRows struct {
+	values [][]driver.Value
+}
+
+func (r *stubRows) Columns() []string { return []string{"name", "roles", "members", "nested"} }
+func (r *stubRows) Close() error      { return nil }
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newStubGroupSQLRepo(placeholder Placeholder) (*GroupSQLRepo, *stubDatabase) {
+	database := &stubDatabase{rows: make(map[string][]driver.Value)}
+	return NewGroupSQLRepo(sql.OpenDB(database), placeholder), database
+}
+
+func TestGroupSQLRepo(t *testing.T) {
+	//given
+	repo, _ := newStubGroupSQLRepo(PlaceholderQuestion)
+
+	//when
+	for _, group := range []*Group{
+		{Name: "staff", Roles: []string{"user"}, Groups: []string{"editors"}},
+		{Name: "editors", Roles: []string{"editor"}, Members: []string{"anna"}},
+	} {
+		if err := repo.AddGroup(group); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//then
+	groups := repo.AllGroups()
+	if len(groups) != 2 || groups[0].Name != "editors" || !slices.Equal(groups[1].Groups, []string{"editors"}) {
+		log.Println("unexpected groups:", groups)
+		t.FailNow()
+	}
+	if roles := EffectiveRoles(groups, &User{Email: "anna"}); !slices.Equal(roles, []string{"editor", "user"}) {
+		log.Println("unexpected roles:", roles)
+		t.FailNow()
+	}
+
+	//when
+	err := repo.UpdateGroup(&Group{Name: "editors", Members: []string{"anna"}, Groups: []string{"staff"}})
+
+	//then
+	if group, _ := repo.GetGroup("editors"); !errors.Is(err, ErrGroupCycle) || !slices.Equal(group.Roles, []string{"editor"}) {
+		log.Println("cycle not rejected:", err, group)
+		t.FailNow()
+	}
+
+	//when
+	err = repo.UpdateGroup(&Group{Name: "editors", Roles: []string{"publisher"}})
+
+	//then
+	if group, _ := repo.GetGroup("editors"); err != nil || !slices.Equal(group.Roles, []string{"publisher"}) || group.Members != nil {
+		log.Println("group not updated:", err, group)
+		t.FailNow()
+	}
+
+	//when
+	err = repo.DeleteGroup("editors")
+
+	//then
+	if _, getErr := repo.GetGroup("editors"); err != nil || getErr == nil || len(repo.AllGroups()) != 1 {
+		log.Println("group not deleted:", err)
+		t.FailNow()
+	}
+
+	if repo.AddGroup(&Group{Name: "staff"}) == nil || repo.UpdateGroup(&Group{Name: "unknown"}) == nil || repo.DeleteGroup("unknown") == nil {
+		log.Println("missing or existing group not reported")
+		t.Fail()
+	}
+}
+
+func TestGroupSQLRepoUsesDollarPlaceholders(t *testing.T) {
+	//given
+	repo, database := newStubGroupSQLRepo(PlaceholderDollar)
+
+	//when
+	if err := repo.AddGroup(&Group{Name: "staff"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.GetGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+
+	//then
+	for _, query := range database.queries {
+		if strings.Contains(query, "?") {
+			log.Println("unexpected placeholder:", query)
+			t.Fail()
+		}
+	}
+	if !slices.Contains(database.queries, "INSERT INTO idp_groups (name, roles, members, nested) VALUES ($1, $2, $3, $4)") {
+		log.Println("unexpected queries:", database.queries)
+		t.Fail()
+	}
+}
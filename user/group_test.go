@@ -0,0 +1,82 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"testing"
+)
+
+func TestEffectiveRolesFollowNestedGroups(t *testing.T) {
+	//given
+	groups := []*Group{
+		{Name: "staff", Roles: []string{"user"}, Groups: []string{"editors", "unknown"}},
+		{Name: "editors", Roles: []string{"editor", "user"}, Groups: []string{"chief-editors"}},
+		{Name: "chief-editors", Roles: []string{"publisher"}, Members: []string{"anna"}},
+		{Name: "admins", Roles: []string{"admin"}, Members: []string{"bob"}},
+	}
+	anna := &User{Email: "anna", Roles: []string{"reviewer"}}
+
+	//when
+	memberships := Memberships(groups, anna.Email)
+	roles := EffectiveRoles(groups, anna)
+
+	//then
+	if !slices.Equal(memberships, []string{"chief-editors", "editors", "staff"}) {
+		log.Println("unexpected memberships:", memberships)
+		t.Fail()
+	}
+
+	if !slices.Equal(roles, []string{"reviewer", "publisher", "editor", "user"}) {
+		log.Println("unexpected roles:", roles)
+		t.Fail()
+	}
+
+	if roles := EffectiveRoles(groups, &User{Email: "carl"}); len(roles) != 0 {
+		log.Println("user without groups got roles:", roles)
+		t.Fail()
+	}
+}
+
+func TestGroupCyclesAreRejected(t *testing.T) {
+	//given
+	repo, err := NewGroupInMemoryRepo([]*Group{
+		{Name: "a", Groups: []string{"b"}},
+		{Name: "b", Groups: []string{"c"}},
+		{Name: "c", Members: []string{"anna"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//when
+	err = repo.UpdateGroup(&Group{Name: "c", Members: []string{"anna"}, Groups: []string{"a"}})
+
+	//then
+	if !errors.Is(err, ErrGroupCycle) {
+		log.Println("cycle not rejected:", err)
+		t.FailNow()
+	}
+
+	if err := repo.AddGroup(&Group{Name: "d", Groups: []string{"d"}}); !errors.Is(err, ErrGroupCycle) {
+		log.Println("self reference not rejected:", err)
+		t.Fail()
+	}
+
+	if _, err := NewGroupInMemoryRepo([]*Group{{Name: "x", Groups: []string{"y"}}, {Name: "y", Groups: []string{"x"}}}); !errors.Is(err, ErrGroupCycle) {
+		log.Println("cycle not detected on import:", err)
+		t.Fail()
+	}
+
+	//when
+	memberships := Memberships([]*Group{
+		{Name: "x", Groups: []string{"y"}, Members: []string{"anna"}},
+		{Name: "y", Groups: []string{"x"}},
+	}, "anna")
+
+	//then
+	if !slices.Equal(memberships, []string{"x", "y"}) {
+		log.Println("unexpected memberships with cycle:", memberships)
+		t.Fail()
+	}
+}
@@ -1,23 +1,105 @@
 package user
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
 	Email    string   `json:"email"`
 	Password string   `json:"password"`
 	Roles    []string `json:"roles"`
+	// Password is a bcrypt hash, the import hashes plain text passwords.
+	// PasswordChangedAt is the time the password was set, PasswordHistory
+	// holds bcrypt hashes of the previous passwords.
+	PasswordChangedAt time.Time `json:"password_changed_at"`
+	PasswordHistory   []string  `json:"password_history,omitempty"`
+	// EmailVerified is set once the user confirmed the email with a link
+	// sent to it. Imported users have to set it explicitly.
+	EmailVerified bool `json:"email_verified,omitempty"`
+	// Registered marks users who created the account themselves. They can
+	// not sign in with the password before the email is verified.
+	Registered bool   `json:"registered,omitempty"`
+	GivenName  string `json:"given_name,omitempty"`
+	FamilyName string `json:"family_name,omitempty"`
+	Locale     string `json:"locale,omitempty"`
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// TOTPLastStep is the time step of the last accepted code, codes of this
+	// or an earlier step are rejected.
+	TOTPLastStep int64     `json:"totp_last_step,omitempty"`
+	Passkeys     []Passkey `json:"passkeys,omitempty"`
+}
+
+// Passkey is a WebAuthn credential registered by the user. The credential is
+// kept as JSON, so the repository does not depend on the WebAuthn library.
+type Passkey struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// HasSecondFactor reports whether the login requires a TOTP code or a
+// passkey after the password.
+func (u *User) HasSecondFactor() bool {
+	return u.TOTPSecret != "" || len(u.Passkeys) > 0
+}
+
+// PasswordMatches compares the password with the stored one. Passwords are
+// stored as bcrypt hash, a plain text password is only left by users added
+// to a repository directly.
+func (u *User) PasswordMatches(password string) bool {
+	if u.Password == "" || password == "" {
+		return false
+	}
+	if HashedPassword(u.Password) {
+		return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+}
+
+// HashedPassword reports whether the stored password is a bcrypt hash.
+func HashedPassword(password string) bool {
+	_, err := bcrypt.Cost([]byte(password))
+	return err == nil
+}
+
+// PendingVerification reports whether the user registered and did not
+// verify the email yet.
+func (u *User) PendingVerification() bool {
+	return u.Registered && !u.EmailVerified
+}
+
+// LogValue omits the password and the second factors when a user is logged.
+func (u *User) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("email", u.Email),
+		slog.Any("roles", u.Roles),
+	)
 }
 
 type UserRepository interface {
 	All() []*User
 	GetUserByEmail(email string) (user *User, err error)
 	AddUser(user *User) (err error)
+	// UpdateUser replaces the stored user with the same email.
+	UpdateUser(user *User) (err error)
+	// ModifyUser calls modify with a copy of the stored user and stores the
+	// copy unless modify returns an error, which is returned. Concurrent
+	// modifications of a user are applied one after the other, so modify can
+	// check the stored values before changing them.
+	ModifyUser(email string, modify func(user *User) error) (modified *User, err error)
 	DeleteUserByEmail(email string) (err error)
 }
 
 type UserInMemoryRepo struct {
+	mu      sync.RWMutex
 	byEmail map[string]*User
 }
 
@@ -34,6 +116,9 @@ func NewUserInMemoryRepo(data map[string]*User) (repo *UserInMemoryRepo) {
 }
 
 func (r *UserInMemoryRepo) GetUserByEmail(email string) (user *User, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	user, found := r.byEmail[email]
 	if !found {
 		return &User{}, errors.New("user not found")
@@ -43,6 +128,9 @@ func (r *UserInMemoryRepo) GetUserByEmail(email string) (user *User, err error)
 }
 
 func (r *UserInMemoryRepo) All() []*User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	userList := make([]*User, len(r.byEmail))
 
 	for _, u := range r.byEmail {
@@ -53,6 +141,9 @@ func (r *UserInMemoryRepo) All() []*User {
 }
 
 func (r *UserInMemoryRepo) AddUser(user *User) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	_, found := r.byEmail[user.Email]
 	if found {
 		return errors.New("user already exists")
@@ -62,7 +153,40 @@ func (r *UserInMemoryRepo) AddUser(user *User) (err error) {
 	return nil
 }
 
+func (r *UserInMemoryRepo) UpdateUser(user *User) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, found := r.byEmail[user.Email]
+	if !found {
+		return errors.New("user not found")
+	}
+
+	r.byEmail[user.Email] = user
+	return nil
+}
+
+func (r *UserInMemoryRepo) ModifyUser(email string, modify func(user *User) error) (modified *User, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, found := r.byEmail[email]
+	if !found {
+		return nil, errors.New("user not found")
+	}
+
+	copied := *stored
+	if err := modify(&copied); err != nil {
+		return nil, err
+	}
+	r.byEmail[email] = &copied
+	return &copied, nil
+}
+
 func (r *UserInMemoryRepo) DeleteUserByEmail(email string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	_, found := r.byEmail[email]
 	if !found {
 		return errors.New("user not found")
@@ -0,0 +1,8 @@
+package view
+
+import "embed"
+
+// Files contains the page templates, see render.Renderer.
+//
+//go:embed *.html
+var Files embed.FS